@@ -30,6 +30,9 @@ type (
 		IsLastRename() (bool, bool)
 		IsLastUnlink() (bool, bool)
 		JobID() string
+		Flags() uint
+		HsmEvent() (llapi.HsmEvent, bool)
+		HsmError() int
 		String() string
 	}
 	// Handle represents an interface to a Lustre Changelog
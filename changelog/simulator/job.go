@@ -5,6 +5,8 @@
 package simulator
 
 import (
+	"fmt"
+	"math/rand"
 	"strconv"
 	"time"
 
@@ -18,6 +20,9 @@ type (
 		name   string
 		fid    *lustre.Fid
 		parent *lustre.Fid
+		isDir  bool
+		size   int64
+		links  []string
 	}
 
 	simJob struct {
@@ -28,54 +33,107 @@ type (
 		minFilesPerDirectory int
 		maxFileSize          int64
 		minFileSize          int64
+		linksPerFile         int
 
 		fidGenerator <-chan *lustre.Fid
 		records      recordChannel
+		dir          *simJobFile
 		files        []*simJobFile
 		done         doneChannel
 	}
 )
 
+func (j *simJob) fileSize() int64 {
+	if j.maxFileSize <= j.minFileSize {
+		return j.minFileSize
+	}
+	return j.minFileSize + rand.Int63n(j.maxFileSize-j.minFileSize+1)
+}
+
+// createFiles creates the files in a top-level directory named after
+// the job, so that names from concurrent jobs don't collide.
 func (j *simJob) createFiles() {
-	lastParent := &lustre.Fid{} // zero fid
+	j.dir = &simJobFile{
+		name:   j.id,
+		parent: &lustre.Fid{}, // zero fid
+		isDir:  true,
+	}
+	j.dir.fid = <-j.fidGenerator
+	j.sendMkdirRecord(j.dir)
+
+	lastParent := j.dir.fid
 	for i := 0; i < j.maxFileCount; i++ {
 		file := &simJobFile{
 			name:   strconv.Itoa(i),
 			parent: lastParent,
+			isDir:  i%j.maxFilesPerDirectory == 0,
 		}
 		file.fid = <-j.fidGenerator
-		j.sendCreateRecord(file)
-		if i%j.maxFilesPerDirectory == 0 {
+		if file.isDir {
+			j.sendMkdirRecord(file)
 			lastParent = file.fid
+		} else {
+			file.size = j.fileSize()
+			j.sendCreateRecord(file)
+			for n := 0; n < j.linksPerFile; n++ {
+				link := fmt.Sprintf("%s.%d", file.name, n)
+				j.sendLinkRecord(file, link)
+				file.links = append(file.links, link)
+			}
 		}
 		j.files[i] = file
 	}
 }
 
+// deleteFiles removes files in the reverse order of creation, so
+// directories are emptied before they are removed.
 func (j *simJob) deleteFiles() {
-	for _, file := range j.files {
-		j.sendUnlinkRecord(file)
+	for i := len(j.files) - 1; i >= 0; i-- {
+		file := j.files[i]
+		if file.isDir {
+			j.sendRmdirRecord(file)
+			continue
+		}
+		for _, link := range file.links {
+			j.sendUnlinkRecord(file, link, false)
+		}
+		j.sendUnlinkRecord(file, file.name, true)
 	}
+	j.sendRmdirRecord(j.dir)
 }
 
 func (j *simJob) sendCreateRecord(file *simJobFile) {
 	rec := &simRecord{
 		name:       file.name,
 		typeString: "CREAT",
-		typeCode:   1,
+		typeCode:   recCreate,
 		time:       time.Now(),
 		targetFid:  file.fid,
 		parentFid:  file.parent,
 		jobID:      j.id,
+		size:       file.size,
 	}
 	j.records <- rec
 }
 
-func (j *simJob) sendUnlinkRecord(file *simJobFile) {
+func (j *simJob) sendMkdirRecord(file *simJobFile) {
 	rec := &simRecord{
 		name:       file.name,
-		typeString: "UNLNK",
-		typeCode:   6,
+		typeString: "MKDIR",
+		typeCode:   recMkdir,
+		time:       time.Now(),
+		targetFid:  file.fid,
+		parentFid:  file.parent,
+		jobID:      j.id,
+	}
+	j.records <- rec
+}
+
+func (j *simJob) sendLinkRecord(file *simJobFile, name string) {
+	rec := &simRecord{
+		name:       name,
+		typeString: "HLINK",
+		typeCode:   recHardlink,
 		time:       time.Now(),
 		targetFid:  file.fid,
 		parentFid:  file.parent,
@@ -84,6 +142,34 @@ func (j *simJob) sendUnlinkRecord(file *simJobFile) {
 	j.records <- rec
 }
 
+func (j *simJob) sendUnlinkRecord(file *simJobFile, name string, last bool) {
+	rec := &simRecord{
+		name:         name,
+		typeString:   "UNLNK",
+		typeCode:     recUnlink,
+		time:         time.Now(),
+		targetFid:    file.fid,
+		parentFid:    file.parent,
+		jobID:        j.id,
+		isLastUnlink: last,
+	}
+	j.records <- rec
+}
+
+func (j *simJob) sendRmdirRecord(file *simJobFile) {
+	rec := &simRecord{
+		name:         file.name,
+		typeString:   "RMDIR",
+		typeCode:     recRmdir,
+		time:         time.Now(),
+		targetFid:    file.fid,
+		parentFid:    file.parent,
+		jobID:        j.id,
+		isLastUnlink: true,
+	}
+	j.records <- rec
+}
+
 func (j *simJob) Start() {
 	go func() {
 		j.createFiles()
@@ -140,6 +226,15 @@ func OptJobMinFileSize(size int64) func(*simJob) error {
 	}
 }
 
+// OptJobLinksPerFile sets the number of additional hard links created
+// for each file in the job
+func OptJobLinksPerFile(count int) func(*simJob) error {
+	return func(j *simJob) error {
+		j.linksPerFile = count
+		return nil
+	}
+}
+
 // OptJobID sets the job id
 func OptJobID(id string) func(*simJob) error {
 	return func(j *simJob) error {
@@ -0,0 +1,268 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package simulator
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/luser"
+)
+
+type (
+	nsEntry struct {
+		fid      lustre.Fid
+		mode     os.FileMode
+		size     int64
+		mtime    time.Time
+		links    []luser.LinkEntry
+		children map[string]lustre.Fid
+	}
+
+	// Namespace is a simulated Lustre namespace. It is updated as
+	// the simulator hands out records, so it always reflects the
+	// state of the filesystem as of the last record returned by
+	// NextRecord(). It implements fs.Namespace.
+	Namespace struct {
+		mu      sync.RWMutex
+		entries map[lustre.Fid]*nsEntry
+	}
+
+	simFileInfo struct {
+		name  string
+		size  int64
+		mode  os.FileMode
+		mtime time.Time
+	}
+)
+
+// The simulator uses the zero fid as the parent of top-level files,
+// so that is the root of the simulated namespace.
+var rootFid = lustre.Fid{}
+
+func (fi *simFileInfo) Name() string       { return fi.name }
+func (fi *simFileInfo) Size() int64        { return fi.size }
+func (fi *simFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *simFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *simFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *simFileInfo) Sys() interface{}   { return nil }
+
+func newNamespace() *Namespace {
+	ns := &Namespace{
+		entries: make(map[lustre.Fid]*nsEntry),
+	}
+	ns.entries[rootFid] = &nsEntry{
+		fid:      rootFid,
+		mode:     os.ModeDir | 0755,
+		mtime:    time.Now(),
+		children: make(map[string]lustre.Fid),
+	}
+	return ns
+}
+
+func notFound(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+}
+
+// apply updates the namespace with the effects of a record.
+func (ns *Namespace) apply(r *simRecord) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	switch r.typeCode {
+	case recCreate:
+		ns.create(r.parentFid, r.targetFid, r.name, 0644, r.size, r.time)
+	case recMkdir:
+		ns.create(r.parentFid, r.targetFid, r.name, os.ModeDir|0755, 0, r.time)
+	case recHardlink:
+		ns.link(r.parentFid, r.targetFid, r.name)
+	case recUnlink, recRmdir:
+		ns.unlink(r.parentFid, r.name)
+	}
+}
+
+func (ns *Namespace) create(parent, fid *lustre.Fid, name string, mode os.FileMode, size int64, mtime time.Time) {
+	e := &nsEntry{
+		fid:   *fid,
+		mode:  mode,
+		size:  size,
+		mtime: mtime,
+	}
+	if mode.IsDir() {
+		e.children = make(map[string]lustre.Fid)
+	}
+	ns.entries[*fid] = e
+	ns.link(parent, fid, name)
+}
+
+func (ns *Namespace) link(parent, fid *lustre.Fid, name string) {
+	p, ok := ns.entries[*parent]
+	if !ok {
+		return
+	}
+	e, ok := ns.entries[*fid]
+	if !ok {
+		return
+	}
+	if p.children == nil {
+		p.children = make(map[string]lustre.Fid)
+	}
+	p.children[name] = *fid
+	e.links = append(e.links, luser.LinkEntry{Name: name, Parent: *parent})
+}
+
+func (ns *Namespace) unlink(parent *lustre.Fid, name string) {
+	p, ok := ns.entries[*parent]
+	if !ok {
+		return
+	}
+	fid, ok := p.children[name]
+	if !ok {
+		return
+	}
+	delete(p.children, name)
+
+	e := ns.entries[fid]
+	for i, l := range e.links {
+		if l.Parent == *parent && l.Name == name {
+			e.links = append(e.links[:i], e.links[i+1:]...)
+			break
+		}
+	}
+	if len(e.links) == 0 {
+		delete(ns.entries, fid)
+	}
+}
+
+// entryPath returns the root-relative path of the entry's first link.
+func (ns *Namespace) entryPath(e *nsEntry) (string, bool) {
+	var names []string
+	for e.fid != rootFid {
+		if len(e.links) == 0 {
+			return "", false
+		}
+		l := e.links[0]
+		names = append([]string{l.Name}, names...)
+		p, ok := ns.entries[l.Parent]
+		if !ok {
+			return "", false
+		}
+		e = p
+	}
+	return path.Join(names...), true
+}
+
+func (ns *Namespace) pathnames(f *lustre.Fid) ([]string, error) {
+	e, ok := ns.entries[*f]
+	if !ok {
+		return nil, notFound("fid2path", f.String())
+	}
+	if e.fid == rootFid {
+		return []string{""}, nil
+	}
+
+	var paths []string
+	for _, l := range e.links {
+		p, ok := ns.entries[l.Parent]
+		if !ok {
+			continue
+		}
+		dir, ok := ns.entryPath(p)
+		if !ok {
+			continue
+		}
+		paths = append(paths, path.Join(dir, l.Name))
+	}
+	if len(paths) == 0 {
+		return nil, notFound("fid2path", f.String())
+	}
+	return paths, nil
+}
+
+// FidPathname returns the linkno'th path for the fid, relative to the
+// root of the simulated filesystem.
+func (ns *Namespace) FidPathname(f *lustre.Fid, linkno int) (string, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	paths, err := ns.pathnames(f)
+	if err != nil {
+		return "", err
+	}
+	if linkno < 0 || linkno >= len(paths) {
+		return "", notFound("fid2path", f.String())
+	}
+	return paths[linkno], nil
+}
+
+// FidPathnames returns all paths for the fid, relative to the root of
+// the simulated filesystem.
+func (ns *Namespace) FidPathnames(f *lustre.Fid) ([]string, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	return ns.pathnames(f)
+}
+
+// LookupFid returns the fid for a path relative to the root of the
+// simulated filesystem.
+func (ns *Namespace) LookupFid(p string) (*lustre.Fid, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	e := ns.entries[rootFid]
+	for _, name := range strings.Split(path.Clean("/"+p), "/") {
+		if name == "" {
+			continue
+		}
+		fid, ok := e.children[name]
+		if !ok {
+			return nil, notFound("path2fid", p)
+		}
+		e = ns.entries[fid]
+	}
+	fid := e.fid
+	return &fid, nil
+}
+
+// StatFid returns an os.FileInfo for the fid. The name is that of the
+// first link to the file.
+func (ns *Namespace) StatFid(f *lustre.Fid) (os.FileInfo, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	e, ok := ns.entries[*f]
+	if !ok {
+		return nil, notFound("stat", f.String())
+	}
+	fi := &simFileInfo{
+		size:  e.size,
+		mode:  e.mode,
+		mtime: e.mtime,
+	}
+	if len(e.links) > 0 {
+		fi.name = e.links[0].Name
+	}
+	return fi, nil
+}
+
+// LinkEA returns the simulated link extended attribute for the fid.
+func (ns *Namespace) LinkEA(f *lustre.Fid) ([]luser.LinkEntry, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	e, ok := ns.entries[*f]
+	if !ok {
+		return nil, notFound("getxattr", f.String())
+	}
+	links := make([]luser.LinkEntry, len(e.links))
+	copy(links, e.links)
+	return links, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package simulator_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/intel-hpdd/go-lustre/changelog/simulator"
+	"github.com/intel-hpdd/go-lustre/fs"
+)
+
+func TestNamespace(t *testing.T) {
+	sim, err := simulator.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sim.AddJob(
+		simulator.OptJobID("ns"),
+		simulator.OptJobMaxFileCount(8),
+		simulator.OptJobMaxFilesPerDirectory(4),
+		simulator.OptJobLinksPerFile(1),
+		simulator.OptJobMinFileSize(100),
+		simulator.OptJobMaxFileSize(100),
+	); err != nil {
+		t.Fatal(err)
+	}
+	sim.Start()
+	defer sim.Stop()
+
+	var ns fs.Namespace = sim.Namespace()
+	h := sim.GetHandle()
+
+	rec, err := h.NextRecord()
+	for ; err == nil; rec, err = h.NextRecord() {
+		switch rec.Type() {
+		case "CREAT":
+			paths, err := ns.FidPathnames(rec.TargetFid())
+			if err != nil {
+				t.Fatalf("%s: %s", rec, err)
+			}
+			if len(paths) != 1 {
+				t.Fatalf("%s: expected 1 path, got %v", rec, paths)
+			}
+			fid, err := ns.LookupFid(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *fid != *rec.TargetFid() {
+				t.Fatalf("path2fid(%s) = %s, expected %s", paths[0], fid, rec.TargetFid())
+			}
+			fi, err := ns.StatFid(fid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 100 || fi.IsDir() {
+				t.Fatalf("%s: unexpected stat %v %v", paths[0], fi.Size(), fi.Mode())
+			}
+		case "HLINK":
+			paths, err := ns.FidPathnames(rec.TargetFid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(paths) != 2 {
+				t.Fatalf("%s: expected 2 paths, got %v", rec, paths)
+			}
+			second, err := ns.FidPathname(rec.TargetFid(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second != paths[1] {
+				t.Fatalf("link 1: got %s, expected %s", second, paths[1])
+			}
+			links, err := ns.LinkEA(rec.TargetFid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(links) != 2 || links[1].Name != rec.Name() {
+				t.Fatalf("unexpected linkEA %v", links)
+			}
+		case "MKDIR":
+			fi, err := ns.StatFid(rec.TargetFid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fi.IsDir() {
+				t.Fatalf("%s: expected a directory", rec)
+			}
+		case "UNLNK", "RMDIR":
+			last, _ := rec.IsLastUnlink()
+			_, err := ns.StatFid(rec.TargetFid())
+			if last && err == nil {
+				t.Fatalf("%s: fid still exists after last unlink", rec)
+			}
+			if !last && err != nil {
+				t.Fatalf("%s: %s", rec, err)
+			}
+		}
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if _, err := ns.LookupFid("ns"); err == nil {
+		t.Fatal("job directory still exists after all records")
+	}
+}
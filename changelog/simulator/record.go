@@ -10,6 +10,16 @@ import (
 	"time"
 
 	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+// Record type codes, as defined by the Lustre changelog.
+const (
+	recCreate   = 1
+	recMkdir    = 2
+	recHardlink = 3
+	recUnlink   = 6
+	recRmdir    = 7
 )
 
 type simRecord struct {
@@ -28,6 +38,11 @@ type simRecord struct {
 	isLastUnlink    bool
 	hasCruft        bool
 	jobID           string
+	hsmEvent        llapi.HsmEvent
+	hsmError        int
+
+	// size of a created file, used to update the Namespace
+	size int64
 }
 
 func (r *simRecord) Index() int64 {
@@ -82,6 +97,18 @@ func (r *simRecord) IsLastUnlink() (bool, bool) {
 	return r.isLastUnlink, r.hasCruft
 }
 
+func (r *simRecord) Flags() uint {
+	return 0
+}
+
+func (r *simRecord) HsmEvent() (llapi.HsmEvent, bool) {
+	return r.hsmEvent, r.typeCode == llapi.OpHSM
+}
+
+func (r *simRecord) HsmError() int {
+	return r.hsmError
+}
+
 func (r *simRecord) JobID() string {
 	return r.jobID
 }
@@ -29,6 +29,7 @@ type (
 		indexGenerator <-chan int64
 		fidGenerator   <-chan *lustre.Fid
 		jobs           map[string]*simJob
+		namespace      *Namespace
 	}
 )
 
@@ -47,6 +48,12 @@ func (s *Simulator) GetHandle() changelog.Handle {
 	}
 }
 
+// Namespace returns the simulated namespace that backs the records
+// generated by the simulator.
+func (s *Simulator) Namespace() *Namespace {
+	return s.namespace
+}
+
 // AddJob creates a new job and adds it to the simulator
 func (s *Simulator) AddJob(options ...simJobOption) error {
 	job, err := newJob(s.fidGenerator, options...)
@@ -117,6 +124,7 @@ func (s *Simulator) NextRecord() (changelog.Record, error) {
 	case rec := <-s.recordQueue:
 		if r, ok := rec.(*simRecord); ok {
 			r.index = <-s.indexGenerator
+			s.namespace.apply(r)
 			return r, nil
 		}
 	}
@@ -174,6 +182,7 @@ func New(options ...simulatorOption) (*Simulator, error) {
 		indexGenerator: newIndexGenerator(),
 		jobs:           make(map[string]*simJob),
 		recordQueue:    make(recordChannel, 1024),
+		namespace:      newNamespace(),
 	}
 
 	for _, option := range options {
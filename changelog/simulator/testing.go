@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package simulator
+
+import (
+	"io"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	// RecordOption sets a field of a record returned by
+	// NewTestRecord.
+	RecordOption func(*simRecord)
+
+	// RecordList is a changelog.RecordIterator that returns its
+	// records in order, then io.EOF.
+	RecordList []changelog.Record
+)
+
+// TestFid returns a fid in the normal sequence, for testing.
+func TestFid(n uint32) *lustre.Fid {
+	return &lustre.Fid{Seq: 0x200000400, Oid: n}
+}
+
+// NewTestRecord returns a changelog record of type typeCode for fid,
+// for testing changelog consumers without running a simulation.
+func NewTestRecord(index int64, typeCode uint, fid *lustre.Fid, options ...RecordOption) changelog.Record {
+	r := &simRecord{
+		index:     index,
+		typeCode:  typeCode,
+		time:      time.Now(),
+		targetFid: fid,
+		isRename:  typeCode == llapi.OpRename,
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// OptRecordTime sets the time of the record.
+func OptRecordTime(t time.Time) RecordOption {
+	return func(r *simRecord) {
+		r.time = t
+	}
+}
+
+// OptRecordLast marks an unlink or rename record as removing the last
+// link to the file. If exists is true the file also exists in the
+// archive.
+func OptRecordLast(exists bool) RecordOption {
+	return func(r *simRecord) {
+		switch r.typeCode {
+		case llapi.OpUnlink:
+			r.isLastUnlink = true
+		case llapi.OpRename:
+			r.isLastRename = true
+		}
+		r.hasCruft = exists
+	}
+}
+
+// OptRecordHsmEvent sets the event and error of an HSM record.
+func OptRecordHsmEvent(event llapi.HsmEvent, errval int) RecordOption {
+	return func(r *simRecord) {
+		r.hsmEvent = event
+		r.hsmError = errval
+	}
+}
+
+// NextRecord returns the next record in the list.
+func (l *RecordList) NextRecord() (changelog.Record, error) {
+	if len(*l) == 0 {
+		return nil, io.EOF
+	}
+	rec := (*l)[0]
+	*l = (*l)[1:]
+	return rec, nil
+}
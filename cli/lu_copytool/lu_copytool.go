@@ -0,0 +1,219 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// lu_copytool is a reference HSM copytool that archives files into a
+// local directory tree.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/hsm/gc"
+	"github.com/intel-hpdd/go-lustre/hsm/metrics"
+	"github.com/intel-hpdd/go-lustre/hsm/posix"
+)
+
+var (
+	archiveDir   string
+	archiveID    uint
+	workers      int
+	drainTimeout time.Duration
+	reregister   time.Duration
+	limits       = make(archiveLimits)
+	metricsAddr  string
+	auditFile    string
+	eventFifo    string
+
+	gcMDT     string
+	gcUser    string
+	gcJournal string
+	gcGrace   time.Duration
+)
+
+// archiveLimits is a flag.Value for repeated ID:CONCURRENCY[:BANDWIDTH]
+// arguments.
+type archiveLimits map[uint]hsm.ArchiveLimits
+
+func (al archiveLimits) String() string {
+	var parts []string
+	for id, l := range al {
+		parts = append(parts, fmt.Sprintf("%d:%d:%d", id, l.Concurrency, l.Bandwidth))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (al archiveLimits) Set(value string) error {
+	fields := strings.Split(value, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return fmt.Errorf("expected ID:CONCURRENCY[:BANDWIDTH], got %q", value)
+	}
+	var nums [3]int64
+	for i, f := range fields {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return err
+		}
+		nums[i] = n
+	}
+	al[uint(nums[0])] = hsm.ArchiveLimits{Concurrency: int(nums[1]), Bandwidth: nums[2]}
+	return nil
+}
+
+func init() {
+	flag.StringVar(&archiveDir, "archive", "", "Directory to store archived files in.")
+	flag.UintVar(&archiveID, "id", 0, "Only handle actions for this archive ID (default all).")
+	flag.IntVar(&workers, "workers", 4, "Number of actions to process concurrently.")
+	flag.DurationVar(&drainTimeout, "drain", time.Minute, "How long running actions may finish after a shutdown signal.")
+	flag.Var(limits, "limit", "Limit an archive ID to `ID:CONCURRENCY[:BANDWIDTH]` actions and bytes per second (0 is unlimited). May be repeated.")
+	flag.StringVar(&metricsAddr, "metrics", "", "Serve Prometheus metrics at http://`ADDR`/metrics.")
+	flag.StringVar(&auditFile, "audit", "", "Append a JSON line for each completed action to `FILE`.")
+	flag.StringVar(&eventFifo, "events", "", "Write copytool events to the FIFO at `PATH`, like a liblustreapi copytool.")
+	flag.DurationVar(&reregister, "reregister", 0, "Register with the coordinator again at this interval after it shuts down (default exit).")
+	flag.StringVar(&gcMDT, "gc-mdt", "", "Remove archived copies of files deleted from this MDT.")
+	flag.StringVar(&gcUser, "gc-user", "", "Changelog user registered on the gc MDT (with lctl changelog_register) whose records are cleared once journaled.")
+	flag.StringVar(&gcJournal, "gc-journal", "", "Journal of pending removals (default ARCHIVE/gc.journal).")
+	flag.DurationVar(&gcGrace, "gc-grace", 24*time.Hour, "How long to keep archived copies of deleted files.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -archive DIR [-id ARCHIVE] [-workers N] [-limit ID:N[:BW]] [-gc-mdt MDT -gc-user USER] /lustre/mount\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || archiveDir == "" || (gcMDT != "" && gcUser == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	root, err := fs.MountRoot(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := posix.NewStore(archiveDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend := posix.NewBackend(root, store)
+
+	// The source waits a little longer than the copytool, so actions
+	// canceled at the drain timeout are ended before it unregisters.
+	sourceOptions := []hsm.ActionSourceOption{
+		hsm.OptSourceDrainTimeout(drainTimeout + 10*time.Second),
+	}
+	if reregister > 0 {
+		sourceOptions = append(sourceOptions, hsm.OptSourceReregister(reregister))
+	}
+	if archiveID != 0 {
+		sourceOptions = append(sourceOptions, hsm.OptSourceArchiveIDs(archiveID))
+	}
+	source := hsm.NewActionSource(root, sourceOptions...)
+
+	ctOptions := []hsm.CopytoolOption{
+		hsm.OptCopytoolWorkers(workers),
+		hsm.OptCopytoolDrainTimeout(drainTimeout),
+	}
+	for id, l := range limits {
+		ctOptions = append(ctOptions, hsm.OptCopytoolArchiveLimits(id, l))
+	}
+	if metricsAddr != "" {
+		collector := metrics.NewCollector(nil)
+		ctOptions = append(ctOptions, hsm.OptCopytoolObserver(collector))
+		http.Handle("/metrics", collector)
+		go func() {
+			log.Fatal(http.ListenAndServe(metricsAddr, nil))
+		}()
+	}
+	if auditFile != "" {
+		f, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		ctOptions = append(ctOptions, hsm.OptCopytoolObserver(hsm.NewAuditLog(f)))
+	}
+	if eventFifo != "" {
+		w, err := hsm.CreateEventFifo(eventFifo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+		var archives []uint
+		if archiveID != 0 {
+			archives = append(archives, archiveID)
+		}
+		ctOptions = append(ctOptions, hsm.OptCopytoolEvents(hsm.NewEventWriter(w, root.Path(), archives...)))
+	}
+	ct, err := hsm.NewCopytool(source, backend, ctOptions...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, shutting down", sig)
+		cancel()
+	}()
+
+	// SIGUSR1 logs the depth of each archive's queues.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			for _, d := range ct.QueueDepths() {
+				log.Printf("archive %d: %d restores and %d others queued, %d running",
+					d.ArchiveID, d.Restores, d.Other, d.Running)
+			}
+		}
+	}()
+
+	if gcMDT != "" {
+		if gcJournal == "" {
+			gcJournal = filepath.Join(archiveDir, "gc.journal")
+		}
+		collector, err := gc.NewCollector(backend, gcJournal,
+			gc.OptCollectorGracePeriod(gcGrace),
+			gc.OptCollectorChangelogUser(gcMDT, gcUser))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer collector.Close()
+
+		follower := changelog.CreateFollower(gcMDT, collector.LastIndex()+1)
+		go func() {
+			<-ctx.Done()
+			follower.Close()
+		}()
+		go func() {
+			if err := collector.Run(ctx, follower, time.Minute); err != nil && err != context.Canceled {
+				log.Printf("gc: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	if err := ct.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
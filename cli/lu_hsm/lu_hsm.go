@@ -0,0 +1,173 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// lu_hsm displays and controls the state of the HSM coordinators on an
+// MDS.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/intel-hpdd/go-lustre/status"
+)
+
+var (
+	paramRoot string
+	mdtName   string
+	verbose   bool
+)
+
+func init() {
+	flag.StringVar(&paramRoot, "root", status.DefaultParamRoot, "Directory holding the Lustre parameter files.")
+	flag.StringVar(&mdtName, "mdt", "", "Only show or control this MDT (default all).")
+	flag.BoolVar(&verbose, "v", false, "List the waiting and started actions in the coordinator log.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-root DIR] [-mdt MDT] [-v] [status|enabled|disabled|shutdown|purge]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func archiveIDs(ids []uint) string {
+	if ids == nil {
+		return "ANY"
+	}
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
+
+func showStatus(c *status.Coordinator) error {
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	policy, err := c.Policy()
+	if err != nil {
+		return err
+	}
+	timeouts, err := c.Timeouts()
+	if err != nil {
+		return err
+	}
+	agents, err := c.Agents()
+	if err != nil {
+		return err
+	}
+	active, err := c.ActiveRequests()
+	if err != nil {
+		return err
+	}
+	actions, err := c.Actions()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %s, policy %s\n", c, state, policy)
+	fmt.Printf("  active_request_timeout %v, loop_period %v, grace_delay %v, max_requests %d, default_archive_id %d\n",
+		timeouts.ActiveRequestTimeout, timeouts.LoopPeriod, timeouts.GraceDelay,
+		timeouts.MaxRequests, timeouts.DefaultArchiveID)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	registered := make(map[string]bool)
+	fmt.Printf("  %d agents:\n", len(agents))
+	if len(agents) > 0 {
+		fmt.Fprintln(tw, "    UUID\tARCHIVES\tCURRENT\tOK\tERRORS")
+	}
+	for _, a := range agents {
+		registered[a.UUID] = true
+		fmt.Fprintf(tw, "    %s\t%s\t%d\t%d\t%d\n", a.UUID, archiveIDs(a.ArchiveIDs), a.Current, a.OK, a.Errors)
+	}
+	tw.Flush()
+
+	counts := make(map[string]int)
+	for _, a := range actions {
+		counts[a.Status]++
+	}
+	var statuses []string
+	for s, n := range counts {
+		statuses = append(statuses, fmt.Sprintf("%d %s", n, s))
+	}
+	sort.Strings(statuses)
+	fmt.Printf("  %d actions logged: %s\n", len(actions), strings.Join(statuses, ", "))
+
+	// Requests whose agent has gone are stuck until they time out.
+	fmt.Printf("  %d active requests:\n", len(active))
+	if len(active) > 0 {
+		fmt.Fprintln(tw, "    COOKIE\tACTION\tARCHIVE\tFID\tAGENT\tNOTE")
+	}
+	for _, r := range active {
+		var notes []string
+		if !registered[r.AgentUUID] {
+			notes = append(notes, "agent missing")
+		}
+		if r.Canceled {
+			notes = append(notes, "canceled")
+		}
+		fmt.Fprintf(tw, "    %#x\t%s\t%d\t%s\t%s\t%s\n", r.Cookie, r.Action, r.ArchiveID,
+			&r.Fid, r.AgentUUID, strings.Join(notes, ", "))
+	}
+	tw.Flush()
+
+	if verbose {
+		fmt.Println("  pending actions:")
+		fmt.Fprintln(tw, "    IDX\tCOOKIE\tACTION\tARCHIVE\tFID\tEXTENT\tSTATUS")
+		for _, a := range actions {
+			if a.Status != "WAITING" && a.Status != "STARTED" {
+				continue
+			}
+			fmt.Fprintf(tw, "    %d\t%#x\t%s\t%d\t%s\t%s\t%s\n", a.Index, a.Cookie, a.Action,
+				a.ArchiveID, &a.Fid, a.Extent, a.Status)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	command := "status"
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		command = flag.Arg(0)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var cdts []*status.Coordinator
+	if mdtName != "" {
+		cdts = []*status.Coordinator{status.NewCoordinator(paramRoot, mdtName)}
+	} else {
+		var err error
+		cdts, err = status.Coordinators(paramRoot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(cdts) == 0 {
+			log.Fatalf("no MDTs found in %s", paramRoot)
+		}
+	}
+
+	for _, c := range cdts {
+		var err error
+		if command == "status" {
+			err = showStatus(c)
+		} else {
+			err = c.SetState(status.CoordinatorState(command))
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", c, err)
+		}
+	}
+}
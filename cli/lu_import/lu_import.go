@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// lu_import creates released files in a Lustre filesystem for each file
+// listed in the manifest of an archive, and writes a map of each file's
+// backend key to its new FID.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/hsm/importer"
+)
+
+var (
+	journalPath string
+	mapPath     string
+	format      string
+	archiveID   uint
+	workers     int
+)
+
+func init() {
+	flag.StringVar(&journalPath, "journal", "", "Progress journal, used to resume an interrupted import.")
+	flag.StringVar(&mapPath, "map", "", "Write the map of backend keys to FIDs to this file.")
+	flag.StringVar(&format, "format", "", "Manifest format, json or csv. Defaults to csv for .csv files, otherwise json.")
+	flag.UintVar(&archiveID, "archive", 1, "Archive ID for entries without one.")
+	flag.IntVar(&workers, "workers", 8, "Number of files to import concurrently.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -journal FILE [-map FILE] [-format json|csv] [-archive ID] [-workers N] MANIFEST DIR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func openManifest(path string) (importer.Manifest, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == "" {
+		format = "json"
+		if strings.HasSuffix(path, ".csv") {
+			format = "csv"
+		}
+	}
+	switch format {
+	case "json":
+		return importer.NewJSONManifest(f), f, nil
+	case "csv":
+		m, err := importer.NewCSVManifest(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return m, f, nil
+	}
+	f.Close()
+	return nil, nil, fmt.Errorf("unknown manifest format: %s", format)
+}
+
+func writeMap() error {
+	f, err := os.Create(mapPath)
+	if err != nil {
+		return err
+	}
+	if err := importer.WriteMap(f, journalPath); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 || journalPath == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	m, closer, err := openManifest(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closer.Close()
+
+	im, err := importer.NewImporter(flag.Arg(1), journalPath,
+		importer.OptImporterWorkers(workers),
+		importer.OptImporterArchiveID(archiveID))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	stats, err := im.Run(ctx, m)
+	if cerr := im.Close(); err == nil {
+		err = cerr
+	}
+	fmt.Printf("%d imported, %d skipped, %d failed\n", stats.Imported, stats.Skipped, stats.Failed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if mapPath != "" {
+		if err := writeMap(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if stats.Failed > 0 {
+		os.Exit(2)
+	}
+}
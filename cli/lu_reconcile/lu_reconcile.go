@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// lu_reconcile compares the HSM state of files in a Lustre filesystem
+// with the contents of a POSIX archive, and optionally repairs the
+// differences.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm/posix"
+	"github.com/intel-hpdd/go-lustre/hsm/reconcile"
+)
+
+var (
+	archiveDir string
+	archiveID  uint
+	verify     bool
+	repair     bool
+)
+
+func init() {
+	flag.StringVar(&archiveDir, "archive", "", "Directory the archive is stored in.")
+	flag.UintVar(&archiveID, "id", 1, "Archive ID of the archive.")
+	flag.BoolVar(&verify, "verify", false, "Compare the checksum of each archived file's data.")
+	flag.BoolVar(&repair, "repair", false, "Re-archive files with missing or bad copies, and mark unrecoverable files lost.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -archive DIR [-id ARCHIVE] [-verify] [-repair] DIR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || archiveDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	root, err := fs.MountRoot(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := posix.NewStore(archiveDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var options []reconcile.ReconcilerOption
+	if verify {
+		options = append(options, reconcile.OptReconcileVerifyChecksums())
+	}
+	if repair {
+		options = append(options, reconcile.OptReconcileRepair())
+	}
+	r := reconcile.NewReconciler(root, uint32(archiveID), store, options...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	report, err := r.Run(ctx, flag.Arg(0))
+	if report != nil {
+		for _, f := range report.Findings {
+			fmt.Println(f)
+		}
+		fmt.Printf("%d files, %d objects: %d orphan, %d missing, %d mismatch, %d lost\n",
+			report.Files, report.Objects,
+			report.Count(reconcile.Orphan), report.Count(reconcile.Missing),
+			report.Count(reconcile.Mismatch), report.Count(reconcile.Lost))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if report.Count(reconcile.Lost) > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// lu_release is a daemon which releases archived files, least recently
+// used first, when OSTs fill past a high watermark.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm/release"
+	"github.com/intel-hpdd/go-lustre/status"
+)
+
+var (
+	mdt       string
+	user      string
+	indexPath string
+	pool      string
+	high      float64
+	low       float64
+	interval  time.Duration
+	batchSize int
+)
+
+func init() {
+	flag.StringVar(&mdt, "mdt", "", "MDT whose changelog is used to track file access.")
+	flag.StringVar(&user, "user", "", "Changelog user registered on the MDT (with lctl changelog_register) whose records are cleared once saved.")
+	flag.StringVar(&indexPath, "index", "", "File the access time index is saved in, to resume after a restart.")
+	flag.StringVar(&pool, "pool", "", "Only watch the OSTs in this pool.")
+	flag.Float64Var(&high, "high", 0.9, "Start releasing files above this fill level.")
+	flag.Float64Var(&low, "low", 0.8, "Stop releasing files below this fill level.")
+	flag.DurationVar(&interval, "interval", time.Minute, "How often to check the fill level.")
+	flag.IntVar(&batchSize, "batch", 100, "Number of files released per request.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -mdt MDT -user USER -index FILE [-pool POOL] [-high N] [-low N] /lustre/mount\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || mdt == "" || user == "" || indexPath == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	root, err := fs.MountRoot(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := status.Client(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	index, err := release.LoadAtimeIndex(indexPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("loaded %d files from %s, resuming after record %d", index.Len(), indexPath, index.LastIndex())
+	d, err := release.NewDaemon(root, index, release.OSTUsage(client, pool), high, low,
+		release.OptDaemonInterval(interval),
+		release.OptDaemonBatchSize(batchSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, shutting down", sig)
+		cancel()
+	}()
+
+	follower := changelog.CreateFollower(mdt, index.LastIndex()+1)
+	go func() {
+		<-ctx.Done()
+		follower.Close()
+	}()
+	go func() {
+		if err := index.Follow(ctx, follower, time.Second); err != nil && err != context.Canceled {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkpoint(index)
+			}
+		}
+	}()
+
+	if err := d.Run(ctx); err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+	checkpoint(index)
+	log.Printf("%+v", d.Stats())
+}
+
+// checkpoint saves the index, and then clears the changelog records it
+// reflects.
+func checkpoint(index *release.AtimeIndex) {
+	last, err := index.Save(indexPath)
+	if err != nil {
+		log.Printf("save index: %v", err)
+		return
+	}
+	if last == 0 {
+		return
+	}
+	if err := changelog.Clear(mdt, user, last); err != nil {
+		log.Printf("clear changelog for %s: %v", user, err)
+	}
+}
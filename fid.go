@@ -37,18 +37,21 @@ func (f *Fid) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON converts fid string to Fid.
 func (f *Fid) UnmarshalJSON(b []byte) (err error) {
 	// trim the '"'
-	if b[0] == '"' {
+	if len(b) > 1 && b[0] == '"' {
 		b = b[1 : len(b)-1]
 	}
 	newFid, err := ParseFid(string(b))
+	if err != nil {
+		return err
+	}
 	*f = *newFid
-	return err
+	return nil
 }
 
 // ParseFid converts a fid in string format to a Fid
 func ParseFid(fidstr string) (*Fid, error) {
 	fid := &Fid{}
-	if fidstr[0] == '[' {
+	if len(fidstr) > 1 && fidstr[0] == '[' {
 		fidstr = fidstr[1 : len(fidstr)-1]
 	}
 	n, err := fmt.Sscanf(fidstr, "0x%x:0x%x:0x%x", &fid.Seq, &fid.Oid, &fid.Ver)
@@ -0,0 +1,35 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"os"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/luser"
+)
+
+// Namespace answers path and metadata queries for the files in a
+// filesystem. Consumers that need to map between fids and names
+// should accept a Namespace rather than calling the llapi-backed
+// functions directly, so a simulated namespace can be injected
+// for testing.
+type Namespace interface {
+	// FidPathname returns a path for the fid, relative to the root
+	// of the filesystem. The linkno selects a specific hard link.
+	FidPathname(f *lustre.Fid, linkno int) (string, error)
+
+	// FidPathnames returns all paths that refer to the fid.
+	FidPathnames(f *lustre.Fid) ([]string, error)
+
+	// LookupFid returns the fid for a path relative to the root.
+	LookupFid(path string) (*lustre.Fid, error)
+
+	// StatFid returns an os.FileInfo for the fid.
+	StatFid(f *lustre.Fid) (os.FileInfo, error)
+
+	// LinkEA returns the link extended attribute entries for the fid.
+	LinkEA(f *lustre.Fid) ([]luser.LinkEntry, error)
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/go-lustre/fs"
@@ -29,8 +30,13 @@ const (
 type (
 	// CoordinatorClient receives HSM actions to execute.
 	CoordinatorClient struct {
-		root fs.RootDir
-		hcp  *llapi.HsmCopytoolPrivate
+		root     fs.RootDir
+		hcp      *llapi.HsmCopytoolPrivate
+		archives []uint
+
+		// outstanding counts the actions received which have not
+		// been ended yet.
+		outstanding sync.WaitGroup
 	}
 
 	// ActionItem is one action to perform on specified file.
@@ -41,6 +47,17 @@ type (
 		hai       llapi.HsmActionItem
 		halFlags  uint64
 		archiveID uint
+		fsName    string
+		finished  bool
+
+		// dataVersion is the version of the data archived, set
+		// with SetDataVersion.
+		dataVersion    uint64
+		hasDataVersion bool
+
+		// layoutPending is set until the data file of a restore
+		// has a layout.
+		layoutPending bool
 	}
 
 	// ErrIOError are errors that returned by the HSM library.
@@ -58,9 +75,11 @@ func IoError(msg string) error {
 	return errors.New(msg)
 }
 
-// NewCoordinatorClient opens a connection to the coordinator.
-func NewCoordinatorClient(path fs.RootDir, nonBlocking bool) (*CoordinatorClient, error) {
-	var cdc = CoordinatorClient{root: path}
+// NewCoordinatorClient opens a connection to the coordinator. If any
+// archive IDs are given, only actions for those archives are received,
+// otherwise actions for all archives are received.
+func NewCoordinatorClient(path fs.RootDir, nonBlocking bool, archives ...uint) (*CoordinatorClient, error) {
+	var cdc = CoordinatorClient{root: path, archives: archives}
 	var err error
 
 	flags := llapi.CopytoolDefault
@@ -69,13 +88,32 @@ func NewCoordinatorClient(path fs.RootDir, nonBlocking bool) (*CoordinatorClient
 		flags = llapi.CopytoolNonBlock
 	}
 
-	cdc.hcp, err = llapi.HsmCopytoolRegister(path.String(), 0, nil, flags)
+	ids := make([]int, len(archives))
+	for i, id := range archives {
+		ids[i] = int(id)
+	}
+
+	cdc.hcp, err = llapi.HsmCopytoolRegister(path.String(), len(ids), ids, flags)
 	if err != nil {
 		return nil, err
 	}
 	return &cdc, nil
 }
 
+// handlesArchive returns true if the client is registered for the
+// archive ID.
+func (cdc *CoordinatorClient) handlesArchive(archiveID uint) bool {
+	if len(cdc.archives) == 0 {
+		return true
+	}
+	for _, id := range cdc.archives {
+		if id == archiveID {
+			return true
+		}
+	}
+	return false
+}
+
 // Recv blocks and waits for new action items from the coordinator.
 // Retuns a slice of *actionItem.
 func (cdc *CoordinatorClient) recv() ([]*actionItem, error) {
@@ -88,15 +126,29 @@ func (cdc *CoordinatorClient) recv() ([]*actionItem, error) {
 		return nil, err
 	}
 	items := make([]*actionItem, len(actionList.Items))
+	cdc.outstanding.Add(len(items))
 	for i, hai := range actionList.Items {
 		item := &actionItem{
 			halFlags:  actionList.Flags,
 			archiveID: actionList.ArchiveID,
+			fsName:    actionList.FsName,
 			cdc:       cdc,
 			hai:       hai,
 		}
 		items[i] = item
 	}
+
+	// The coordinator should only send actions for the archives we
+	// registered for. If it doesn't, hand them back to be retried,
+	// possibly by another agent, rather than failing them for good.
+	if !cdc.handlesArchive(actionList.ArchiveID) {
+		alert.Warnf("coordinator inconsistency: received %d actions for archive %d, registered for %v",
+			len(items), actionList.ArchiveID, cdc.archives)
+		for _, item := range items {
+			item.FailImmediately(int(unix.EAGAIN))
+		}
+		return nil, nil
+	}
 	return items, nil
 }
 
@@ -105,6 +157,22 @@ func (cdc *CoordinatorClient) GetFd() int {
 	return llapi.HsmCopytoolGetFd(cdc.hcp)
 }
 
+// Drain waits until every action received has been ended, or until the
+// timeout expires. It returns false if actions are still outstanding.
+func (cdc *CoordinatorClient) Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		cdc.outstanding.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // Close terminates connection with coordinator.
 func (cdc *CoordinatorClient) Close() {
 	if cdc.hcp != nil {
@@ -118,9 +186,12 @@ type (
 	ActionRequest interface {
 		Begin(openFlags int, isError bool) (ActionHandle, error)
 		FailImmediately(errval int)
+		Fid() *lustre.Fid
 		ArchiveID() uint
+		FsName() string
 		String() string
 		Action() llapi.HsmAction
+		Cookie() uint64
 	}
 
 	// ActionHandle is an HSM action that is currently being processed
@@ -134,16 +205,21 @@ type (
 		Fd() (int, error)
 		Offset() int64
 		ArchiveID() uint
+		FsName() string
 		Length() int64
 		String() string
 		Data() []byte
+		DataVersion(flags llapi.DataVersionFlag) (uint64, error)
+		SetDataVersion(dv uint64)
+		Layout() ([]byte, error)
+		SetLayout(lovEA []byte) error
 	}
 )
 
 // Copy the striping info from the primary to the temporary file.
 //
 func (ai *actionItem) copyLovMd() error {
-	fd, err := ai.Fd()
+	fd, err := ai.dataFd()
 	if err != nil {
 		return err
 	}
@@ -158,13 +234,28 @@ func (ai *actionItem) copyLovMd() error {
 	return llapi.SetFileLayout(fd, layout)
 }
 
+// applyPendingLayout copies the striping info to the data file of a
+// restore when it is first used, unless a layout was set with
+// SetLayout.
+func (ai *actionItem) applyPendingLayout() {
+	ai.mu.Lock()
+	pending := ai.layoutPending
+	ai.layoutPending = false
+	ai.mu.Unlock()
+	if pending {
+		if err := ai.copyLovMd(); err != nil {
+			alert.Warn(err)
+		}
+	}
+}
+
 // Begin prepares an actionItem for processing.
 //
 // returns an actionItem. The End method must be called to complete
-// this action.
+// this action. The data file of a restore is given the striping info
+// of the file when it is first used, unless SetLayout is called first.
 func (ai *actionItem) Begin(openFlags int, isError bool) (ActionHandle, error) {
 	mdtIndex := -1
-	setLov := false
 	if ai.Action() == RESTORE && !isError {
 		var err error
 		mdtIndex, err = status.GetMdt(ai.cdc.root, ai.Fid())
@@ -173,26 +264,21 @@ func (ai *actionItem) Begin(openFlags int, isError bool) (ActionHandle, error) {
 			return nil, err
 		}
 		openFlags = llapi.LovDelayCreate
-		setLov = true
 	}
 	var err error
 	ai.mu.Lock()
 	ai.hcap, err = llapi.HsmActionBegin(ai.cdc.hcp, &ai.hai, mdtIndex, openFlags, isError)
+	ai.layoutPending = err == nil && ai.Action() == RESTORE && !isError
 	ai.mu.Unlock()
 	if err != nil {
 		ai.mu.Lock()
 		llapi.HsmActionEnd(&ai.hcap, 0, 0, 0, -1)
+		ai.finish()
 		ai.mu.Unlock()
 		return nil, err
 
 	}
-	aih := (*actionItem)(ai)
-	if setLov {
-		if err := aih.copyLovMd(); err != nil {
-			alert.Warn(err)
-		}
-	}
-	return aih, nil
+	return (*actionItem)(ai), nil
 }
 
 // ArchiveID returns the archive id associated with teh actionItem.
@@ -200,6 +286,11 @@ func (ai *actionItem) ArchiveID() uint {
 	return ai.archiveID
 }
 
+// FsName returns the name of the filesystem the action is for.
+func (ai *actionItem) FsName() string {
+	return ai.fsName
+}
+
 // Action returns name of the action.
 func (ai *actionItem) Action() llapi.HsmAction {
 	return ai.hai.Action
@@ -214,12 +305,34 @@ func (ai *actionItem) Fid() *lustre.Fid {
 
 // FailImmediately completes the ActinoItem with given error.
 // The passed actionItem is no longer valid when this function returns.
+// Actions failed with a transient error such as ESHUTDOWN are
+// rescheduled by the coordinator.
 func (ai *actionItem) FailImmediately(errval int) {
 	aih, err := ai.Begin(0, true)
 	if err != nil {
 		return
 	}
-	aih.End(0, 0, 0, errval)
+	aih.End(0, 0, retryFlags(errval), errval)
+}
+
+// retryFlags returns the progress flags for an action that failed with
+// errval. The coordinator reschedules actions that fail with a
+// transient error, possibly on another agent.
+func retryFlags(errval int) int {
+	switch unix.Errno(errval) {
+	case unix.EAGAIN, unix.EBUSY, unix.ETIMEDOUT, unix.ESHUTDOWN:
+		return llapi.HsmProgressFlagRetry
+	}
+	return 0
+}
+
+// finish marks the action as ended for the client. The caller must
+// hold ai.mu.
+func (ai *actionItem) finish() {
+	if !ai.finished {
+		ai.finished = true
+		ai.cdc.outstanding.Done()
+	}
 }
 
 func lengthStr(length int64) string {
@@ -242,12 +355,86 @@ func (ai *actionItem) Progress(offset, length, totalLength int64, flags int) err
 
 // End completes an action with specified status.
 // No more requests should be made on this action after calling this.
+//
+// If a data version was set for a successful archive, it is compared
+// with the file's current version, and the archive fails with EBUSY
+// and is retried if the file has been modified.
 func (ai *actionItem) End(offset, length int64, flags int, errval int) error {
+	if errval == 0 {
+		ai.applyPendingLayout()
+	}
+	ai.mu.Lock()
+	expected, check := ai.dataVersion, ai.hasDataVersion
+	ai.mu.Unlock()
+	if ai.Action() == ARCHIVE && errval == 0 && check {
+		dv, err := ai.DataVersion(llapi.DataVersionReadFlush)
+		if err != nil || dv != expected {
+			alert.Warnf("%s: data version changed during archive", ai)
+			offset, length = 0, 0
+			flags |= llapi.HsmProgressFlagRetry
+			errval = int(unix.EBUSY)
+		}
+	}
+
 	ai.mu.Lock()
 	defer ai.mu.Unlock()
+	defer ai.finish()
 	return llapi.HsmActionEnd(&ai.hcap, offset, length, flags, errval)
 }
 
+// DataVersion returns the current data version of the data file.
+func (ai *actionItem) DataVersion(flags llapi.DataVersionFlag) (uint64, error) {
+	fd, err := ai.Fd()
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	return llapi.GetDataVersion(fd, flags)
+}
+
+// SetDataVersion records the data version of the file that was
+// archived, to be checked when the action ends.
+func (ai *actionItem) SetDataVersion(dv uint64) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	ai.dataVersion = dv
+	ai.hasDataVersion = true
+}
+
+// Layout returns the full layout of the data file, including any
+// composite components and the pool name.
+func (ai *actionItem) Layout() ([]byte, error) {
+	fd, err := ai.Fd()
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	return llapi.FileLovEA(fd)
+}
+
+// SetLayout applies a layout returned by Layout to the data file of a
+// restore, instead of the current layout of the file. If lovEA is nil,
+// the current layout of the file is used. It must be called before the
+// data file is used.
+func (ai *actionItem) SetLayout(lovEA []byte) error {
+	if ai.Action() != RESTORE {
+		return fmt.Errorf("%s: layout can only be set for restore", ai)
+	}
+	ai.mu.Lock()
+	ai.layoutPending = false
+	ai.mu.Unlock()
+	if lovEA == nil {
+		return ai.copyLovMd()
+	}
+
+	fd, err := ai.dataFd()
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return llapi.SetFileLovEA(fd, lovEA)
+}
+
 // Cookie returns the action identifier.
 func (ai *actionItem) Cookie() uint64 {
 	return ai.hai.Cookie
@@ -256,6 +443,7 @@ func (ai *actionItem) Cookie() uint64 {
 // DataFid returns the FID of the data file.
 // This file should be used for all Lustre IO for archive and restore commands.
 func (ai *actionItem) DataFid() (*lustre.Fid, error) {
+	ai.applyPendingLayout()
 	ai.mu.Lock()
 	defer ai.mu.Unlock()
 	return llapi.HsmActionGetDataFid(ai.hcap)
@@ -264,6 +452,11 @@ func (ai *actionItem) DataFid() (*lustre.Fid, error) {
 // Fd returns the file descriptor of the DataFid.
 // If used, this Fd must be closed prior to calling End.
 func (ai *actionItem) Fd() (int, error) {
+	ai.applyPendingLayout()
+	return ai.dataFd()
+}
+
+func (ai *actionItem) dataFd() (int, error) {
 	ai.mu.Lock()
 	defer ai.mu.Unlock()
 	fd, err := llapi.HsmActionGetFd(ai.hcap)
@@ -5,10 +5,9 @@
 package hsm
 
 import (
-	"fmt"
 	"os"
-
-	"github.com/pkg/errors"
+	"sync"
+	"time"
 
 	"github.com/intel-hpdd/logging/alert"
 	"github.com/intel-hpdd/logging/debug"
@@ -27,19 +26,71 @@ type ActionSource interface {
 
 	// Start signals the action source to begin sending actions
 	Start(context.Context) error
+
+	// Err returns the error that caused the source to shut down, or
+	// nil if it was shut down by canceling its context. It is only
+	// valid once the Actions channel is closed.
+	Err() error
 }
 
+// ActionSourceOption is a configuration option for an ActionSource.
+type ActionSourceOption func(*coordinatorSource)
+
 type coordinatorSource struct {
-	fsRoot  fs.RootDir
-	actions <-chan ActionRequest
+	fsRoot            fs.RootDir
+	archives          []uint
+	drainTimeout      time.Duration
+	reregister        bool
+	reregisterBackoff time.Duration
+	actions           <-chan ActionRequest
+
+	mu  sync.Mutex // protects err
+	err error
+}
+
+const defaultSourceDrainTimeout = 5 * time.Minute
+
+// OptSourceArchiveIDs restricts the source to actions for the archive
+// IDs. By default actions for all archives are received.
+func OptSourceArchiveIDs(archives ...uint) ActionSourceOption {
+	return func(src *coordinatorSource) {
+		src.archives = append(src.archives, archives...)
+	}
+}
+
+// OptSourceDrainTimeout sets how long the source waits, once its
+// context is canceled, for the actions it has sent to be ended before
+// it unregisters from the coordinator.
+func OptSourceDrainTimeout(timeout time.Duration) ActionSourceOption {
+	return func(src *coordinatorSource) {
+		src.drainTimeout = timeout
+	}
+}
+
+// OptSourceReregister makes the source register with the coordinator
+// again after a transient failure, such as the coordinator shutting
+// down during an MDT failover, instead of shutting down. Registration
+// is retried every backoff until it succeeds or the source is stopped.
+func OptSourceReregister(backoff time.Duration) ActionSourceOption {
+	return func(src *coordinatorSource) {
+		src.reregister = true
+		src.reregisterBackoff = backoff
+	}
 }
 
 // NewActionSource initializes an ActionSource for the filesystem in root.
-func NewActionSource(root fs.RootDir) ActionSource {
-	return &coordinatorSource{fsRoot: root}
+func NewActionSource(root fs.RootDir, options ...ActionSourceOption) ActionSource {
+	src := &coordinatorSource{fsRoot: root, drainTimeout: defaultSourceDrainTimeout}
+	for _, option := range options {
+		option(src)
+	}
+	return src
 }
 
-// Start signals the source to begin sending actions
+// Start signals the source to begin sending actions. When ctx is
+// canceled the source stops receiving new actions, and waits for the
+// actions already sent to be ended before it unregisters from the
+// coordinator and closes the Actions channel.
 func (src *coordinatorSource) Start(ctx context.Context) error {
 	// This pipe is used by Stop() to send the terminate signal to actionListener.
 	r, w, err := os.Pipe()
@@ -47,10 +98,17 @@ func (src *coordinatorSource) Start(ctx context.Context) error {
 		return err
 	}
 
-	if err := src.actionListener(r); err != nil {
-		return err
+	cdc, err := NewCoordinatorClient(src.fsRoot, true, src.archives...)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return &SourceError{Op: "register", Err: err}
 	}
 
+	ch := make(chan ActionRequest)
+	src.actions = bufferedActionChannel(ch)
+	go src.listen(ctx, cdc, r, ch)
+
 	// Wait for the context to be canceled, then tell the other
 	// side that we're closing up shop...
 	go func() {
@@ -67,91 +125,146 @@ func (src *coordinatorSource) Actions() <-chan ActionRequest {
 	return src.actions
 }
 
+func (src *coordinatorSource) Err() error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	return src.err
+}
+
+func (src *coordinatorSource) setErr(err error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.err = err
+}
+
 func getFd(f *os.File) int {
 	return int(f.Fd())
 }
 
-func (src *coordinatorSource) actionListener(stopFile *os.File) error {
-	var err error
-	cdc, err := NewCoordinatorClient(src.fsRoot, true)
-	if err != nil {
-		return fmt.Errorf("%s: %s", src.fsRoot, err)
+// listen sends the actions received from the coordinator to ch until
+// the source is stopped or fails, registering again after transient
+// failures if enabled. Clients are closed once their actions have
+// ended, and then ch is closed.
+func (src *coordinatorSource) listen(ctx context.Context, cdc *CoordinatorClient, stopFile *os.File, ch chan<- ActionRequest) {
+	var retiring sync.WaitGroup
+	retire := func(cdc *CoordinatorClient) {
+		retiring.Add(1)
+		go func() {
+			defer retiring.Done()
+			if !cdc.Drain(src.drainTimeout) {
+				alert.Warnf("%s: unregistering with actions outstanding", src.fsRoot)
+			}
+			cdc.Close()
+		}()
 	}
+	defer func() {
+		stopFile.Close()
+		retiring.Wait()
+		close(ch)
+	}()
 
-	ch := make(chan ActionRequest)
-
-	go func() {
-		var events = make([]unix.EpollEvent, 2)
-		var ev unix.EpollEvent
-		epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
-		if err != nil {
-			alert.Fatal(err)
+	for {
+		err := src.poll(cdc, stopFile, ch)
+		retire(cdc)
+		if err == nil {
+			return
 		}
-		ev.Fd = int32(getFd(stopFile))
-		ev.Events = unix.EPOLLIN | unix.EPOLLET
-		err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, getFd(stopFile), &ev)
-		if err != nil {
-			alert.Abort(errors.Wrap(err, "epollctl stopfile failed"))
+		if !src.reregister || !isTransient(err) {
+			alert.Warnf("%s: action source stopped: %v", src.fsRoot, err)
+			src.setErr(err)
+			return
 		}
 
-		ev.Fd = int32(cdc.GetFd())
-		ev.Events = unix.EPOLLIN | unix.EPOLLET
-		err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, cdc.GetFd(), &ev)
+		alert.Warnf("%s: %v, registering again", src.fsRoot, err)
+		cdc, err = src.register(ctx)
 		if err != nil {
-			alert.Abort(errors.Wrap(err, "epollctl coordinator fd failed"))
+			if ctx.Err() == nil {
+				src.setErr(err)
+			}
+			return
 		}
+	}
+}
 
-		defer func() {
-			cdc.Close()
-			stopFile.Close()
-			unix.Close(epfd)
-			close(ch)
-		}()
+// register connects to the coordinator, retrying until it succeeds or
+// ctx is canceled.
+func (src *coordinatorSource) register(ctx context.Context) (*CoordinatorClient, error) {
+	for {
+		cdc, err := NewCoordinatorClient(src.fsRoot, true, src.archives...)
+		if err == nil {
+			return cdc, nil
+		}
+		debug.Printf("%s: register failed: %v", src.fsRoot, err)
+		select {
+		case <-ctx.Done():
+			return nil, &SourceError{Op: "register", Err: ctx.Err()}
+		case <-time.After(src.reregisterBackoff):
+		}
+	}
+}
 
-		for {
-			var actions []*actionItem
-			nfds, err := unix.EpollWait(epfd, events, -1)
-			if err != nil {
-				if err == unix.EINTR {
-					continue
-				}
-				alert.Fatal(err)
+// poll receives actions from the client and sends them to ch. It
+// returns nil when the source is stopped, or the error that stopped it.
+func (src *coordinatorSource) poll(cdc *CoordinatorClient, stopFile *os.File, ch chan<- ActionRequest) error {
+	var events = make([]unix.EpollEvent, 2)
+	var ev unix.EpollEvent
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return &SourceError{Op: "epoll create", Err: err}
+	}
+	defer unix.Close(epfd)
+
+	ev.Fd = int32(getFd(stopFile))
+	ev.Events = unix.EPOLLIN | unix.EPOLLET
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, getFd(stopFile), &ev)
+	if err != nil {
+		return &SourceError{Op: "epoll add stop file", Err: err}
+	}
+
+	ev.Fd = int32(cdc.GetFd())
+	ev.Events = unix.EPOLLIN | unix.EPOLLET
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, cdc.GetFd(), &ev)
+	if err != nil {
+		return &SourceError{Op: "epoll add coordinator", Err: err}
+	}
+
+	for {
+		nfds, err := unix.EpollWait(epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
 			}
+			return &SourceError{Op: "epoll wait", Err: err}
+		}
 
-			for n := 0; n < nfds; n++ {
-				ev := events[n]
-				switch int(ev.Fd) {
-				case getFd(stopFile):
-					buf := make([]byte, 32)
-					stopFile.Read(buf)
-					return
-				case cdc.GetFd():
-					for {
-						actions, err = cdc.recv()
-						if err == unix.EAGAIN {
-							break
-						}
-						if err != nil {
-							debug.Print(err)
-							return
-						}
-						for _, ai := range actions {
-							ch <- ai
-						}
+		for n := 0; n < nfds; n++ {
+			ev := events[n]
+			switch int(ev.Fd) {
+			case getFd(stopFile):
+				buf := make([]byte, 32)
+				stopFile.Read(buf)
+				return nil
+			case cdc.GetFd():
+				for {
+					actions, err := cdc.recv()
+					if err == unix.EAGAIN {
+						break
+					}
+					if err != nil {
+						return &SourceError{Op: "receive", Err: err}
+					}
+					for _, ai := range actions {
+						ch <- ai
 					}
 				}
-
 			}
-
 		}
-	}()
-
-	src.actions = bufferedActionChannel(ch)
-	return nil
+	}
 }
 
 // bufferedActionChannel buffers the input channel into an arbitrarily sized queue, and returns
-// the channel for consumers to read from.
+// the channel for consumers to read from. When the input channel is closed, the
+// queued actions are still sent before the output channel is closed.
 func bufferedActionChannel(in <-chan ActionRequest) <-chan ActionRequest {
 	var queue []ActionRequest
 	out := make(chan ActionRequest)
@@ -169,7 +282,10 @@ func bufferedActionChannel(in <-chan ActionRequest) <-chan ActionRequest {
 			select {
 			case item, ok := <-in:
 				if !ok {
-					debug.Print("in channel failed, close out!")
+					debug.Printf("in channel closed, flushing %d actions", len(queue))
+					for _, ar := range queue {
+						out <- ar
+					}
 					return
 				}
 				queue = append(queue, item)
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/logging/alert"
+)
+
+type (
+	// AuditEntry is the record of a completed action in an AuditLog.
+	AuditEntry struct {
+		Time      time.Time   `json:"time"`
+		FsName    string      `json:"fs,omitempty"`
+		Cookie    uint64      `json:"cookie"`
+		Fid       *lustre.Fid `json:"fid"`
+		Action    string      `json:"action"`
+		ArchiveID uint        `json:"archive_id"`
+		Offset    int64       `json:"offset"`
+		Length    int64       `json:"length"`
+		Bytes     int64       `json:"bytes"`
+		// Result is "ok", or the name of the errno the action
+		// failed with.
+		Result string `json:"result"`
+		Errval int    `json:"errno,omitempty"`
+		// Duration and QueueWait are in seconds.
+		Duration  float64 `json:"duration"`
+		QueueWait float64 `json:"queue_wait"`
+	}
+
+	// AuditLog is an ActionObserver that writes an AuditEntry as a
+	// line of JSON for each action a Copytool completes.
+	AuditLog struct {
+		mu  sync.Mutex
+		enc *json.Encoder
+	}
+)
+
+// NewAuditLog returns an AuditLog that writes to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{enc: json.NewEncoder(w)}
+}
+
+// ActionQueued implements ActionObserver.
+func (l *AuditLog) ActionQueued(ar ActionRequest) {}
+
+// ActionStarted implements ActionObserver.
+func (l *AuditLog) ActionStarted(ar ActionRequest, wait time.Duration) {}
+
+// ActionFinished writes the entry for the action.
+func (l *AuditLog) ActionFinished(ar ActionRequest, res *ActionResult) {
+	entry := &AuditEntry{
+		Time:      time.Now().UTC(),
+		FsName:    ar.FsName(),
+		Cookie:    ar.Cookie(),
+		Fid:       ar.Fid(),
+		Action:    ar.Action().String(),
+		ArchiveID: ar.ArchiveID(),
+		Offset:    res.Offset,
+		Length:    res.Length,
+		Bytes:     res.Bytes,
+		Result:    "ok",
+		Errval:    res.Errval,
+		Duration:  res.Duration.Seconds(),
+		QueueWait: res.QueueWait.Seconds(),
+	}
+	if res.Errval != 0 {
+		entry.Result = unix.ErrnoName(syscall.Errno(res.Errval))
+		if entry.Result == "" {
+			entry.Result = "error"
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(entry); err != nil {
+		alert.Warnf("%s: audit log: %v", ar, err)
+	}
+}
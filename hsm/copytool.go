@@ -0,0 +1,602 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// Backend moves file data between Lustre and an archive on
+	// behalf of a Copytool. The ActionHandle has already been
+	// started with Begin, and the Copytool calls End with the
+	// result once the Backend method returns.
+	Backend interface {
+		// Archive copies the file data described by the action
+		// into the archive and returns the number of bytes copied.
+		Archive(ctx context.Context, aih ActionHandle) (int64, error)
+
+		// Restore copies the file data from the archive into the
+		// action's data file and returns the number of bytes copied.
+		Restore(ctx context.Context, aih ActionHandle) (int64, error)
+
+		// Remove deletes the archived copy of the file.
+		Remove(ctx context.Context, aih ActionHandle) error
+	}
+
+	// LayoutBackend is implemented by a Backend that stores the
+	// layout of archived files. Before a restore, the Copytool
+	// applies the layout returned by Layout to the data file. If
+	// Layout returns nil, the current layout of the file is used.
+	LayoutBackend interface {
+		Layout(ctx context.Context, aih ActionHandle) ([]byte, error)
+	}
+
+	// CopytoolOption is a configuration option for a Copytool.
+	CopytoolOption func(*Copytool) error
+
+	// Copytool receives actions from an ActionSource and runs them
+	// against the Backend registered for each action's archive ID,
+	// using a bounded pool of workers.
+	Copytool struct {
+		source           ActionSource
+		backend          Backend
+		archives         map[uint]Backend
+		workers          int
+		progressInterval time.Duration
+		drainTimeout     time.Duration
+		limits           map[uint]ArchiveLimits
+		sched            *scheduler
+		observers        []ActionObserver
+		events           *EventWriter
+
+		mu      sync.Mutex // protects running and expired
+		running map[actionKey]*pendingAction
+		expired bool
+	}
+
+	// actionKey identifies an action. Cookies are only unique within
+	// a filesystem.
+	actionKey struct {
+		fsName string
+		cookie uint64
+	}
+
+	// pendingAction is an action that has been received but not yet
+	// completed. It can be canceled by a CANCEL action with the same
+	// cookie.
+	pendingAction struct {
+		ActionRequest
+		ctx    context.Context
+		cancel context.CancelFunc
+		queued time.Time
+	}
+
+	// ActionObserver is notified as a Copytool processes actions, for
+	// monitoring. Its methods are called concurrently from the
+	// Copytool's workers and must not block.
+	ActionObserver interface {
+		// ActionQueued is called when an action is received.
+		ActionQueued(ar ActionRequest)
+		// ActionStarted is called when a worker takes the action
+		// from the queue, after waiting there for wait.
+		ActionStarted(ar ActionRequest, wait time.Duration)
+		// ActionFinished is called once the action has ended.
+		ActionFinished(ar ActionRequest, res *ActionResult)
+	}
+
+	// ProgressObserver is implemented by an ActionObserver that is
+	// also notified of the progress reported for running actions.
+	ProgressObserver interface {
+		ActionProgress(ar ActionRequest, copied, total int64)
+	}
+
+	// observedHandle reports the progress of an action to the
+	// Copytool's observers.
+	observedHandle struct {
+		ActionHandle
+		ar        ActionRequest
+		observers []ProgressObserver
+	}
+
+	// ActionResult is the outcome of an action run by a Copytool.
+	ActionResult struct {
+		// Offset and Length are the extent of the action, if it was
+		// started.
+		Offset int64
+		Length int64
+		// Bytes is the number of bytes copied.
+		Bytes int64
+		// Errval is the errno the action ended with, or 0.
+		Errval    int
+		QueueWait time.Duration
+		Duration  time.Duration
+	}
+)
+
+const (
+	defaultCopytoolWorkers  = 4
+	defaultProgressInterval = 10 * time.Second
+	defaultDrainTimeout     = time.Minute
+)
+
+// OptCopytoolWorkers sets the number of actions processed concurrently.
+func OptCopytoolWorkers(count int) CopytoolOption {
+	return func(ct *Copytool) error {
+		if count < 1 {
+			return errors.Errorf("invalid worker count: %d", count)
+		}
+		ct.workers = count
+		return nil
+	}
+}
+
+// OptCopytoolArchive routes actions for the archive ID to the backend,
+// instead of the default backend.
+func OptCopytoolArchive(archiveID uint, backend Backend) CopytoolOption {
+	return func(ct *Copytool) error {
+		ct.archives[archiveID] = backend
+		return nil
+	}
+}
+
+// OptCopytoolProgressInterval sets how often progress is reported to the
+// coordinator for a running action.
+func OptCopytoolProgressInterval(interval time.Duration) CopytoolOption {
+	return func(ct *Copytool) error {
+		if interval <= 0 {
+			return errors.Errorf("invalid progress interval: %v", interval)
+		}
+		ct.progressInterval = interval
+		return nil
+	}
+}
+
+// OptCopytoolDrainTimeout sets how long running actions may continue
+// after the copytool is stopped. Actions still running when it expires
+// are canceled and rescheduled by the coordinator.
+func OptCopytoolDrainTimeout(timeout time.Duration) CopytoolOption {
+	return func(ct *Copytool) error {
+		ct.drainTimeout = timeout
+		return nil
+	}
+}
+
+// OptCopytoolArchiveLimits sets the concurrency and bandwidth limits for
+// the actions of the archive ID.
+func OptCopytoolArchiveLimits(archiveID uint, limits ArchiveLimits) CopytoolOption {
+	return func(ct *Copytool) error {
+		if limits.Concurrency < 0 || limits.Bandwidth < 0 {
+			return errors.Errorf("invalid limits for archive %d: %+v", archiveID, limits)
+		}
+		ct.limits[archiveID] = limits
+		return nil
+	}
+}
+
+// OptCopytoolObserver adds an observer that is notified of each action
+// the copytool processes.
+func OptCopytoolObserver(obs ActionObserver) CopytoolOption {
+	return func(ct *Copytool) error {
+		ct.observers = append(ct.observers, obs)
+		return nil
+	}
+}
+
+// OptCopytoolEvents writes events for the copytool and its actions with
+// ew, so it can be monitored like a liblustreapi copytool with an event
+// FIFO.
+func OptCopytoolEvents(ew *EventWriter) CopytoolOption {
+	return func(ct *Copytool) error {
+		ct.events = ew
+		ct.observers = append(ct.observers, ew)
+		return nil
+	}
+}
+
+// NewCopytool returns a Copytool that processes actions from source. The
+// backend handles actions for any archive ID without a backend set by
+// OptCopytoolArchive, and may be nil.
+func NewCopytool(source ActionSource, backend Backend, options ...CopytoolOption) (*Copytool, error) {
+	ct := &Copytool{
+		source:           source,
+		backend:          backend,
+		archives:         make(map[uint]Backend),
+		workers:          defaultCopytoolWorkers,
+		progressInterval: defaultProgressInterval,
+		drainTimeout:     defaultDrainTimeout,
+		limits:           make(map[uint]ArchiveLimits),
+		running:          make(map[actionKey]*pendingAction),
+	}
+
+	for _, option := range options {
+		if err := option(ct); err != nil {
+			return nil, err
+		}
+	}
+	ct.sched = newScheduler(ct.limits, ct.restoreOrderer)
+
+	return ct, nil
+}
+
+// QueueDepths returns the number of actions queued and running for each
+// archive ID that has received actions, ordered by archive ID.
+func (ct *Copytool) QueueDepths() []QueueDepth {
+	return ct.sched.depths()
+}
+
+// Run starts the action source and processes actions until the source
+// is shut down by canceling ctx. Queued restores are started before
+// other actions, within the limits set for each archive ID. The
+// copytool then drains: actions not
+// yet started are failed so the coordinator reschedules them, and
+// running actions are given the drain timeout to finish. Run returns
+// once the source has closed and every action has ended, with the
+// source's error if it shut down because of a failure.
+func (ct *Copytool) Run(ctx context.Context) error {
+	if err := ct.source.Start(ctx); err != nil {
+		return errors.Wrap(err, "start action source")
+	}
+	if ct.events != nil {
+		ct.events.Register()
+		defer ct.events.Unregister()
+	}
+
+	// Running actions are not canceled with ctx, so they can finish
+	// while the copytool drains.
+	actx, cancelActions := context.WithCancel(context.Background())
+	defer cancelActions()
+	go ct.expire(ctx, actx, cancelActions)
+
+	var wg sync.WaitGroup
+	for i := 0; i < ct.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				pa, ok := ct.sched.pop()
+				if !ok {
+					return
+				}
+				ct.handleAction(ctx, pa)
+			}
+		}()
+	}
+
+	ct.dispatch(actx)
+	ct.sched.close()
+	wg.Wait()
+
+	return ct.source.Err()
+}
+
+// dispatch reads actions from the source until it is closed. CANCEL
+// actions are handled immediately, unsupported actions are failed, and
+// everything else is queued for the workers.
+func (ct *Copytool) dispatch(ctx context.Context) {
+	for ar := range ct.source.Actions() {
+		switch ar.Action() {
+		case ARCHIVE, RESTORE, REMOVE:
+		case CANCEL:
+			ct.cancelAction(ar)
+			continue
+		default:
+			debug.Printf("%s: unsupported action", ar)
+			ar.FailImmediately(int(unix.EINVAL))
+			continue
+		}
+
+		pa := &pendingAction{ActionRequest: ar, queued: time.Now()}
+		pa.ctx, pa.cancel = context.WithCancel(ctx)
+		ct.mu.Lock()
+		ct.running[keyOf(ar)] = pa
+		ct.mu.Unlock()
+
+		for _, obs := range ct.observers {
+			obs.ActionQueued(pa)
+		}
+		ct.sched.push(pa)
+	}
+}
+
+func keyOf(ar ActionRequest) actionKey {
+	return actionKey{fsName: ar.FsName(), cookie: ar.Cookie()}
+}
+
+// expire cancels the running actions if they have not finished when
+// the drain timeout expires after ctx is canceled.
+func (ct *Copytool) expire(ctx, actx context.Context, cancel context.CancelFunc) {
+	select {
+	case <-ctx.Done():
+	case <-actx.Done():
+		return
+	}
+	ct.sched.drain()
+
+	timer := time.NewTimer(ct.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		ct.mu.Lock()
+		ct.expired = true
+		count := len(ct.running)
+		ct.mu.Unlock()
+		alert.Warnf("drain timeout expired, canceling %d actions", count)
+		cancel()
+	case <-actx.Done():
+	}
+}
+
+func (ct *Copytool) isExpired() bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.expired
+}
+
+// cancelAction cancels the running action with the same cookie as the
+// CANCEL request. The CANCEL itself is never begun or ended, as that
+// would end the canceled action, which is left to end itself with
+// ECANCELED.
+func (ct *Copytool) cancelAction(ar ActionRequest) {
+	ct.mu.Lock()
+	pa, ok := ct.running[keyOf(ar)]
+	ct.mu.Unlock()
+
+	if !ok {
+		debug.Printf("%s: no running action to cancel", ar)
+		return
+	}
+	debug.Printf("%s: canceling %s", ar, pa)
+	pa.cancel()
+}
+
+func (ct *Copytool) finishAction(pa *pendingAction) {
+	ct.mu.Lock()
+	delete(ct.running, keyOf(pa))
+	ct.mu.Unlock()
+	pa.cancel()
+	ct.sched.done(pa)
+}
+
+func (ct *Copytool) getBackend(archiveID uint) Backend {
+	if b, ok := ct.archives[archiveID]; ok {
+		return b
+	}
+	return ct.backend
+}
+
+func (ct *Copytool) restoreOrderer(archiveID uint) RestoreOrderer {
+	o, _ := ct.getBackend(archiveID).(RestoreOrderer)
+	return o
+}
+
+// handleAction runs an action and reports it to the observers.
+func (ct *Copytool) handleAction(ctx context.Context, pa *pendingAction) {
+	defer ct.finishAction(pa)
+
+	res := &ActionResult{QueueWait: time.Since(pa.queued)}
+	for _, obs := range ct.observers {
+		obs.ActionStarted(pa, res.QueueWait)
+	}
+	started := time.Now()
+	res.Errval = ct.runAction(ctx, pa, res)
+	res.Duration = time.Since(started)
+	for _, obs := range ct.observers {
+		obs.ActionFinished(pa, res)
+	}
+}
+
+// observeProgress wraps the handle to report progress to the observers
+// that want it.
+func (ct *Copytool) observeProgress(ar ActionRequest, aih ActionHandle) ActionHandle {
+	var observers []ProgressObserver
+	for _, obs := range ct.observers {
+		if po, ok := obs.(ProgressObserver); ok {
+			observers = append(observers, po)
+		}
+	}
+	if len(observers) == 0 {
+		return aih
+	}
+	return &observedHandle{ActionHandle: aih, ar: ar, observers: observers}
+}
+
+func (h *observedHandle) Progress(offset, length, totalLength int64, flags int) error {
+	err := h.ActionHandle.Progress(offset, length, totalLength, flags)
+	if length == 0 {
+		// A heartbeat, with no data copied to report.
+		return err
+	}
+	for _, po := range h.observers {
+		po.ActionProgress(h.ar, length, totalLength)
+	}
+	return err
+}
+
+// runAction runs an action with its backend, filling in the extent and
+// bytes copied in res, and returns the errno the action ended with.
+func (ct *Copytool) runAction(ctx context.Context, pa *pendingAction, res *ActionResult) int {
+	if ctx.Err() != nil {
+		debug.Printf("%s: copytool stopping, returning action to coordinator", pa)
+		pa.FailImmediately(int(unix.ESHUTDOWN))
+		return int(unix.ESHUTDOWN)
+	}
+
+	if pa.ctx.Err() != nil {
+		debug.Printf("%s: canceled before start", pa)
+		pa.FailImmediately(int(unix.ECANCELED))
+		return int(unix.ECANCELED)
+	}
+
+	backend := ct.getBackend(pa.ArchiveID())
+	if backend == nil {
+		alert.Warnf("%s: no backend for archive %d", pa, pa.ArchiveID())
+		pa.FailImmediately(int(unix.EINVAL))
+		return int(unix.EINVAL)
+	}
+
+	aih, err := pa.Begin(0, false)
+	if err != nil {
+		alert.Warnf("%s: begin failed: %v", pa, err)
+		return errorToErrno(err)
+	}
+	res.Offset, res.Length = aih.Offset(), aih.Length()
+	aih = ct.observeProgress(pa, aih)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ct.heartbeat(aih, done)
+	}()
+
+	var length int64
+	switch aih.Action() {
+	case ARCHIVE:
+		length, err = ct.archive(pa.ctx, backend, aih)
+	case RESTORE:
+		length, err = ct.restore(pa.ctx, backend, aih)
+	case REMOVE:
+		err = backend.Remove(pa.ctx, aih)
+	}
+	res.Bytes = length
+
+	close(done)
+	wg.Wait()
+
+	if err != nil {
+		errval := errorToErrno(err)
+		if pa.ctx.Err() != nil {
+			errval = int(unix.ECANCELED)
+			if ct.isExpired() {
+				errval = int(unix.ETIMEDOUT)
+			}
+		}
+		flags := retryFlags(errval)
+		alert.Warnf("%s: failed: %v (errno %d)", aih, err, errval)
+		if err := aih.End(0, 0, flags, errval); err != nil {
+			alert.Warnf("%s: end failed: %v", aih, err)
+		}
+		return errval
+	}
+
+	debug.Printf("%s: completed, %d bytes", aih, length)
+	if err := aih.End(aih.Offset(), length, 0, 0); err != nil {
+		alert.Warnf("%s: end failed: %v", aih, err)
+		return errorToErrno(err)
+	}
+	return 0
+}
+
+// archive copies the file data with the backend, guarded by the data
+// version of the file. The version is read before the copy and
+// compared afterwards, and is set on the handle so the archive is also
+// rejected if the file changes before the action ends.
+func (ct *Copytool) archive(ctx context.Context, backend Backend, aih ActionHandle) (int64, error) {
+	before, err := aih.DataVersion(llapi.DataVersionReadFlush)
+	if err != nil {
+		return 0, errors.Wrap(err, "get data version")
+	}
+	aih.SetDataVersion(before)
+
+	n, err := backend.Archive(WithDataVersion(ctx, before), aih)
+	if err != nil {
+		return n, err
+	}
+
+	after, err := aih.DataVersion(llapi.DataVersionReadFlush)
+	if err != nil {
+		return n, errors.Wrap(err, "get data version")
+	}
+	if after != before {
+		return n, errors.Wrapf(ErrFileModified, "data version %d, was %d", after, before)
+	}
+	return n, nil
+}
+
+// restore sets the layout of the data file before the backend copies
+// the data into it. The restore fails if the layout can't be applied,
+// rather than leaving the file with the default layout.
+func (ct *Copytool) restore(ctx context.Context, backend Backend, aih ActionHandle) (int64, error) {
+	var layout []byte
+	if lb, ok := backend.(LayoutBackend); ok {
+		var err error
+		layout, err = lb.Layout(ctx, aih)
+		if err != nil {
+			return 0, errors.Wrap(err, "get archived layout")
+		}
+	}
+	if err := aih.SetLayout(layout); err != nil {
+		return 0, errors.Wrap(err, "set layout")
+	}
+	return backend.Restore(ctx, aih)
+}
+
+type dataVersionKey struct{}
+
+// WithDataVersion returns a context carrying the data version of the
+// file being archived, so a Backend can store it with the copy.
+func WithDataVersion(ctx context.Context, dv uint64) context.Context {
+	return context.WithValue(ctx, dataVersionKey{}, dv)
+}
+
+// DataVersionFromContext returns the data version of the file being
+// archived, if the Copytool provided one.
+func DataVersionFromContext(ctx context.Context) (uint64, bool) {
+	dv, ok := ctx.Value(dataVersionKey{}).(uint64)
+	return dv, ok
+}
+
+// heartbeat reports progress at regular intervals so the coordinator
+// doesn't consider a long-running action stalled.
+func (ct *Copytool) heartbeat(aih ActionHandle, done <-chan struct{}) {
+	ticker := time.NewTicker(ct.progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := aih.Progress(aih.Offset(), 0, 0, 0); err != nil {
+				debug.Printf("%s: progress failed: %v", aih, err)
+			}
+		}
+	}
+}
+
+// errorToErrno maps an error returned by a Backend to the errno value
+// reported to the coordinator.
+func errorToErrno(err error) int {
+	if errors.Cause(err) == context.Canceled {
+		return int(unix.ECANCELED)
+	}
+	if errors.Cause(err) == ErrFileModified {
+		return int(unix.EBUSY)
+	}
+	switch e := errors.Cause(err).(type) {
+	case syscall.Errno:
+		return int(e)
+	case *os.PathError:
+		return errorToErrno(e.Err)
+	case *os.LinkError:
+		return errorToErrno(e.Err)
+	case *os.SyscallError:
+		return errorToErrno(e.Err)
+	}
+	return int(unix.EIO)
+}
@@ -0,0 +1,625 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type testBackend struct {
+	length int64
+	delay  time.Duration
+	err    error
+	// progress causes the length to be reported as progress before
+	// the delay.
+	progress bool
+}
+
+func (b *testBackend) run(ctx context.Context) (int64, error) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	return b.length, b.err
+}
+
+func (b *testBackend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	return b.run(ctx)
+}
+
+func (b *testBackend) Restore(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	if b.progress {
+		if err := aih.Progress(aih.Offset(), b.length, b.length, 0); err != nil {
+			return 0, err
+		}
+	}
+	return b.run(ctx)
+}
+
+func (b *testBackend) Remove(ctx context.Context, aih hsm.ActionHandle) error {
+	_, err := b.run(ctx)
+	return err
+}
+
+func startCopytool(t *testing.T, backend hsm.Backend, options ...hsm.CopytoolOption) (*hsm.TestSource, func()) {
+	src := hsm.NewTestSource()
+	ct, err := hsm.NewCopytool(src, backend, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ct.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	return src, func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitComplete drains the progress updates for a request and returns
+// the final update and the number of intermediate updates.
+func waitComplete(t *testing.T, req *hsm.TestRequest) (*hsm.TestProgressUpdate, int) {
+	var progress int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-req.ProgressUpdates():
+			if p.Complete {
+				return p, progress
+			}
+			progress++
+		case <-timeout:
+			t.Fatalf("%s: timed out waiting for completion", req)
+		}
+	}
+}
+
+func TestCopytoolArchive(t *testing.T) {
+	src, stop := startCopytool(t, &testBackend{length: 42})
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+
+	p, _ := waitComplete(t, req)
+	if p.Errval != 0 {
+		t.Fatalf("unexpected errval: %d", p.Errval)
+	}
+	if p.Length != 42 {
+		t.Fatalf("got length %d, expected 42", p.Length)
+	}
+}
+
+func TestCopytoolErrors(t *testing.T) {
+	var tests = []struct {
+		err    error
+		errval int
+	}{
+		{
+			err:    &os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC},
+			errval: int(syscall.ENOSPC),
+		},
+		{
+			err:    syscall.EPERM,
+			errval: int(syscall.EPERM),
+		},
+		{
+			err:    errors.New("backend failed"),
+			errval: int(syscall.EIO),
+		},
+	}
+
+	for _, tc := range tests {
+		src, stop := startCopytool(t, &testBackend{err: tc.err})
+		req := hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+		src.Inject(req)
+
+		p, _ := waitComplete(t, req)
+		if p.Errval != tc.errval {
+			t.Fatalf("%v: got errval %d, expected %d", tc.err, p.Errval, tc.errval)
+		}
+		stop()
+	}
+}
+
+func TestCopytoolArchiveRouting(t *testing.T) {
+	src, stop := startCopytool(t, nil,
+		hsm.OptCopytoolArchive(2, &testBackend{length: 2}),
+		hsm.OptCopytoolArchive(3, &testBackend{length: 3}),
+	)
+	defer stop()
+
+	for _, archive := range []uint{2, 3} {
+		req := hsm.NewTestRequest(archive, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+		src.Inject(req)
+		p, _ := waitComplete(t, req)
+		if p.Errval != 0 || p.Length != int64(archive) {
+			t.Fatalf("archive %d: unexpected result %s", archive, p)
+		}
+	}
+
+	req := hsm.NewTestRequest(4, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	p, _ := waitComplete(t, req)
+	if p.Errval != int(syscall.EINVAL) {
+		t.Fatalf("got errval %d for unknown archive, expected EINVAL", p.Errval)
+	}
+}
+
+func TestCopytoolUnsupportedAction(t *testing.T) {
+	src, stop := startCopytool(t, &testBackend{})
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.NONE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	p, _ := waitComplete(t, req)
+	if p.Errval != int(syscall.EINVAL) {
+		t.Fatalf("got errval %d for unsupported action, expected EINVAL", p.Errval)
+	}
+}
+
+func TestCopytoolProgress(t *testing.T) {
+	src, stop := startCopytool(t, &testBackend{delay: 100 * time.Millisecond},
+		hsm.OptCopytoolProgressInterval(10*time.Millisecond),
+	)
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+
+	_, progress := waitComplete(t, req)
+	if progress == 0 {
+		t.Fatal("no progress reported for long-running action")
+	}
+
+	if _, err := hsm.NewCopytool(src, nil, hsm.OptCopytoolProgressInterval(0)); err == nil {
+		t.Fatal("expected error for zero progress interval")
+	}
+}
+
+type blockingBackend struct {
+	testBackend
+	started chan struct{}
+}
+
+func (b *blockingBackend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	close(b.started)
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestCopytoolCancel(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{})}
+	src, stop := startCopytool(t, backend)
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	<-backend.started
+
+	cancel := hsm.NewTestCancelRequest(req)
+	if cancel.Cookie() != req.Cookie() {
+		t.Fatalf("cancel cookie %x does not match %x", cancel.Cookie(), req.Cookie())
+	}
+	src.Inject(cancel)
+
+	p, _ := waitComplete(t, req)
+	if p.Errval != int(syscall.ECANCELED) {
+		t.Fatalf("got errval %d for canceled action, expected ECANCELED", p.Errval)
+	}
+
+	// The CANCEL has the cookie of the canceled action, so ending it
+	// would end that action.
+	select {
+	case p := <-cancel.ProgressUpdates():
+		t.Fatalf("unexpected update for cancel: %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type versionBackend struct {
+	testBackend
+	dataVersion uint64
+	hasVersion  bool
+	modify      func()
+}
+
+func (b *versionBackend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	b.dataVersion, b.hasVersion = hsm.DataVersionFromContext(ctx)
+	if b.modify != nil {
+		b.modify()
+	}
+	return 42, nil
+}
+
+func TestCopytoolDataVersion(t *testing.T) {
+	backend := &versionBackend{}
+	src, stop := startCopytool(t, backend)
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	req.SetFileDataVersion(7)
+	src.Inject(req)
+
+	p, _ := waitComplete(t, req)
+	if p.Errval != 0 {
+		t.Fatalf("unexpected errval: %d", p.Errval)
+	}
+	if !backend.hasVersion || backend.dataVersion != 7 {
+		t.Fatalf("backend got data version %d (%v), expected 7", backend.dataVersion, backend.hasVersion)
+	}
+	if dv, ok := req.ArchivedDataVersion(); !ok || dv != 7 {
+		t.Fatalf("archived data version %d (%v), expected 7", dv, ok)
+	}
+
+	// The file is written during the copy.
+	req = hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 3}, nil)
+	req.SetFileDataVersion(7)
+	backend.modify = func() { req.SetFileDataVersion(8) }
+	src.Inject(req)
+
+	p, _ = waitComplete(t, req)
+	if p.Errval != int(syscall.EBUSY) {
+		t.Fatalf("got errval %d for modified file, expected EBUSY", p.Errval)
+	}
+	if p.Flags&llapi.HsmProgressFlagRetry == 0 {
+		t.Fatalf("retry flag not set for modified file")
+	}
+}
+
+type layoutBackend struct {
+	testBackend
+	layout []byte
+	err    error
+}
+
+func (b *layoutBackend) Layout(ctx context.Context, aih hsm.ActionHandle) ([]byte, error) {
+	return b.layout, b.err
+}
+
+func TestCopytoolRestoreLayout(t *testing.T) {
+	backend := &layoutBackend{layout: []byte("archived layout")}
+	src, stop := startCopytool(t, backend)
+	defer stop()
+
+	req := hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	req.SetFileLayout([]byte("released layout"))
+	src.Inject(req)
+
+	p, _ := waitComplete(t, req)
+	if p.Errval != 0 {
+		t.Fatalf("unexpected errval: %d", p.Errval)
+	}
+	if layout, ok := req.RestoredLayout(); !ok || string(layout) != "archived layout" {
+		t.Fatalf("restored layout %q (%v), expected archived layout", layout, ok)
+	}
+
+	// Without an archived layout the current layout is kept.
+	backend.layout = nil
+	req = hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 3}, nil)
+	req.SetFileLayout([]byte("released layout"))
+	src.Inject(req)
+
+	waitComplete(t, req)
+	if layout, ok := req.RestoredLayout(); !ok || string(layout) != "released layout" {
+		t.Fatalf("restored layout %q (%v), expected released layout", layout, ok)
+	}
+
+	backend.err = syscall.EIO
+	req = hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 4}, nil)
+	src.Inject(req)
+
+	p, _ = waitComplete(t, req)
+	if p.Errval != int(syscall.EIO) {
+		t.Fatalf("got errval %d for layout failure, expected EIO", p.Errval)
+	}
+}
+
+type delayBackend struct {
+	testBackend
+	started chan struct{}
+}
+
+func (b *delayBackend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	close(b.started)
+	return b.run(ctx)
+}
+
+func TestCopytoolDrain(t *testing.T) {
+	backend := &delayBackend{
+		testBackend: testBackend{length: 10, delay: 100 * time.Millisecond},
+		started:     make(chan struct{}),
+	}
+	src, stop := startCopytool(t, backend, hsm.OptCopytoolWorkers(1))
+
+	running := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(running)
+	<-backend.started
+	queued := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 3}, nil)
+	src.Inject(queued)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	// The running action finishes, and the queued one is returned to
+	// the coordinator to be rescheduled.
+	p, _ := waitComplete(t, running)
+	if p.Errval != 0 {
+		t.Fatalf("got errval %d for running action, expected 0", p.Errval)
+	}
+	p, _ = waitComplete(t, queued)
+	if p.Errval != int(syscall.ESHUTDOWN) || p.Flags&llapi.HsmProgressFlagRetry == 0 {
+		t.Fatalf("got errval %d flags %x for queued action, expected ESHUTDOWN with retry", p.Errval, p.Flags)
+	}
+	<-stopped
+}
+
+func TestCopytoolDrainTimeout(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{})}
+	src, stop := startCopytool(t, backend, hsm.OptCopytoolDrainTimeout(50*time.Millisecond))
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	<-backend.started
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	p, _ := waitComplete(t, req)
+	if p.Errval != int(syscall.ETIMEDOUT) || p.Flags&llapi.HsmProgressFlagRetry == 0 {
+		t.Fatalf("got errval %d flags %x, expected ETIMEDOUT with retry", p.Errval, p.Flags)
+	}
+	<-stopped
+}
+
+func TestCopytoolSourceError(t *testing.T) {
+	src := hsm.NewTestSource()
+	ct, err := hsm.NewCopytool(src, &testBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- ct.Run(ctx)
+	}()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	waitComplete(t, req)
+
+	srcErr := &hsm.SourceError{Op: "receive", Err: syscall.EIO}
+	src.Fail(srcErr)
+	select {
+	case err := <-done:
+		if err != srcErr {
+			t.Fatalf("Run returned %v, expected %v", err, srcErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the source failed")
+	}
+}
+
+// orderBackend reports each action as it starts, and holds it until
+// released. It orders queued restores by descending object ID.
+type orderBackend struct {
+	testBackend
+	started chan uint32
+	release chan struct{}
+}
+
+func (b *orderBackend) hold(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	b.started <- aih.Fid().Oid
+	select {
+	case <-b.release:
+		return 0, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (b *orderBackend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	return b.hold(ctx, aih)
+}
+
+func (b *orderBackend) Restore(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	return b.hold(ctx, aih)
+}
+
+func (b *orderBackend) OrderRestores(restores []hsm.ActionRequest) {
+	sort.Slice(restores, func(i, j int) bool {
+		return restores[i].Fid().Oid > restores[j].Fid().Oid
+	})
+}
+
+func newOrderBackend() *orderBackend {
+	return &orderBackend{started: make(chan uint32, 10), release: make(chan struct{})}
+}
+
+func waitStarted(t *testing.T, b *orderBackend) uint32 {
+	select {
+	case oid := <-b.started:
+		return oid
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an action to start")
+	}
+	return 0
+}
+
+func waitDepth(t *testing.T, ct *hsm.Copytool, expected []hsm.QueueDepth) {
+	timeout := time.After(5 * time.Second)
+	for {
+		if reflect.DeepEqual(ct.QueueDepths(), expected) {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("got queue depths %+v, expected %+v", ct.QueueDepths(), expected)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestCopytoolRestorePriority(t *testing.T) {
+	backend := newOrderBackend()
+	src := hsm.NewTestSource()
+	ct, err := hsm.NewCopytool(src, backend, hsm.OptCopytoolWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ct.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	reqs := make(map[uint32]*hsm.TestRequest)
+	inject := func(action llapi.HsmAction, oid uint32) {
+		reqs[oid] = hsm.NewTestRequest(1, action, &lustre.Fid{Seq: 1, Oid: oid}, nil)
+		src.Inject(reqs[oid])
+	}
+
+	inject(hsm.ARCHIVE, 1)
+	if oid := waitStarted(t, backend); oid != 1 {
+		t.Fatalf("started %d, expected 1", oid)
+	}
+	inject(hsm.ARCHIVE, 2)
+	inject(hsm.ARCHIVE, 3)
+	inject(hsm.RESTORE, 4)
+	inject(hsm.RESTORE, 5)
+	waitDepth(t, ct, []hsm.QueueDepth{{ArchiveID: 1, Restores: 2, Other: 2, Running: 1}})
+
+	// Restores go first, in the order chosen by the backend, and
+	// then the archives in the order they were received.
+	running := uint32(1)
+	for _, expected := range []uint32{5, 4, 2, 3} {
+		backend.release <- struct{}{}
+		waitComplete(t, reqs[running])
+		if running = waitStarted(t, backend); running != expected {
+			t.Fatalf("started %d, expected %d", running, expected)
+		}
+	}
+	backend.release <- struct{}{}
+	waitComplete(t, reqs[running])
+	waitDepth(t, ct, []hsm.QueueDepth{{ArchiveID: 1}})
+}
+
+func TestCopytoolArchiveLimits(t *testing.T) {
+	backend := newOrderBackend()
+	src, stop := startCopytool(t, backend,
+		hsm.OptCopytoolArchiveLimits(1, hsm.ArchiveLimits{Concurrency: 1}))
+	defer stop()
+
+	reqs := []*hsm.TestRequest{
+		hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 1}, nil),
+		hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil),
+		hsm.NewTestRequest(2, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 3}, nil),
+	}
+	for _, req := range reqs {
+		src.Inject(req)
+	}
+
+	// Archive 2 isn't held up by the limit on archive 1.
+	started := map[uint32]bool{waitStarted(t, backend): true, waitStarted(t, backend): true}
+	if !started[1] || !started[3] {
+		t.Fatalf("started %v, expected 1 and 3", started)
+	}
+	select {
+	case oid := <-backend.started:
+		t.Fatalf("started %d beyond the concurrency limit", oid)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	backend.release <- struct{}{}
+	backend.release <- struct{}{}
+	waitComplete(t, reqs[0])
+	waitComplete(t, reqs[2])
+	if oid := waitStarted(t, backend); oid != 2 {
+		t.Fatalf("started %d, expected 2", oid)
+	}
+	backend.release <- struct{}{}
+	waitComplete(t, reqs[1])
+
+	if _, err := hsm.NewCopytool(src, backend,
+		hsm.OptCopytoolArchiveLimits(1, hsm.ArchiveLimits{Concurrency: -1})); err == nil {
+		t.Fatal("expected error for invalid limits")
+	}
+}
+
+// chanWriter sends each write to a channel, so a test can wait for it.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestCopytoolAuditLog(t *testing.T) {
+	lines := make(chanWriter, 2)
+	src, stop := startCopytool(t, &testBackend{length: 42},
+		hsm.OptCopytoolArchive(3, &testBackend{err: syscall.ENOSPC}),
+		hsm.OptCopytoolObserver(hsm.NewAuditLog(lines)))
+	defer stop()
+
+	fid := &lustre.Fid{Seq: 1, Oid: 2}
+	archived := hsm.NewTestRequest(1, hsm.ARCHIVE, fid, nil)
+	src.Inject(archived)
+	waitComplete(t, archived)
+	restored := hsm.NewTestRequest(3, hsm.RESTORE, fid, nil)
+	src.Inject(restored)
+	waitComplete(t, restored)
+
+	for _, expected := range []hsm.AuditEntry{
+		{Cookie: archived.Cookie(), Action: "ARCHIVE", ArchiveID: 1, Bytes: 42, Result: "ok"},
+		{Cookie: restored.Cookie(), Action: "RESTORE", ArchiveID: 3, Result: "ENOSPC", Errval: int(syscall.ENOSPC)},
+	} {
+		var entry hsm.AuditEntry
+		select {
+		case line := <-lines:
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for audit entry")
+		}
+		if entry.Cookie != expected.Cookie || entry.Action != expected.Action ||
+			entry.ArchiveID != expected.ArchiveID || entry.Bytes != expected.Bytes ||
+			entry.Result != expected.Result || entry.Errval != expected.Errval ||
+			entry.Fid.String() != fid.String() {
+			t.Fatalf("got audit entry %+v, expected %+v", entry, expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"errors"
+	"fmt"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrActionFailed is reported when a file has no HSM action in
+	// progress, but has not reached the state expected after the
+	// action completed.
+	ErrActionFailed = errors.New("HSM action did not complete")
+
+	// ErrLost is reported when the archive copy of a released file
+	// is marked as lost, so the file can't be restored.
+	ErrLost = errors.New("archive copy is lost")
+
+	// ErrFileModified is reported when a file's data changes while
+	// it is being archived.
+	ErrFileModified = errors.New("file modified during archive")
+)
+
+// FileError records an error for an HSM operation on a file. Use
+// errors.Cause() from github.com/pkg/errors to retrieve the underlying
+// error, such as ErrLost.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *FileError) Cause() error {
+	return e.Err
+}
+
+// SourceError is reported by an ActionSource that stopped because of an
+// error. Op describes what the source was doing when it failed.
+type SourceError struct {
+	Op  string
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("action source: %s: %v", e.Op, e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *SourceError) Cause() error {
+	return e.Err
+}
+
+// isTransient returns true if the error is expected to clear after the
+// copytool registers with the coordinator again, such as when the
+// coordinator shuts down for an MDT failover.
+func isTransient(err error) bool {
+	switch pkgerrors.Cause(err) {
+	case unix.ESHUTDOWN, unix.ENOTCONN, unix.ECONNRESET, unix.EPIPE, unix.ENODEV:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// CopytoolEventType is the type of a CopytoolEvent.
+type CopytoolEventType string
+
+// Copytool event types, as named by liblustreapi.
+const (
+	EventRegister       = CopytoolEventType("REGISTER")
+	EventUnregister     = CopytoolEventType("UNREGISTER")
+	EventArchiveStart   = CopytoolEventType("ARCHIVE_START")
+	EventArchiveRunning = CopytoolEventType("ARCHIVE_RUNNING")
+	EventArchiveFinish  = CopytoolEventType("ARCHIVE_FINISH")
+	EventArchiveCancel  = CopytoolEventType("ARCHIVE_CANCEL")
+	EventArchiveError   = CopytoolEventType("ARCHIVE_ERROR")
+	EventRestoreStart   = CopytoolEventType("RESTORE_START")
+	EventRestoreRunning = CopytoolEventType("RESTORE_RUNNING")
+	EventRestoreFinish  = CopytoolEventType("RESTORE_FINISH")
+	EventRestoreCancel  = CopytoolEventType("RESTORE_CANCEL")
+	EventRestoreError   = CopytoolEventType("RESTORE_ERROR")
+	EventRemoveStart    = CopytoolEventType("REMOVE_START")
+	EventRemoveRunning  = CopytoolEventType("REMOVE_RUNNING")
+	EventRemoveFinish   = CopytoolEventType("REMOVE_FINISH")
+	EventRemoveCancel   = CopytoolEventType("REMOVE_CANCEL")
+	EventRemoveError    = CopytoolEventType("REMOVE_ERROR")
+	EventLoggedMessage  = CopytoolEventType("LOGGED_MESSAGE")
+)
+
+type (
+	// CopytoolEvent is an event sent by a copytool to its event FIFO,
+	// as registered with llapi_hsm_register_event_fifo. Fields that
+	// don't apply to the event type are zero.
+	CopytoolEvent struct {
+		Time time.Time
+		Type CopytoolEventType
+
+		// Registration events.
+		UUID       string
+		MountPoint string
+		ArchiveID  uint
+
+		// Action events.
+		Fid          *lustre.Fid
+		DataFid      *lustre.Fid
+		Cookie       uint64
+		LustrePath   string
+		TotalBytes   int64
+		CurrentBytes int64
+		ReturnCode   int
+
+		// Logged messages.
+		Message string
+		Level   string
+	}
+
+	// jsonEvent is the wire format of a CopytoolEvent.
+	jsonEvent struct {
+		EventTime    int64       `json:"event_time"`
+		EventType    string      `json:"event_type"`
+		UUID         string      `json:"uuid,omitempty"`
+		MountPoint   string      `json:"mount_point,omitempty"`
+		Archive      *uint       `json:"archive,omitempty"`
+		Fid          *lustre.Fid `json:"fid,omitempty"`
+		DataFid      *lustre.Fid `json:"data_fid,omitempty"`
+		Cookie       eventCookie `json:"cookie,omitempty"`
+		LustrePath   string      `json:"lustre_path,omitempty"`
+		TotalBytes   int64       `json:"total_bytes,omitempty"`
+		CurrentBytes int64       `json:"current_bytes,omitempty"`
+		ReturnCode   int         `json:"return_code,omitempty"`
+		Message      string      `json:"message,omitempty"`
+		Level        string      `json:"level,omitempty"`
+	}
+
+	// eventCookie is an action cookie, which liblustreapi writes as a
+	// hex string.
+	eventCookie uint64
+
+	// EventReader parses a stream of CopytoolEvents, one JSON object
+	// per line.
+	EventReader struct {
+		scanner *bufio.Scanner
+	}
+
+	// EventWriter is an ActionObserver that writes CopytoolEvents for
+	// the actions of a Copytool, in the format used by liblustreapi
+	// copytools.
+	EventWriter struct {
+		mountPoint string
+		archives   []uint
+
+		mu sync.Mutex
+		w  io.Writer
+	}
+
+	// fifoWriter writes to an event FIFO without blocking, dropping
+	// events the reader is too slow to take, as liblustreapi does.
+	fifoWriter struct {
+		fd int
+	}
+)
+
+// MarshalJSON encodes the event as liblustreapi does.
+func (ev *CopytoolEvent) MarshalJSON() ([]byte, error) {
+	je := jsonEvent{
+		EventTime:    ev.Time.Unix(),
+		EventType:    string(ev.Type),
+		UUID:         ev.UUID,
+		MountPoint:   ev.MountPoint,
+		Fid:          ev.Fid,
+		DataFid:      ev.DataFid,
+		Cookie:       eventCookie(ev.Cookie),
+		LustrePath:   ev.LustrePath,
+		TotalBytes:   ev.TotalBytes,
+		CurrentBytes: ev.CurrentBytes,
+		ReturnCode:   ev.ReturnCode,
+		Message:      ev.Message,
+		Level:        ev.Level,
+	}
+	if ev.Type == EventRegister || ev.Type == EventUnregister || ev.ArchiveID != 0 {
+		archive := ev.ArchiveID
+		je.Archive = &archive
+	}
+	return json.Marshal(&je)
+}
+
+// UnmarshalJSON decodes an event.
+func (ev *CopytoolEvent) UnmarshalJSON(b []byte) error {
+	var je jsonEvent
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+	if je.EventType == "" {
+		return errors.New("missing event_type")
+	}
+	*ev = CopytoolEvent{
+		Time:         time.Unix(je.EventTime, 0),
+		Type:         CopytoolEventType(je.EventType),
+		UUID:         je.UUID,
+		MountPoint:   je.MountPoint,
+		Fid:          je.Fid,
+		DataFid:      je.DataFid,
+		Cookie:       uint64(je.Cookie),
+		LustrePath:   je.LustrePath,
+		TotalBytes:   je.TotalBytes,
+		CurrentBytes: je.CurrentBytes,
+		ReturnCode:   je.ReturnCode,
+		Message:      je.Message,
+		Level:        je.Level,
+	}
+	if je.Archive != nil {
+		ev.ArchiveID = *je.Archive
+	}
+	return nil
+}
+
+// MarshalJSON encodes the cookie as a hex string.
+func (c eventCookie) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%#x", uint64(c)))
+}
+
+// UnmarshalJSON decodes a cookie written as a string, in hex or
+// decimal, or as a number.
+func (c *eventCookie) UnmarshalJSON(b []byte) error {
+	var n uint64
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		var err error
+		if n, err = strconv.ParseUint(s, 0, 64); err != nil {
+			return errors.Wrap(err, "invalid cookie")
+		}
+	} else if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*c = eventCookie(n)
+	return nil
+}
+
+// ParseCopytoolEvent parses a single event.
+func ParseCopytoolEvent(b []byte) (*CopytoolEvent, error) {
+	var ev CopytoolEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		return nil, errors.Wrapf(err, "parse event %q", b)
+	}
+	return &ev, nil
+}
+
+// NewEventReader returns an EventReader for the events in r.
+func NewEventReader(r io.Reader) *EventReader {
+	return &EventReader{scanner: bufio.NewScanner(r)}
+}
+
+// Next returns the next event, or io.EOF at the end of the stream. Blank
+// lines are skipped.
+func (er *EventReader) Next() (*CopytoolEvent, error) {
+	for er.scanner.Scan() {
+		line := bytes.TrimSpace(er.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		return ParseCopytoolEvent(line)
+	}
+	if err := er.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// mkfifo creates the FIFO at path unless it already exists.
+func mkfifo(path string) error {
+	err := unix.Mkfifo(path, 0644)
+	if err != nil && err != unix.EEXIST {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return errors.Errorf("%s: not a FIFO", path)
+	}
+	return nil
+}
+
+// OpenEventFifo opens the FIFO at path for reading events, creating it if
+// needed. The FIFO is also opened for writing, so the reader doesn't see
+// EOF when a copytool exits.
+func OpenEventFifo(path string) (*os.File, error) {
+	if err := mkfifo(path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// CreateEventFifo opens the FIFO at path for a copytool to write events
+// to, creating it if needed. Writes never block: events are dropped
+// while the FIFO is full.
+func CreateEventFifo(path string) (io.WriteCloser, error) {
+	if err := mkfifo(path); err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &fifoWriter{fd: fd}, nil
+}
+
+func (fw *fifoWriter) Write(b []byte) (int, error) {
+	n, err := unix.Write(fw.fd, b)
+	if err == unix.EAGAIN {
+		debug.Printf("event FIFO full, dropping event")
+		return len(b), nil
+	}
+	return n, err
+}
+
+func (fw *fifoWriter) Close() error {
+	return unix.Close(fw.fd)
+}
+
+// NewEventWriter returns an EventWriter that writes events to w, usually
+// a FIFO opened with CreateEventFifo. The mount point and archive IDs
+// are reported in the registration events.
+func NewEventWriter(w io.Writer, mountPoint string, archiveIDs ...uint) *EventWriter {
+	return &EventWriter{w: w, mountPoint: mountPoint, archives: archiveIDs}
+}
+
+// Write writes an event as a single line.
+func (ew *EventWriter) Write(ev *CopytoolEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	_, err = ew.w.Write(append(b, '\n'))
+	return err
+}
+
+func (ew *EventWriter) write(ev *CopytoolEvent) {
+	ev.Time = time.Now()
+	if err := ew.Write(ev); err != nil {
+		debug.Printf("write %s event: %v", ev.Type, err)
+	}
+}
+
+// registration writes a registration event for each archive ID, or
+// for archive 0 (all archives) if there are none.
+func (ew *EventWriter) registration(t CopytoolEventType) {
+	archives := ew.archives
+	if len(archives) == 0 {
+		archives = []uint{0}
+	}
+	for _, id := range archives {
+		ew.write(&CopytoolEvent{Type: t, MountPoint: ew.mountPoint, ArchiveID: id})
+	}
+}
+
+// Register writes the events for the copytool registering.
+func (ew *EventWriter) Register() {
+	ew.registration(EventRegister)
+}
+
+// Unregister writes the events for the copytool unregistering.
+func (ew *EventWriter) Unregister() {
+	ew.registration(EventUnregister)
+}
+
+func actionEvent(ar ActionRequest, suffix string) *CopytoolEvent {
+	return &CopytoolEvent{
+		Type:      CopytoolEventType(ar.Action().String() + suffix),
+		Fid:       ar.Fid(),
+		Cookie:    ar.Cookie(),
+		ArchiveID: ar.ArchiveID(),
+	}
+}
+
+// ActionQueued implements ActionObserver.
+func (ew *EventWriter) ActionQueued(ar ActionRequest) {}
+
+// ActionStarted writes the START event for the action.
+func (ew *EventWriter) ActionStarted(ar ActionRequest, wait time.Duration) {
+	ew.write(actionEvent(ar, "_START"))
+}
+
+// ActionProgress writes a RUNNING event for the action.
+func (ew *EventWriter) ActionProgress(ar ActionRequest, copied, total int64) {
+	ev := actionEvent(ar, "_RUNNING")
+	ev.CurrentBytes, ev.TotalBytes = copied, total
+	ew.write(ev)
+}
+
+// ActionFinished writes the FINISH, CANCEL or ERROR event for the
+// action.
+func (ew *EventWriter) ActionFinished(ar ActionRequest, res *ActionResult) {
+	var ev *CopytoolEvent
+	switch res.Errval {
+	case 0:
+		ev = actionEvent(ar, "_FINISH")
+	case int(unix.ECANCELED):
+		ev = actionEvent(ar, "_CANCEL")
+	default:
+		ev = actionEvent(ar, "_ERROR")
+	}
+	ev.CurrentBytes = res.Bytes
+	if res.Length != lustre.MaxExtentLength {
+		ev.TotalBytes = res.Length
+	}
+	ev.ReturnCode = res.Errval
+	ew.write(ev)
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+)
+
+// Events in the format liblustreapi writes them, with the cookie as a
+// "%#jx" string and no return code.
+const liblustreapiEvents = `{"event_type": "REGISTER", "event_time": 1459265720, "archive": 0, "mount_point": "/mnt/lustre", "uuid": "b9f2c4e1-0c36-4c7e-b2a1-f7e1d3a0a4c2"}
+{"event_type": "ARCHIVE_START", "event_time": 1459265731, "lustre_path": "dir/f1", "data_fid": "[0x200000400:0x1:0x0]", "cookie": "0x57b1c1a8", "fid": "[0x200000400:0x1:0x0]"}
+
+{"event_type": "ARCHIVE_RUNNING", "event_time": 1459265732, "current_bytes": 4194304, "total_bytes": 10485760, "lustre_path": "dir/f1", "data_fid": "[0x200000400:0x1:0x0]", "cookie": "0x57b1c1a8", "fid": "[0x200000400:0x1:0x0]"}
+{"event_type": "ARCHIVE_ERROR", "event_time": 1459265734, "lustre_path": "dir/f1", "data_fid": "[0x200000400:0x1:0x0]", "cookie": "0x57b1c1a8", "fid": "[0x200000400:0x1:0x0]"}
+{"event_type": "LOGGED_MESSAGE", "event_time": 1459265740, "level": "error", "message": "cannot open archive: No such file or directory (2)"}
+`
+
+func TestEventReader(t *testing.T) {
+	er := hsm.NewEventReader(strings.NewReader(liblustreapiEvents))
+	var events []*hsm.CopytoolEvent
+	for {
+		ev, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 5 {
+		t.Fatalf("read %d events, expected 5", len(events))
+	}
+
+	reg := events[0]
+	if reg.Type != hsm.EventRegister || reg.MountPoint != "/mnt/lustre" || reg.ArchiveID != 0 ||
+		reg.UUID != "b9f2c4e1-0c36-4c7e-b2a1-f7e1d3a0a4c2" || !reg.Time.Equal(time.Unix(1459265720, 0)) {
+		t.Fatalf("unexpected register event: %+v", reg)
+	}
+	fid := lustre.Fid{Seq: 0x200000400, Oid: 1}
+	start := events[1]
+	if start.Type != hsm.EventArchiveStart || *start.Fid != fid || *start.DataFid != fid ||
+		start.Cookie != 0x57b1c1a8 || start.LustrePath != "dir/f1" {
+		t.Fatalf("unexpected start event: %+v", start)
+	}
+	if running := events[2]; running.CurrentBytes != 4<<20 || running.TotalBytes != 10<<20 {
+		t.Fatalf("unexpected running event: %+v", running)
+	}
+	if failed := events[3]; failed.Type != hsm.EventArchiveError || failed.Cookie != 0x57b1c1a8 {
+		t.Fatalf("unexpected error event: %+v", failed)
+	}
+	if msg := events[4]; msg.Type != hsm.EventLoggedMessage || msg.Level != "error" ||
+		msg.Message != "cannot open archive: No such file or directory (2)" {
+		t.Fatalf("unexpected message event: %+v", msg)
+	}
+
+	// Events written by Go copytools read back the same.
+	for _, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt, err := hsm.ParseCopytoolEvent(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b2, _ := json.Marshal(rt); !bytes.Equal(b, b2) {
+			t.Fatalf("round trip changed %s to %s", b, b2)
+		}
+	}
+	if b, _ := json.Marshal(start); !bytes.Contains(b, []byte(`"cookie":"0x57b1c1a8"`)) {
+		t.Fatalf("cookie not written as a hex string: %s", b)
+	}
+
+	// Cookies written as numbers are also accepted.
+	ev, err := hsm.ParseCopytoolEvent([]byte(`{"event_type": "ARCHIVE_START", "cookie": 1471267240}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Cookie != 0x57b1c1a8 {
+		t.Fatalf("got cookie %#x, expected 0x57b1c1a8", ev.Cookie)
+	}
+
+	for _, bad := range []string{
+		`{"event_time": 1}`,
+		`{"event_type": `,
+		`{"event_type": "ARCHIVE_START", "fid": ""}`,
+		`{"event_type": "ARCHIVE_START", "fid": "bogus"}`,
+		`{"event_type": "ARCHIVE_START", "data_fid": "["}`,
+		`{"event_type": "ARCHIVE_START", "cookie": "bogus"}`,
+	} {
+		if _, err := hsm.ParseCopytoolEvent([]byte(bad)); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+
+	// A bad event doesn't stop the reader.
+	er = hsm.NewEventReader(strings.NewReader(`{"event_type": "ARCHIVE_START", "fid": ""}` + "\n" + liblustreapiEvents))
+	if _, err := er.Next(); err == nil {
+		t.Fatal("expected error for an empty fid")
+	}
+	if ev, err := er.Next(); err != nil || ev.Type != hsm.EventRegister {
+		t.Fatalf("unexpected event after an error: %+v, %v", ev, err)
+	}
+}
+
+func TestCopytoolEvents(t *testing.T) {
+	lines := make(chanWriter, 100)
+	src, stop := startCopytool(t, &testBackend{length: 42, delay: 50 * time.Millisecond, progress: true},
+		hsm.OptCopytoolProgressInterval(10*time.Millisecond),
+		hsm.OptCopytoolEvents(hsm.NewEventWriter(lines, "/mnt/lustre", 1)))
+
+	next := func() *hsm.CopytoolEvent {
+		select {
+		case line := <-lines:
+			ev, err := hsm.ParseCopytoolEvent(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+		return nil
+	}
+
+	if ev := next(); ev.Type != hsm.EventRegister || ev.MountPoint != "/mnt/lustre" || ev.ArchiveID != 1 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	req := hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	src.Inject(req)
+	waitComplete(t, req)
+	if ev := next(); ev.Type != hsm.EventRestoreStart || ev.Cookie != req.Cookie() || ev.Fid.Oid != 2 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	var running int
+	ev := next()
+	for ; ev.Type == hsm.EventRestoreRunning; ev = next() {
+		// Heartbeats don't copy anything, and aren't reported.
+		if ev.CurrentBytes != 42 {
+			t.Fatalf("unexpected running event: %+v", ev)
+		}
+		running++
+	}
+	if ev.Type != hsm.EventRestoreFinish || ev.CurrentBytes != 42 || ev.ReturnCode != 0 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if running == 0 {
+		t.Fatal("no running events for the progress reported")
+	}
+
+	stop()
+	if ev := next(); ev.Type != hsm.EventUnregister {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestEventFifo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fifo")
+
+	w, err := hsm.CreateEventFifo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := hsm.OpenEventFifo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ew := hsm.NewEventWriter(w, "/mnt/lustre")
+	ew.Register()
+	ev, err := hsm.NewEventReader(r).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != hsm.EventRegister || ev.ArchiveID != 0 || ev.MountPoint != "/mnt/lustre" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hsm.CreateEventFifo(filepath.Join(dir, "file")); err == nil {
+		t.Fatal("expected error for a regular file")
+	}
+}
@@ -7,6 +7,7 @@ package hsm
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/intel-hpdd/go-lustre/llapi"
@@ -66,13 +67,18 @@ func (f *FileStatus) String() string {
 	return FileStatusString(f, true)
 }
 
+// NewFileStatus returns a *FileStatus for an HSM state and archive ID
+func NewFileStatus(state llapi.HsmFileState, archiveID uint32) *FileStatus {
+	return &FileStatus{ArchiveID: archiveID, state: state}
+}
+
 // GetFileStatus returns a *FileStatus for the given path
 func GetFileStatus(filePath string) (*FileStatus, error) {
 	s, id, err := llapi.GetHsmFileStatus(filePath)
 	if err != nil {
 		return nil, err
 	}
-	return &FileStatus{ArchiveID: id, state: s}, nil
+	return NewFileStatus(s, id), nil
 }
 
 func summarizeStatus(s *FileStatus) string {
@@ -135,6 +141,16 @@ func FileStatusString(s *FileStatus, summarize bool) string {
 	return buf.String()
 }
 
+// GetDataVersion returns the data version of the file at filePath.
+func GetDataVersion(filePath string, flags llapi.DataVersionFlag) (uint64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return llapi.GetDataVersion(int(f.Fd()), flags)
+}
+
 // SetFileStatus updates the file's HSM flags and/or archive ID
 func SetFileStatus(filePath string, setMask, clearMask uint64, archiveID uint32) error {
 	return llapi.SetHsmFileStatus(filePath, setMask, clearMask, archiveID)
@@ -0,0 +1,377 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gc removes the archive copies of files which have been
+// deleted from a Lustre filesystem.
+package gc
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// Remover deletes the archive copy of a file. Removing a copy
+	// that doesn't exist must not be an error, as removals are
+	// retried after failures and restarts.
+	Remover interface {
+		RemoveFid(ctx context.Context, fid *lustre.Fid) error
+	}
+
+	// CollectorOption is a configuration option for a Collector.
+	CollectorOption func(*Collector)
+
+	// Collector queues the archive copies of files reported deleted
+	// in the changelog, and removes them once a grace period has
+	// passed. The queue is journaled, so removals are not lost if the
+	// collector is restarted.
+	Collector struct {
+		mu            sync.Mutex
+		remover       Remover
+		journal       *journal
+		pending       map[lustre.Fid]*Entry
+		grace         time.Duration
+		retryInterval time.Duration
+		lastIndex     int64
+		savedIndex    int64
+		now           func() time.Time
+
+		// clear clears the changelog records up to an index, once
+		// they are reflected in the journal.
+		clear func(index int64) error
+	}
+)
+
+const (
+	defaultGracePeriod   = 24 * time.Hour
+	defaultRetryInterval = 10 * time.Minute
+)
+
+// OptCollectorGracePeriod sets how long after a file is deleted its
+// archive copy is removed. Until then, the removal can be cancelled
+// with Undelete.
+func OptCollectorGracePeriod(grace time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.grace = grace
+	}
+}
+
+// OptCollectorRetryInterval sets how long to wait before retrying a
+// failed removal.
+func OptCollectorRetryInterval(interval time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.retryInterval = interval
+	}
+}
+
+// OptCollectorChangelogUser clears the changelog records of the user,
+// registered on the MDT device with lctl changelog_register, once
+// they have been applied and journaled.
+func OptCollectorChangelogUser(device, user string) CollectorOption {
+	return func(c *Collector) {
+		c.clear = func(index int64) error {
+			return changelog.Clear(device, user, index)
+		}
+	}
+}
+
+// NewCollector returns a *Collector which removes archive copies with
+// remover, and journals its queue in the file at journalPath. Entries
+// left pending in an existing journal are restored.
+func NewCollector(remover Remover, journalPath string, options ...CollectorOption) (*Collector, error) {
+	j, pending, lastIndex, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &Collector{
+		remover:       remover,
+		journal:       j,
+		pending:       pending,
+		grace:         defaultGracePeriod,
+		retryInterval: defaultRetryInterval,
+		lastIndex:     lastIndex,
+		savedIndex:    lastIndex,
+		now:           time.Now,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// Close closes the journal.
+func (c *Collector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.journal.close()
+}
+
+// LastIndex returns the index of the last changelog record applied.
+// After a restart, it is the last index journaled, and following the
+// changelog should resume after it.
+func (c *Collector) LastIndex() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastIndex
+}
+
+// Checkpoint journals the index of the last changelog record applied,
+// and returns it. Records up to this index may be cleared.
+func (c *Collector) Checkpoint() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastIndex == c.savedIndex {
+		return c.savedIndex, nil
+	}
+	if err := c.journal.write(opIndex, nil, c.lastIndex); err != nil {
+		return 0, err
+	}
+	c.savedIndex = c.lastIndex
+	return c.savedIndex, nil
+}
+
+// write journals a change to an entry, along with the last index.
+func (c *Collector) write(op string, e *Entry) error {
+	if err := c.journal.write(op, e, c.lastIndex); err != nil {
+		return err
+	}
+	c.savedIndex = c.lastIndex
+	return nil
+}
+
+// Pending returns the entries waiting to be removed, oldest first.
+func (c *Collector) Pending() []*Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []*Entry
+	for _, e := range c.pending {
+		dup := *e
+		entries = append(entries, &dup)
+	}
+	sort.Sort(byUnlinked(entries))
+	return entries
+}
+
+type byUnlinked []*Entry
+
+func (s byUnlinked) Len() int           { return len(s) }
+func (s byUnlinked) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byUnlinked) Less(i, j int) bool { return s[i].Unlinked.Before(s[j].Unlinked) }
+
+// removedFid returns the fid of a file whose archive copy is orphaned
+// by the record, if any.
+func removedFid(rec changelog.Record) *lustre.Fid {
+	var last, exists bool
+	switch rec.TypeCode() {
+	case llapi.OpUnlink:
+		last, exists = rec.IsLastUnlink()
+	case llapi.OpRename:
+		// The target of a rename is the file overwritten, if any.
+		last, exists = rec.IsLastRename()
+	}
+	if !last || !exists {
+		return nil
+	}
+	fid := rec.TargetFid()
+	if fid == nil || fid.IsZero() {
+		return nil
+	}
+	return fid
+}
+
+// Apply queues the removal of the archive copy of a file deleted by
+// the record. Other records, and records at or below the last index
+// applied, are ignored, so a removal cancelled with Undelete is not
+// queued again when the changelog is replayed after a restart.
+func (c *Collector) Apply(rec changelog.Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rec.Index() <= c.lastIndex {
+		return nil
+	}
+	fid := removedFid(rec)
+	if fid == nil {
+		c.lastIndex = rec.Index()
+		return nil
+	}
+	if _, ok := c.pending[*fid]; ok {
+		c.lastIndex = rec.Index()
+		return nil
+	}
+
+	f := *fid
+	e := &Entry{Fid: &f, Index: rec.Index(), Unlinked: rec.Time()}
+	prev := c.lastIndex
+	c.lastIndex = rec.Index()
+	if err := c.write(opQueue, e); err != nil {
+		c.lastIndex = prev
+		return err
+	}
+	c.pending[f] = e
+	debug.Printf("gc: queued %s", fid)
+	return nil
+}
+
+// Undelete cancels the pending removal of a file's archive copy. It
+// returns false if no removal was pending.
+func (c *Collector) Undelete(fid *lustre.Fid) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.pending[*fid]
+	if !ok {
+		return false, nil
+	}
+	if err := c.write(opUndelete, e); err != nil {
+		return false, err
+	}
+	delete(c.pending, *fid)
+	return true, nil
+}
+
+// due returns the entries whose grace period has passed, oldest first.
+func (c *Collector) due() []*Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	var entries []*Entry
+	for _, e := range c.pending {
+		if now.Sub(e.Unlinked) >= c.grace && !now.Before(e.nextAttempt) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Sort(byUnlinked(entries))
+	return entries
+}
+
+// Collect removes the archive copies whose grace period has passed,
+// and returns the number removed. Failed removals are retried by a
+// later Collect after the retry interval.
+func (c *Collector) Collect(ctx context.Context) (int, error) {
+	removed := 0
+	for _, e := range c.due() {
+		if ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+		err := c.remover.RemoveFid(ctx, e.Fid)
+
+		c.mu.Lock()
+		if _, ok := c.pending[*e.Fid]; !ok {
+			// Undeleted while the removal was in progress.
+			c.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			e.Attempts++
+			e.LastError = err.Error()
+			e.nextAttempt = c.now().Add(c.retryInterval)
+			alert.Warnf("gc: remove %s failed (attempt %d): %v", e.Fid, e.Attempts, err)
+			if jerr := c.write(opFailed, e); jerr != nil {
+				c.mu.Unlock()
+				return removed, jerr
+			}
+			c.mu.Unlock()
+			continue
+		}
+		if jerr := c.write(opRemoved, e); jerr != nil {
+			c.mu.Unlock()
+			return removed, jerr
+		}
+		delete(c.pending, *e.Fid)
+		c.mu.Unlock()
+
+		debug.Printf("gc: removed %s", e.Fid)
+		removed++
+	}
+	return removed, nil
+}
+
+// Run applies changelog records and collects due removals every
+// interval, until ctx is done or the records fail. The records should
+// start after LastIndex. With OptCollectorChangelogUser, the records
+// applied are checkpointed and cleared every interval. The records are
+// read in a separate goroutine, which returns when the iterator
+// returns an error, so a blocking iterator should be closed when ctx
+// is done.
+func (c *Collector) Run(ctx context.Context, records changelog.RecordIterator, interval time.Duration) error {
+	type result struct {
+		rec changelog.Record
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		for {
+			rec, err := records.NextRecord()
+			if err == io.EOF {
+				// Nothing new yet.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+				continue
+			}
+			select {
+			case results <- result{rec, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r := <-results:
+			if r.err != nil {
+				return r.err
+			}
+			if err := c.Apply(r.rec); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := c.Collect(ctx); err != nil && err != ctx.Err() {
+				return err
+			}
+			if err := c.clearChangelog(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// clearChangelog checkpoints the last index applied, and clears the
+// changelog records up to it.
+func (c *Collector) clearChangelog() error {
+	if c.clear == nil {
+		return nil
+	}
+	index, err := c.Checkpoint()
+	if err != nil || index == 0 {
+		return err
+	}
+	if err := c.clear(index); err != nil {
+		alert.Warnf("gc: clear changelog to %d: %v", index, err)
+	}
+	return nil
+}
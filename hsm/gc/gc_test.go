@@ -0,0 +1,251 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package gc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/changelog/simulator"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type testRemover struct {
+	removed map[lustre.Fid]int
+	fail    map[lustre.Fid]bool
+}
+
+func (r *testRemover) RemoveFid(ctx context.Context, fid *lustre.Fid) error {
+	if r.fail[*fid] {
+		return errors.New("archive unavailable")
+	}
+	r.removed[*fid]++
+	return nil
+}
+
+func newTestCollector(t *testing.T, journal string, remover Remover, now *time.Time) *Collector {
+	c, err := NewCollector(remover, journal,
+		OptCollectorGracePeriod(time.Hour),
+		OptCollectorRetryInterval(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	start := time.Now()
+	now := start
+	remover := &testRemover{
+		removed: make(map[lustre.Fid]int),
+		fail:    map[lustre.Fid]bool{*simulator.TestFid(5): true},
+	}
+	c := newTestCollector(t, journal, remover, &now)
+
+	at := func(index int64) simulator.RecordOption {
+		return simulator.OptRecordTime(start.Add(time.Duration(index) * time.Second))
+	}
+	last := simulator.OptRecordLast
+	for _, rec := range []changelog.Record{
+		simulator.NewTestRecord(1, llapi.OpUnlink, simulator.TestFid(1), at(1), last(true)),
+		// Other links remain.
+		simulator.NewTestRecord(2, llapi.OpUnlink, simulator.TestFid(2), at(2)),
+		// Never archived.
+		simulator.NewTestRecord(3, llapi.OpUnlink, simulator.TestFid(3), at(3), last(false)),
+		// Overwritten by a rename.
+		simulator.NewTestRecord(4, llapi.OpRename, simulator.TestFid(4), at(4), last(true)),
+		simulator.NewTestRecord(5, llapi.OpUnlink, simulator.TestFid(5), at(5), last(true)),
+		simulator.NewTestRecord(6, llapi.OpUnlink, simulator.TestFid(6), at(6), last(true)),
+		simulator.NewTestRecord(7, llapi.OpCreate, simulator.TestFid(7), at(7)),
+	} {
+		if err := c.Apply(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(c.Pending()); got != 4 {
+		t.Fatalf("got %d pending, want 4", got)
+	}
+	if got := c.LastIndex(); got != 7 {
+		t.Fatalf("LastIndex() = %d, want 7", got)
+	}
+
+	// Nothing is due during the grace period.
+	if n, err := c.Collect(context.Background()); n != 0 || err != nil {
+		t.Fatalf("Collect() = %d, %v during grace period", n, err)
+	}
+
+	if ok, err := c.Undelete(simulator.TestFid(6)); !ok || err != nil {
+		t.Fatalf("Undelete() = %v, %v", ok, err)
+	}
+	if ok, _ := c.Undelete(simulator.TestFid(3)); ok {
+		t.Fatal("Undelete() of unqueued file succeeded")
+	}
+
+	now = start.Add(2 * time.Hour)
+	if n, err := c.Collect(context.Background()); n != 2 || err != nil {
+		t.Fatalf("Collect() = %d, %v, want 2", n, err)
+	}
+	for n, want := range map[uint32]int{1: 1, 2: 0, 3: 0, 4: 1, 5: 0, 6: 0} {
+		if got := remover.removed[*simulator.TestFid(n)]; got != want {
+			t.Errorf("file %d removed %d times, want %d", n, got, want)
+		}
+	}
+	pending := c.Pending()
+	if len(pending) != 1 || pending[0].Fid.Oid != 5 || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected pending entries: %v", pending)
+	}
+
+	// The failed removal isn't retried until the retry interval passes.
+	remover.fail = nil
+	if n, _ := c.Collect(context.Background()); n != 0 {
+		t.Fatalf("retried before retry interval")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending removal survives a restart, and is retried.
+	c = newTestCollector(t, journal, remover, &now)
+	defer c.Close()
+	pending = c.Pending()
+	if len(pending) != 1 || pending[0].Fid.Oid != 5 || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected pending entries after restart: %v", pending)
+	}
+	if n, err := c.Collect(context.Background()); n != 1 || err != nil {
+		t.Fatalf("Collect() = %d, %v, want 1", n, err)
+	}
+	if len(c.Pending()) != 0 {
+		t.Fatal("removal still pending")
+	}
+}
+
+func TestCollectorRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	now := time.Now()
+	remover := &testRemover{removed: make(map[lustre.Fid]int)}
+	c := newTestCollector(t, journal, remover, &now)
+	unlink := simulator.NewTestRecord(1, llapi.OpUnlink, simulator.TestFid(1), simulator.OptRecordTime(now), simulator.OptRecordLast(true))
+	if err := c.Apply(unlink); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(simulator.NewTestRecord(2, llapi.OpCreate, simulator.TestFid(2))); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Undelete(simulator.TestFid(1)); !ok || err != nil {
+		t.Fatalf("Undelete() = %v, %v", ok, err)
+	}
+	if err := c.Apply(simulator.NewTestRecord(3, llapi.OpCreate, simulator.TestFid(3))); err != nil {
+		t.Fatal(err)
+	}
+	if index, err := c.Checkpoint(); index != 3 || err != nil {
+		t.Fatalf("Checkpoint() = %d, %v, want 3", index, err)
+	}
+	c.Close()
+
+	// The changelog is replayed from the start after the restart, as
+	// it hasn't been cleared.
+	c = newTestCollector(t, journal, remover, &now)
+	defer c.Close()
+	if got := c.LastIndex(); got != 3 {
+		t.Fatalf("LastIndex() = %d after restart, want 3", got)
+	}
+	if err := c.Apply(unlink); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(c.Pending()); got != 0 {
+		t.Fatalf("undeleted file queued again after restart: %v", c.Pending())
+	}
+}
+
+func TestCollectorClearsChangelog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	c := newTestCollector(t, filepath.Join(dir, "journal"), &testRemover{removed: make(map[lustre.Fid]int)}, &now)
+	defer c.Close()
+	cleared := make(chan int64, 10)
+	c.clear = func(index int64) error {
+		cleared <- index
+		return nil
+	}
+
+	records := simulator.RecordList{
+		simulator.NewTestRecord(4, llapi.OpUnlink, simulator.TestFid(1), simulator.OptRecordTime(now), simulator.OptRecordLast(true)),
+		simulator.NewTestRecord(5, llapi.OpCreate, simulator.TestFid(2)),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, &records, 5*time.Millisecond)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case index := <-cleared:
+			if index == 5 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("changelog not cleared to 5")
+		}
+	}
+}
+
+func TestJournalPartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal := filepath.Join(dir, "journal")
+
+	now := time.Now()
+	remover := &testRemover{removed: make(map[lustre.Fid]int)}
+	c := newTestCollector(t, journal, remover, &now)
+	rec := simulator.NewTestRecord(1, llapi.OpUnlink, simulator.TestFid(1), simulator.OptRecordTime(now), simulator.OptRecordLast(true))
+	if err := c.Apply(rec); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Simulate a crash in the middle of a write.
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"removed","entry":{"fid":`)
+	f.Close()
+
+	c = newTestCollector(t, journal, remover, &now)
+	defer c.Close()
+	if got := len(c.Pending()); got != 1 {
+		t.Fatalf("got %d pending, want 1", got)
+	}
+}
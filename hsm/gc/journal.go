@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package gc
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+// Journal operations.
+const (
+	opQueue    = "queue"
+	opRemoved  = "removed"
+	opUndelete = "undelete"
+	opFailed   = "failed"
+	opIndex    = "index"
+)
+
+type (
+	// Entry is an archive copy waiting to be removed.
+	Entry struct {
+		Fid       *lustre.Fid `json:"fid"`
+		Index     int64       `json:"index,omitempty"`
+		Unlinked  time.Time   `json:"unlinked"`
+		Attempts  int         `json:"attempts,omitempty"`
+		LastError string      `json:"last_error,omitempty"`
+
+		// nextAttempt is when a failed removal is next tried.
+		nextAttempt time.Time
+	}
+
+	journalRecord struct {
+		Op    string    `json:"op"`
+		Time  time.Time `json:"time"`
+		Entry *Entry    `json:"entry,omitempty"`
+		// LastIndex is the index of the last changelog record
+		// applied when the record was written.
+		LastIndex int64 `json:"last_index,omitempty"`
+	}
+
+	// journal is an append-only log of the collector's state changes,
+	// so pending removals survive a restart.
+	journal struct {
+		path string
+		f    *os.File
+	}
+)
+
+// openJournal replays the journal at path and returns it along with
+// the entries still pending and the last changelog index recorded. The
+// journal is compacted to contain only the pending entries.
+func openJournal(path string) (*journal, map[lustre.Fid]*Entry, int64, error) {
+	pending, lastIndex, err := replayJournal(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	j := &journal{path: path}
+	if err := j.compact(pending, lastIndex); err != nil {
+		return nil, nil, 0, err
+	}
+	return j, pending, lastIndex, nil
+}
+
+func replayJournal(path string) (map[lustre.Fid]*Entry, int64, error) {
+	pending := make(map[lustre.Fid]*Entry)
+	var lastIndex int64
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return pending, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec journalRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A partial record at the end is from an interrupted
+			// write, and is dropped.
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "%s: corrupt journal", path)
+		}
+		if rec.LastIndex > lastIndex {
+			lastIndex = rec.LastIndex
+		}
+		if rec.Entry == nil || rec.Entry.Fid == nil {
+			continue
+		}
+		if rec.Entry.Index > lastIndex {
+			lastIndex = rec.Entry.Index
+		}
+		switch rec.Op {
+		case opQueue, opFailed:
+			pending[*rec.Entry.Fid] = rec.Entry
+		case opRemoved, opUndelete:
+			delete(pending, *rec.Entry.Fid)
+		}
+	}
+	return pending, lastIndex, nil
+}
+
+// compact rewrites the journal with only the pending entries and the
+// last changelog index.
+func (j *journal) compact(pending map[lustre.Fid]*Entry, lastIndex int64) error {
+	tmp, err := os.Create(j.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	if err := enc.Encode(&journalRecord{Op: opIndex, Time: time.Now(), LastIndex: lastIndex}); err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, e := range pending {
+		if err := enc.Encode(&journalRecord{Op: opQueue, Time: time.Now(), Entry: e, LastIndex: lastIndex}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(j.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// write appends a record to the journal and syncs it to disk.
+func (j *journal) write(op string, e *Entry, lastIndex int64) error {
+	buf, err := json.Marshal(&journalRecord{Op: op, Time: time.Now(), Entry: e, LastIndex: lastIndex})
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(buf, '\n')); err != nil {
+		return errors.Wrapf(err, "%s: write failed", j.path)
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
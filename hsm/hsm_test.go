@@ -5,10 +5,14 @@
 package hsm_test
 
 import (
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/go-lustre/hsm"
 )
 
@@ -31,3 +35,54 @@ func TestActionSource(t *testing.T) {
 		t.Fatalf("err: huh?")
 	}
 }
+
+func TestRequestCookiesUnique(t *testing.T) {
+	const count = 100
+
+	cookies := make(chan uint64, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+			cookies <- req.Cookie()
+		}()
+	}
+	wg.Wait()
+	close(cookies)
+
+	seen := make(map[uint64]bool)
+	for c := range cookies {
+		if seen[c] {
+			t.Fatalf("duplicate cookie 0x%x", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestRequestFailWithoutReader(t *testing.T) {
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req.FailImmediately(int(syscall.EINVAL))
+		// Ending again has no effect.
+		req.FailImmediately(int(syscall.EIO))
+		req.End(0, 0, 0, 0)
+		req.Progress(0, 1, 1, 0)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FailImmediately blocked without a reader")
+	}
+
+	var updates []*hsm.TestProgressUpdate
+	for p := range req.ProgressUpdates() {
+		updates = append(updates, p)
+	}
+	if len(updates) != 1 || !updates[0].Complete || updates[0].Errval != int(syscall.EINVAL) {
+		t.Fatalf("unexpected updates: %v", updates)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package importer creates released files in a Lustre filesystem for the
+// files listed in the manifest of an existing archive, so the archive
+// can be brought under Lustre HSM without copying any data.
+package importer
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const defaultImporterWorkers = 8
+
+type (
+	// Stats counts the files processed by an Importer.
+	Stats struct {
+		Imported int
+		Skipped  int
+		Failed   int
+	}
+
+	// ImporterOption is a configuration option for an Importer.
+	ImporterOption func(*Importer) error
+
+	// Importer imports the entries of a manifest into a directory as
+	// released files. Progress is recorded in a journal, so an import
+	// that is interrupted skips the files already imported when it is
+	// run again.
+	Importer struct {
+		dest      string
+		workers   int
+		archiveID uint
+		journal   *journal
+		done      map[string]bool
+
+		mu    sync.Mutex // protects stats
+		stats Stats
+
+		// Hooks for testing.
+		importFile func(path string, archive uint, fi os.FileInfo, layout *llapi.DataLayout) (*lustre.Fid, error)
+		lookupFid  func(path string) (*lustre.Fid, error)
+		getStatus  func(path string) (*hsm.FileStatus, error)
+	}
+)
+
+// OptImporterWorkers sets the number of files imported concurrently.
+func OptImporterWorkers(count int) ImporterOption {
+	return func(im *Importer) error {
+		if count < 1 {
+			return errors.Errorf("invalid worker count: %d", count)
+		}
+		im.workers = count
+		return nil
+	}
+}
+
+// OptImporterArchiveID sets the archive ID of entries that don't have
+// one in the manifest.
+func OptImporterArchiveID(archiveID uint) ImporterOption {
+	return func(im *Importer) error {
+		im.archiveID = archiveID
+		return nil
+	}
+}
+
+// NewImporter returns an Importer that creates files under dest,
+// recording its progress in the journal at journalPath. If the journal
+// exists, the files it records as imported are skipped.
+func NewImporter(dest string, journalPath string, options ...ImporterOption) (*Importer, error) {
+	im := &Importer{
+		dest:       dest,
+		workers:    defaultImporterWorkers,
+		importFile: hsm.Import,
+		lookupFid:  fs.LookupFid,
+		getStatus:  hsm.GetFileStatus,
+	}
+	for _, option := range options {
+		if err := option(im); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	im.journal, im.done, err = openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	return im, nil
+}
+
+// Close closes the journal.
+func (im *Importer) Close() error {
+	return im.journal.Close()
+}
+
+// Stats returns the number of files processed so far.
+func (im *Importer) Stats() Stats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.stats
+}
+
+// Run imports the entries of the manifest until it is exhausted or ctx
+// is canceled. Files that fail to import are reported and counted, and
+// are retried the next time the import is run. An error is returned if
+// the manifest can't be read or the journal can't be written.
+func (im *Importer) Run(ctx context.Context, m Manifest) (Stats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entries := make(chan *Entry)
+	errc := make(chan error, im.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < im.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				if err := im.importEntry(e); err != nil {
+					errc <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	err := im.feed(ctx, m, entries)
+	close(entries)
+	wg.Wait()
+	close(errc)
+
+	// A journal error is the cause of any cancellation.
+	if jerr := <-errc; jerr != nil {
+		err = jerr
+	}
+	return im.Stats(), err
+}
+
+// feed sends the manifest entries which have not been imported to the
+// workers.
+func (im *Importer) feed(ctx context.Context, m Manifest, entries chan<- *Entry) error {
+	for {
+		e, err := m.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if im.done[e.Path] {
+			im.count(&im.stats.Skipped)
+			continue
+		}
+		select {
+		case entries <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (im *Importer) count(n *int) {
+	im.mu.Lock()
+	*n++
+	im.mu.Unlock()
+}
+
+// importEntry imports one file. Only errors writing the journal are
+// returned; other failures are journaled and counted.
+func (im *Importer) importEntry(e *Entry) error {
+	fid, err := im.create(e)
+	if err != nil {
+		alert.Warnf("%s: import failed: %v", e.Path, err)
+		im.count(&im.stats.Failed)
+		return im.journal.append(&journalRecord{Op: opFailed, Path: e.Path, Key: e.Key, Error: err.Error()})
+	}
+	debug.Printf("%s: imported as %s", e.Path, fid)
+	im.count(&im.stats.Imported)
+	return im.journal.append(&journalRecord{Op: opImported, Path: e.Path, Key: e.Key, Fid: fid})
+}
+
+// create creates the released file and its parent directories. A file
+// which already exists is accepted if it was imported by an earlier run
+// that was interrupted before it was journaled.
+func (im *Importer) create(e *Entry) (*lustre.Fid, error) {
+	path := filepath.Join(im.dest, e.Path)
+	archiveID := e.ArchiveID
+	if archiveID == 0 {
+		archiveID = im.archiveID
+	}
+	if archiveID == 0 {
+		return nil, errors.New("no archive ID")
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		return im.existing(path, archiveID)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return im.importFile(path, archiveID, e.fileInfo(), e.layout())
+}
+
+func (im *Importer) existing(path string, archiveID uint) (*lustre.Fid, error) {
+	s, err := im.getStatus(path)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Released() || !s.Archived() || s.ArchiveID != uint32(archiveID) {
+		return nil, errors.Errorf("file exists and was not imported from archive %d", archiveID)
+	}
+	return im.lookupFid(path)
+}
+
+// WriteMap writes the backend key and FID of each file imported with a
+// key, as recorded in the journal at journalPath, as JSON lines of
+// MapEntry.
+func WriteMap(w io.Writer, journalPath string) error {
+	enc := json.NewEncoder(w)
+	var err error
+	_, rerr := replayJournal(journalPath, func(rec *journalRecord) {
+		if err != nil || rec.Op != opImported || rec.Key == "" {
+			return
+		}
+		err = enc.Encode(&MapEntry{Key: rec.Key, Fid: rec.Fid})
+	})
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+const testJSON = `{"path": "a/b/one", "uid": 10, "gid": 20, "mode": 416, "size": 100, "mtime": "2016-01-02T03:04:05Z", "archive_id": 2, "stripe_count": 4, "pool": "fast", "key": "obj-1"}
+
+{"path": "a/two", "size": 200, "key": "obj-2"}
+{"path": "./three", "size": 0}
+`
+
+const testCSV = `path,uid,gid,mode,size,mtime,archive_id,key
+a/b/one,10,20,0640,100,1451703845,2,obj-1
+a/two,,,,200,,,obj-2
+three,,,,0,,,
+`
+
+func readAll(t *testing.T, m Manifest) []*Entry {
+	var entries []*Entry
+	for {
+		e, err := m.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	csvm, err := NewCSVManifest(strings.NewReader(testCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range map[string]Manifest{
+		"json": NewJSONManifest(strings.NewReader(testJSON)),
+		"csv":  csvm,
+	} {
+		entries := readAll(t, m)
+		if len(entries) != 3 {
+			t.Fatalf("%s: read %d entries, expected 3", name, len(entries))
+		}
+		e := entries[0]
+		if e.Path != "a/b/one" || e.Uid != 10 || e.Gid != 20 || e.Mode != 0640 ||
+			e.Size != 100 || e.ArchiveID != 2 || e.Key != "obj-1" {
+			t.Fatalf("%s: unexpected entry: %+v", name, e)
+		}
+		if !e.Mtime.Equal(time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("%s: mtime %v", name, e.Mtime)
+		}
+		if entries[1].Mode != defaultMode || entries[2].Path != "three" {
+			t.Fatalf("%s: unexpected entries: %+v %+v", name, entries[1], entries[2])
+		}
+
+		st := e.fileInfo().Sys().(*syscall.Stat_t)
+		if st.Mode != syscall.S_IFREG|0640 || st.Size != 100 || st.Mtim.Sec != 1451703845 {
+			t.Fatalf("%s: unexpected stat: %+v", name, st)
+		}
+	}
+
+	if l := readAll(t, NewJSONManifest(strings.NewReader(testJSON)))[0].layout(); l == nil ||
+		l.StripeCount != 4 || l.PoolName != "fast" {
+		t.Fatalf("unexpected layout: %+v", l)
+	}
+
+	for _, bad := range []string{
+		`{"path": "/abs", "size": 1}`,
+		`{"path": "../up", "size": 1}`,
+		`{"path": "a", "size": -1}`,
+		`{"path": "a", "mode": 65535}`,
+		`{"path": `,
+	} {
+		if _, err := NewJSONManifest(strings.NewReader(bad)).Next(); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+	if _, err := NewCSVManifest(strings.NewReader("path,bogus\n")); err == nil {
+		t.Fatal("expected error for unknown column")
+	}
+}
+
+// testFS simulates importing files into Lustre.
+type testFS struct {
+	mu      sync.Mutex
+	nextOid uint32
+	files   map[string]*lustre.Fid
+	archive map[string]uint
+	fail    string
+}
+
+func newTestImporter(t *testing.T, dest, journal string, tfs *testFS) *Importer {
+	im, err := NewImporter(dest, journal, OptImporterWorkers(3), OptImporterArchiveID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.importFile = func(path string, archive uint, fi os.FileInfo, layout *llapi.DataLayout) (*lustre.Fid, error) {
+		tfs.mu.Lock()
+		defer tfs.mu.Unlock()
+		if filepath.Base(path) == tfs.fail {
+			return nil, syscall.EIO
+		}
+		if err := ioutil.WriteFile(path, nil, fi.Mode()); err != nil {
+			return nil, err
+		}
+		tfs.nextOid++
+		fid := &lustre.Fid{Seq: 0x200000400, Oid: tfs.nextOid}
+		tfs.files[path] = fid
+		tfs.archive[path] = archive
+		return fid, nil
+	}
+	im.getStatus = func(path string) (*hsm.FileStatus, error) {
+		tfs.mu.Lock()
+		defer tfs.mu.Unlock()
+		if _, ok := tfs.files[path]; !ok {
+			return hsm.NewFileStatus(0, 0), nil
+		}
+		state := llapi.HsmFileExists | llapi.HsmFileArchived | llapi.HsmFileReleased
+		return hsm.NewFileStatus(llapi.HsmFileState(state), uint32(tfs.archive[path])), nil
+	}
+	im.lookupFid = func(path string) (*lustre.Fid, error) {
+		tfs.mu.Lock()
+		defer tfs.mu.Unlock()
+		return tfs.files[path], nil
+	}
+	return im
+}
+
+func TestImporterResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	journal := filepath.Join(dir, "journal")
+	tfs := &testFS{files: make(map[string]*lustre.Fid), archive: make(map[string]uint), fail: "two"}
+
+	im := newTestImporter(t, dest, journal, tfs)
+	stats, err := im.Run(context.Background(), NewJSONManifest(strings.NewReader(testJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.Close()
+	if stats != (Stats{Imported: 2, Failed: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if tfs.archive[filepath.Join(dest, "a/b/one")] != 2 || tfs.archive[filepath.Join(dest, "three")] != 1 {
+		t.Fatalf("unexpected archive IDs: %v", tfs.archive)
+	}
+
+	// The second run retries the failed file, and accepts a file that
+	// was imported but not journaled.
+	tfs.fail = ""
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op": "imported", "path": "part`)
+	f.Close()
+	extra := `{"path": "four", "size": 1, "key": "obj-4"}` + "\n"
+	tfs.files[filepath.Join(dest, "four")] = &lustre.Fid{Seq: 1, Oid: 99}
+	tfs.archive[filepath.Join(dest, "four")] = 1
+	if err := ioutil.WriteFile(filepath.Join(dest, "four"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	im = newTestImporter(t, dest, journal, tfs)
+	stats, err = im.Run(context.Background(), NewJSONManifest(strings.NewReader(testJSON+extra)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.Close()
+	if stats != (Stats{Imported: 2, Skipped: 2}) {
+		t.Fatalf("unexpected stats after resume: %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMap(&buf, journal); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]string)
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var m MapEntry
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		keys[m.Key] = m.Fid.String()
+	}
+	if len(keys) != 3 || keys["obj-1"] != tfs.files[filepath.Join(dest, "a/b/one")].String() ||
+		keys["obj-4"] != (&lustre.Fid{Seq: 1, Oid: 99}).String() {
+		t.Fatalf("unexpected map: %v", keys)
+	}
+}
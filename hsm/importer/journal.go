@@ -0,0 +1,130 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+// Journal operations.
+const (
+	opImported = "imported"
+	opFailed   = "failed"
+)
+
+type (
+	journalRecord struct {
+		Op    string      `json:"op"`
+		Time  time.Time   `json:"time"`
+		Path  string      `json:"path"`
+		Key   string      `json:"key,omitempty"`
+		Fid   *lustre.Fid `json:"fid,omitempty"`
+		Error string      `json:"error,omitempty"`
+	}
+
+	// MapEntry maps the backend key of an imported file to its FID.
+	MapEntry struct {
+		Key string      `json:"key"`
+		Fid *lustre.Fid `json:"fid"`
+	}
+
+	// journal is an append-only log of the files imported, so an
+	// interrupted import can be resumed.
+	journal struct {
+		mu   sync.Mutex
+		path string
+		f    *os.File
+		enc  *json.Encoder
+	}
+)
+
+// openJournal opens the journal at path for appending, and returns the
+// paths of the files already imported.
+func openJournal(path string) (*journal, map[string]bool, error) {
+	done := make(map[string]bool)
+	valid, err := replayJournal(path, func(rec *journalRecord) {
+		if rec.Op == opImported {
+			done[rec.Path] = true
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Drop a partial record left by an interrupted write, so new
+	// records start on a line of their own.
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &journal{path: path, f: f, enc: json.NewEncoder(f)}, done, nil
+}
+
+// replayJournal calls fn for each record in the journal, and returns
+// the length of the journal up to the last complete record.
+func replayJournal(path string, fn func(*journalRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial record at the end is from an interrupted
+			// write, and is dropped.
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, errors.Wrapf(err, "%s: corrupt journal at offset %d", path, valid)
+		}
+		valid += int64(len(line))
+		fn(&rec)
+	}
+}
+
+func (j *journal) append(rec *journalRecord) error {
+	rec.Time = time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return errors.Wrapf(j.enc.Encode(rec), "%s: write journal", j.path)
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+const defaultMode = 0644
+
+type (
+	// Entry describes a file in the manifest of an archive. Path is
+	// relative to the directory the files are imported into.
+	Entry struct {
+		Path      string    `json:"path"`
+		Uid       uint32    `json:"uid"`
+		Gid       uint32    `json:"gid"`
+		Mode      uint32    `json:"mode"`
+		Size      int64     `json:"size"`
+		Atime     time.Time `json:"atime"`
+		Mtime     time.Time `json:"mtime"`
+		ArchiveID uint      `json:"archive_id"`
+
+		// The layout is optional. The filesystem default is used
+		// for any value not set.
+		StripeCount int    `json:"stripe_count,omitempty"`
+		StripeSize  int    `json:"stripe_size,omitempty"`
+		Pool        string `json:"pool,omitempty"`
+
+		// Key identifies the file's data in the backend.
+		Key string `json:"key,omitempty"`
+
+		// line is the manifest line the entry was read from.
+		line int
+	}
+
+	// Manifest is a source of entries to import. Next returns io.EOF
+	// after the last entry.
+	Manifest interface {
+		Next() (*Entry, error)
+	}
+
+	jsonManifest struct {
+		scanner *bufio.Scanner
+		line    int
+	}
+
+	csvManifest struct {
+		r       *csv.Reader
+		columns map[string]int
+		line    int
+	}
+
+	// entryInfo is the os.FileInfo of an entry, as expected by
+	// hsm.Import.
+	entryInfo struct {
+		e  *Entry
+		st syscall.Stat_t
+	}
+)
+
+// NewJSONManifest returns a Manifest that reads one JSON entry per line.
+// Blank lines are ignored.
+func NewJSONManifest(r io.Reader) Manifest {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &jsonManifest{scanner: scanner}
+}
+
+func (m *jsonManifest) Next() (*Entry, error) {
+	for m.scanner.Scan() {
+		m.line++
+		line := strings.TrimSpace(m.scanner.Text())
+		if line == "" {
+			continue
+		}
+		e := &Entry{Mode: defaultMode, line: m.line}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			return nil, errors.Wrapf(err, "manifest line %d", m.line)
+		}
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	if err := m.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// csvColumns are the columns a CSV manifest may contain. Only path and
+// size are required.
+var csvColumns = []string{
+	"path", "uid", "gid", "mode", "size", "atime", "mtime", "archive_id",
+	"stripe_count", "stripe_size", "pool", "key",
+}
+
+// NewCSVManifest returns a Manifest that reads a CSV file. The first
+// record names the columns. Modes may be given in octal with a leading
+// 0, and times as RFC 3339 or seconds since the epoch.
+func NewCSVManifest(r io.Reader) (Manifest, error) {
+	m := &csvManifest{r: csv.NewReader(r), columns: make(map[string]int)}
+	m.r.FieldsPerRecord = -1
+	header, err := m.r.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "manifest header")
+	}
+	m.line = 1
+	for i, name := range header {
+		m.columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"path", "size"} {
+		if _, ok := m.columns[name]; !ok {
+			return nil, errors.Errorf("manifest header: missing %q column", name)
+		}
+	}
+	for name := range m.columns {
+		if !isCSVColumn(name) {
+			return nil, errors.Errorf("manifest header: unknown column %q", name)
+		}
+	}
+	return m, nil
+}
+
+func isCSVColumn(name string) bool {
+	for _, c := range csvColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *csvManifest) Next() (*Entry, error) {
+	record, err := m.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	m.line++
+	e := &Entry{Mode: defaultMode, line: m.line}
+
+	field := func(name string) string {
+		if i, ok := m.columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	parseUint := func(name string, bits int) uint64 {
+		s := field(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = strconv.ParseUint(s, 0, bits)
+		err = errors.Wrapf(err, "manifest line %d: %s", m.line, name)
+		return v
+	}
+	parseTime := func(name string) time.Time {
+		s := field(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		if secs, perr := strconv.ParseInt(s, 10, 64); perr == nil {
+			return time.Unix(secs, 0)
+		}
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, s)
+		err = errors.Wrapf(err, "manifest line %d: %s", m.line, name)
+		return t
+	}
+
+	e.Path = field("path")
+	e.Uid = uint32(parseUint("uid", 32))
+	e.Gid = uint32(parseUint("gid", 32))
+	if field("mode") != "" {
+		e.Mode = uint32(parseUint("mode", 32))
+	}
+	e.Size = int64(parseUint("size", 63))
+	e.Atime = parseTime("atime")
+	e.Mtime = parseTime("mtime")
+	e.ArchiveID = uint(parseUint("archive_id", 32))
+	e.StripeCount = int(parseUint("stripe_count", 16))
+	e.StripeSize = int(parseUint("stripe_size", 32))
+	e.Pool = field("pool")
+	e.Key = field("key")
+	if err != nil {
+		return nil, err
+	}
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// validate checks the entry and cleans its path.
+func (e *Entry) validate() error {
+	if e.Path == "" {
+		return errors.Errorf("manifest line %d: missing path", e.line)
+	}
+	p := filepath.Clean(e.Path)
+	if filepath.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return errors.Errorf("manifest line %d: invalid path %q", e.line, e.Path)
+	}
+	e.Path = p
+	if e.Size < 0 {
+		return errors.Errorf("manifest line %d: invalid size %d", e.line, e.Size)
+	}
+	if e.Mode&^07777 != 0 {
+		return errors.Errorf("manifest line %d: invalid mode %o", e.line, e.Mode)
+	}
+	return nil
+}
+
+// layout returns the layout of the imported file, or nil to use the
+// default layout.
+func (e *Entry) layout() *llapi.DataLayout {
+	if e.StripeCount == 0 && e.StripeSize == 0 && e.Pool == "" {
+		return nil
+	}
+	layout := llapi.DefaultDataLayout()
+	if e.StripeCount != 0 {
+		layout.StripeCount = e.StripeCount
+	}
+	if e.StripeSize != 0 {
+		layout.StripeSize = e.StripeSize
+	}
+	layout.PoolName = e.Pool
+	return layout
+}
+
+func (e *Entry) fileInfo() os.FileInfo {
+	fi := &entryInfo{e: e}
+	fi.st.Uid = e.Uid
+	fi.st.Gid = e.Gid
+	fi.st.Mode = syscall.S_IFREG | e.Mode
+	fi.st.Size = e.Size
+	fi.st.Atim = timespec(e.Atime)
+	fi.st.Mtim = timespec(e.Mtime)
+	return fi
+}
+
+func timespec(t time.Time) syscall.Timespec {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return syscall.NsecToTimespec(t.UnixNano())
+}
+
+func (fi *entryInfo) Name() string       { return filepath.Base(fi.e.Path) }
+func (fi *entryInfo) Size() int64        { return fi.e.Size }
+func (fi *entryInfo) Mode() os.FileMode  { return os.FileMode(fi.e.Mode) }
+func (fi *entryInfo) ModTime() time.Time { return fi.e.Mtime }
+func (fi *entryInfo) IsDir() bool        { return false }
+func (fi *entryInfo) Sys() interface{}   { return &fi.st }
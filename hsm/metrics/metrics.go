@@ -0,0 +1,207 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package metrics collects statistics about the actions processed by an
+// hsm.Copytool, and exports them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre/hsm"
+)
+
+type (
+	// Collector is an hsm.ActionObserver that records counters and
+	// histograms for each action type and archive ID.
+	Collector struct {
+		registry gometrics.Registry
+	}
+
+	family struct {
+		name string
+		typ  string
+		help string
+	}
+)
+
+const (
+	queued    = "hsm_actions_queued"
+	inFlight  = "hsm_actions_in_flight"
+	completed = "hsm_actions_total"
+	failed    = "hsm_action_errors_total"
+	copied    = "hsm_action_bytes_total"
+	duration  = "hsm_action_duration_seconds"
+	queueWait = "hsm_action_queue_wait_seconds"
+
+	// Histogram sums are kept in microseconds, as go-metrics counters
+	// are integers.
+	histogramScale = float64(time.Second / time.Microsecond)
+)
+
+var (
+	families = []family{
+		{queued, "gauge", "Actions waiting for a worker."},
+		{inFlight, "gauge", "Actions being run."},
+		{completed, "counter", "Actions ended, including failures."},
+		{failed, "counter", "Actions that failed, by errno."},
+		{copied, "counter", "Bytes copied by actions."},
+		{duration, "histogram", "Time taken to run actions."},
+		{queueWait, "histogram", "Time actions waited for a worker."},
+	}
+
+	// buckets are the upper bounds, in seconds, of the histogram
+	// buckets. They are fixed so the series can be aggregated across
+	// copytools and over time.
+	buckets = []float64{0.01, 0.1, 1, 10, 60, 300, 900, 3600, 14400}
+)
+
+// NewCollector returns a Collector that registers its metrics in r, so
+// they can also be reported with the go-metrics exporters. If r is nil
+// a new registry is used.
+func NewCollector(r gometrics.Registry) *Collector {
+	if r == nil {
+		r = gometrics.NewRegistry()
+	}
+	return &Collector{registry: r}
+}
+
+// Registry returns the registry holding the metrics.
+func (c *Collector) Registry() gometrics.Registry {
+	return c.registry
+}
+
+func labels(ar hsm.ActionRequest, extra ...string) string {
+	l := fmt.Sprintf(`{action=%q,archive_id="%d"`, strings.ToLower(ar.Action().String()), ar.ArchiveID())
+	for i := 0; i+1 < len(extra); i += 2 {
+		l += fmt.Sprintf(`,%s=%q`, extra[i], extra[i+1])
+	}
+	return l + "}"
+}
+
+func (c *Collector) counter(name string) gometrics.Counter {
+	return c.registry.GetOrRegister(name, gometrics.NewCounter).(gometrics.Counter)
+}
+
+// bucketLabels returns the labels of the histogram bucket with the
+// upper bound le.
+func bucketLabels(l, le string) string {
+	return fmt.Sprintf(`%s,le=%q}`, l[:len(l)-1], le)
+}
+
+// observe records d in the histogram, which is kept as a counter for
+// each bucket along with the sum and count of the observations.
+func (c *Collector) observe(fam, l string, d time.Duration) {
+	for _, b := range buckets {
+		if d.Seconds() <= b {
+			c.counter(fam + "_bucket" + bucketLabels(l, formatFloat(b))).Inc(1)
+		}
+	}
+	c.counter(fam + "_sum" + l).Inc(int64(d / time.Microsecond))
+	c.counter(fam + "_count" + l).Inc(1)
+}
+
+// ActionQueued implements hsm.ActionObserver.
+func (c *Collector) ActionQueued(ar hsm.ActionRequest) {
+	c.counter(queued + labels(ar)).Inc(1)
+}
+
+// ActionStarted implements hsm.ActionObserver.
+func (c *Collector) ActionStarted(ar hsm.ActionRequest, wait time.Duration) {
+	l := labels(ar)
+	c.counter(queued + l).Dec(1)
+	c.counter(inFlight + l).Inc(1)
+	c.observe(queueWait, l, wait)
+}
+
+// ActionFinished implements hsm.ActionObserver.
+func (c *Collector) ActionFinished(ar hsm.ActionRequest, res *hsm.ActionResult) {
+	l := labels(ar)
+	c.counter(inFlight + l).Dec(1)
+	c.counter(completed + l).Inc(1)
+	c.counter(copied + l).Inc(res.Bytes)
+	c.observe(duration, l, res.Duration)
+	if res.Errval != 0 {
+		c.counter(failed + labels(ar, "errno", errnoName(res.Errval))).Inc(1)
+	}
+}
+
+func errnoName(errval int) string {
+	if name := unix.ErrnoName(syscall.Errno(errval)); name != "" {
+		return name
+	}
+	return strconv.Itoa(errval)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text format.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	series := make(map[string][]string)
+	c.registry.Each(func(name string, _ interface{}) {
+		if i := strings.IndexByte(name, '{'); i > 0 {
+			series[name[:i]] = append(series[name[:i]], name[i:])
+		}
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		histogram := f.typ == "histogram"
+		ls := series[f.name]
+		if histogram {
+			ls = series[f.name+"_count"]
+		}
+		if len(ls) == 0 {
+			continue
+		}
+		sort.Strings(ls)
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, l := range ls {
+			if histogram {
+				c.writeHistogram(bw, f.name, l)
+			} else {
+				fmt.Fprintf(bw, "%s%s %d\n", f.name, l, c.count(f.name+l))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// count returns the value of a counter, or 0 if it hasn't been used.
+func (c *Collector) count(name string) int64 {
+	if m, ok := c.registry.Get(name).(gometrics.Counter); ok {
+		return m.Count()
+	}
+	return 0
+}
+
+func (c *Collector) writeHistogram(w io.Writer, name, l string) {
+	for _, b := range buckets {
+		le := bucketLabels(l, formatFloat(b))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, le, c.count(name+"_bucket"+le))
+	}
+	count := c.count(name + "_count" + l)
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(l, "+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, l, formatFloat(float64(c.count(name+"_sum"+l))/histogramScale))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, l, count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics for a Prometheus scrape.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WritePrometheus(w)
+}
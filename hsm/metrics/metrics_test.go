@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(nil)
+	fid := &lustre.Fid{Seq: 1, Oid: 2}
+
+	archive := hsm.NewTestRequest(1, hsm.ARCHIVE, fid, nil)
+	c.ActionQueued(archive)
+	c.ActionStarted(archive, 2*time.Second)
+	c.ActionFinished(archive, &hsm.ActionResult{Bytes: 100, Duration: 3 * time.Second})
+
+	restore := hsm.NewTestRequest(2, hsm.RESTORE, fid, nil)
+	c.ActionQueued(restore)
+	c.ActionStarted(restore, 0)
+	c.ActionFinished(restore, &hsm.ActionResult{Errval: int(syscall.EIO), Duration: time.Second})
+
+	// A restore that is still running.
+	c.ActionQueued(restore)
+	c.ActionStarted(restore, 0)
+
+	var buf bytes.Buffer
+	if err := c.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"# TYPE hsm_actions_total counter\n",
+		`hsm_actions_total{action="archive",archive_id="1"} 1` + "\n",
+		`hsm_actions_total{action="restore",archive_id="2"} 1` + "\n",
+		`hsm_actions_in_flight{action="restore",archive_id="2"} 1` + "\n",
+		`hsm_actions_queued{action="archive",archive_id="1"} 0` + "\n",
+		`hsm_action_bytes_total{action="archive",archive_id="1"} 100` + "\n",
+		`hsm_action_errors_total{action="restore",archive_id="2",errno="EIO"} 1` + "\n",
+		"# TYPE hsm_action_duration_seconds histogram\n",
+		`hsm_action_duration_seconds_bucket{action="archive",archive_id="1",le="0.01"} 0` + "\n",
+		`hsm_action_duration_seconds_bucket{action="archive",archive_id="1",le="1"} 0` + "\n",
+		`hsm_action_duration_seconds_bucket{action="archive",archive_id="1",le="10"} 1` + "\n",
+		`hsm_action_duration_seconds_bucket{action="archive",archive_id="1",le="14400"} 1` + "\n",
+		`hsm_action_duration_seconds_bucket{action="archive",archive_id="1",le="+Inf"} 1` + "\n",
+		`hsm_action_duration_seconds_sum{action="archive",archive_id="1"} 3` + "\n",
+		`hsm_action_duration_seconds_count{action="archive",archive_id="1"} 1` + "\n",
+		`hsm_action_duration_seconds_bucket{action="restore",archive_id="2",le="1"} 1` + "\n",
+		`hsm_action_queue_wait_seconds_bucket{action="archive",archive_id="1",le="1"} 0` + "\n",
+		`hsm_action_queue_wait_seconds_bucket{action="archive",archive_id="1",le="10"} 1` + "\n",
+		`hsm_action_queue_wait_seconds_bucket{action="restore",archive_id="2",le="0.01"} 2` + "\n",
+		`hsm_action_queue_wait_seconds_sum{action="archive",archive_id="1"} 2` + "\n",
+		`hsm_action_queue_wait_seconds_count{action="restore",archive_id="2"} 2` + "\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("missing %q in output:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{
+		"# TYPE hsm_action_duration_seconds_sum",
+		"# TYPE hsm_action_duration_seconds_bucket",
+		"quantile=",
+	} {
+		if strings.Contains(out, unexpected) {
+			t.Fatalf("unexpected %q in output:\n%s", unexpected, out)
+		}
+	}
+}
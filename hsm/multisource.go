@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const defaultMultiSourceRetry = 30 * time.Second
+
+// MultiActionSource merges the actions of a source for each of several
+// filesystems.
+type MultiActionSource struct {
+	roots   []fs.RootDir
+	retry   time.Duration
+	actions chan ActionRequest
+
+	mu    sync.Mutex
+	stops map[fs.RootDir]context.CancelFunc
+
+	// newSource returns the source for a filesystem.
+	newSource func(root fs.RootDir) ActionSource
+}
+
+// NewMultiActionSource returns an ActionSource that registers with the
+// coordinator of each filesystem and merges their actions. Each action
+// is tagged with its filesystem, see ActionRequest.FsName. The options
+// apply to the source of each filesystem.
+//
+// The filesystems are handled independently. If one can't be
+// registered with, or its source shuts down because of an error, it is
+// retried in the background while actions from the others continue.
+// Each filesystem can be stopped on its own with Stop.
+func NewMultiActionSource(roots []fs.RootDir, options ...ActionSourceOption) *MultiActionSource {
+	return &MultiActionSource{
+		roots:   roots,
+		retry:   defaultMultiSourceRetry,
+		actions: make(chan ActionRequest),
+		newSource: func(root fs.RootDir) ActionSource {
+			return NewActionSource(root, options...)
+		},
+	}
+}
+
+// Actions returns the merged channel of actions, which is closed once
+// the source for every filesystem has shut down or been stopped.
+func (ms *MultiActionSource) Actions() <-chan ActionRequest {
+	return ms.actions
+}
+
+// Err always returns nil, as the errors of each filesystem are
+// reported and retried rather than shutting down the source.
+func (ms *MultiActionSource) Err() error {
+	return nil
+}
+
+// Start starts a source for each filesystem. It fails only if none of
+// them could be started; the others are retried in the background.
+// Canceling ctx stops every filesystem.
+func (ms *MultiActionSource) Start(ctx context.Context) error {
+	if len(ms.roots) == 0 {
+		return errors.New("no filesystems")
+	}
+
+	ctxs := make([]context.Context, len(ms.roots))
+	cancels := make([]context.CancelFunc, len(ms.roots))
+	sources := make([]ActionSource, len(ms.roots))
+	var lastErr error
+	for i, root := range ms.roots {
+		ctxs[i], cancels[i] = context.WithCancel(ctx)
+		src := ms.newSource(root)
+		if err := src.Start(ctxs[i]); err != nil {
+			alert.Warnf("%s: %v", root, err)
+			lastErr = err
+			continue
+		}
+		sources[i] = src
+	}
+	if lastErr != nil && !anyStarted(sources) {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		return errors.Wrap(lastErr, "no filesystem registered")
+	}
+
+	ms.mu.Lock()
+	ms.stops = make(map[fs.RootDir]context.CancelFunc)
+	for i, root := range ms.roots {
+		ms.stops[root] = cancels[i]
+	}
+	ms.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i, root := range ms.roots {
+		wg.Add(1)
+		go func(ctx context.Context, root fs.RootDir, src ActionSource) {
+			defer wg.Done()
+			ms.run(ctx, root, src)
+		}(ctxs[i], root, sources[i])
+	}
+	go func() {
+		wg.Wait()
+		close(ms.actions)
+	}()
+	return nil
+}
+
+// Stop stops the source of a filesystem, unregistering from its
+// coordinator, while the others continue. The actions channel is closed
+// once every filesystem has been stopped.
+func (ms *MultiActionSource) Stop(root fs.RootDir) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	cancel, ok := ms.stops[root]
+	if !ok {
+		return errors.Errorf("%s: not started", root)
+	}
+	cancel()
+	delete(ms.stops, root)
+	return nil
+}
+
+func anyStarted(sources []ActionSource) bool {
+	for _, src := range sources {
+		if src != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// run forwards the actions of a filesystem's source, and starts a new
+// source whenever it shuts down until ctx is canceled or the filesystem
+// is stopped. A nil src is started after the retry interval.
+func (ms *MultiActionSource) run(ctx context.Context, root fs.RootDir, src ActionSource) {
+	for {
+		if src != nil {
+			for ar := range src.Actions() {
+				ms.actions <- ar
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			alert.Warnf("%s: action source stopped: %v", root, src.Err())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ms.retry):
+		}
+
+		debug.Printf("%s: restarting action source", root)
+		src = ms.newSource(root)
+		if err := src.Start(ctx); err != nil {
+			alert.Warnf("%s: %v", root, err)
+			src = nil
+		}
+	}
+}
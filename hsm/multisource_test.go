@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+)
+
+// unavailableSource is a source for a filesystem that is down.
+type unavailableSource struct {
+	*TestSource
+}
+
+func (s unavailableSource) Start(ctx context.Context) error {
+	return errors.New("coordinator unavailable")
+}
+
+func TestMultiActionSource(t *testing.T) {
+	var mu sync.Mutex
+	started := make(chan *TestSource, 4)
+	calls := 0
+	fs1, fs2 := fs.RootDir(fs.TestID("/mnt/fs1")), fs.RootDir(fs.TestID("/mnt/fs2"))
+	ms := NewMultiActionSource([]fs.RootDir{fs1, fs2})
+	ms.retry = 10 * time.Millisecond
+	ms.newSource = func(root fs.RootDir) ActionSource {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		src := NewTestSource()
+		// The second filesystem is down when the source starts.
+		if calls == 2 {
+			return unavailableSource{src}
+		}
+		started <- src
+		return src
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := ms.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first, second := <-started, <-started
+
+	expect := func(src *TestSource, fsName string) {
+		req := NewTestRequest(1, ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+		req.SetFsName(fsName)
+		go src.Inject(req)
+		select {
+		case ar := <-ms.Actions():
+			if ar.FsName() != fsName {
+				t.Fatalf("got action for %q, expected %q", ar.FsName(), fsName)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no action received from %s", fsName)
+		}
+	}
+	expect(first, "fs1")
+	expect(second, "fs2")
+
+	// A source that fails is restarted without affecting the other.
+	first.Fail(errors.New("connection lost"))
+	expect(second, "fs2")
+	restarted := <-started
+	expect(restarted, "fs1")
+
+	// A stopped filesystem is not restarted, and the other continues.
+	if err := ms.Stop(fs1); err != nil {
+		t.Fatal(err)
+	}
+	expect(second, "fs2")
+	time.Sleep(5 * ms.retry)
+	expect(second, "fs2")
+	select {
+	case <-started:
+		t.Fatal("stopped filesystem was restarted")
+	default:
+	}
+	if err := ms.Stop(fs1); err == nil {
+		t.Fatal("expected error stopping a filesystem twice")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ms.Actions():
+		if ok {
+			t.Fatal("unexpected action after shutdown")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("actions channel not closed after shutdown")
+	}
+
+	all := NewMultiActionSource([]fs.RootDir{{}})
+	all.newSource = func(root fs.RootDir) ActionSource {
+		return unavailableSource{NewTestSource()}
+	}
+	if err := all.Start(context.Background()); err == nil {
+		t.Fatal("expected error when no filesystem is available")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package policy selects files for HSM actions according to a set of
+// rules, and submits the resulting requests to the coordinator.
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type (
+	// Config is a list of rules. Rules are evaluated in order, and
+	// the first rule that matches a file and applies to its current
+	// HSM state determines the action for the file.
+	//
+	// Configs are written in YAML. As JSON is a subset of YAML, JSON
+	// configs can also be loaded.
+	Config struct {
+		Rules []*Rule `yaml:"rules" json:"rules"`
+	}
+
+	// Rule matches files and names the HSM action to take for them.
+	// All of the conditions that are set must match.
+	Rule struct {
+		Name      string `yaml:"name" json:"name"`
+		Action    string `yaml:"action" json:"action"`
+		ArchiveID uint   `yaml:"archive_id" json:"archive_id"`
+
+		// Minimum time since the file was last accessed or
+		// modified.
+		AtimeOlderThan Duration `yaml:"atime_older_than" json:"atime_older_than"`
+		MtimeOlderThan Duration `yaml:"mtime_older_than" json:"mtime_older_than"`
+
+		// File size limits. A zero MaxSize is unlimited.
+		MinSize Size `yaml:"min_size" json:"min_size"`
+		MaxSize Size `yaml:"max_size" json:"max_size"`
+
+		// Shell patterns matched against the path relative to the
+		// filesystem root.
+		Paths []string `yaml:"paths" json:"paths"`
+
+		// OST pools, owner UIDs and project IDs, any of which may
+		// match.
+		Pools    []string `yaml:"pools" json:"pools"`
+		Owners   []uint32 `yaml:"owners" json:"owners"`
+		Projects []uint32 `yaml:"projects" json:"projects"`
+
+		// HSM state flags that must be set, such as "archived".
+		// Flags prefixed with "!" must not be set.
+		Status []string `yaml:"status" json:"status"`
+	}
+
+	// Duration is a time.Duration that is configured as a string
+	// such as "12h". A "d" suffix is accepted for days.
+	Duration time.Duration
+
+	// Size is a file size in bytes that may be configured with a K,
+	// M, G or T suffix.
+	Size int64
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %q", s)
+		}
+		*d = Duration(days * float64(24*time.Hour))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var sizeSuffixes = map[string]int64{
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	str = strings.ToUpper(strings.TrimSpace(str))
+	mult := int64(1)
+	if len(str) > 0 {
+		if m, ok := sizeSuffixes[str[len(str)-1:]]; ok {
+			mult = m
+			str = str[:len(str)-1]
+		}
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size: %q", str)
+	}
+	*s = Size(v * mult)
+	return nil
+}
+
+// ParseConfig parses a YAML or JSON config.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrap(err, "parse policy config")
+	}
+	return &cfg, nil
+}
+
+// LoadConfig reads a YAML or JSON config from a file.
+func LoadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/luser"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// EngineOption is a configuration option for an Engine.
+	EngineOption func(*Engine)
+
+	// Engine evaluates candidate files against the rules in a Config,
+	// and submits HSM requests for the files selected.
+	Engine struct {
+		root         fs.RootDir
+		rules        []*Rule
+		batchSize    int
+		dryRun       io.Writer
+		needPool     bool
+		needProject  bool
+		pending      map[batchKey]*batch
+		pendingCount int
+		now          func() time.Time
+
+		// Hooks to replace the Lustre calls in tests.
+		getStatus  func(path string) (*hsm.FileStatus, error)
+		getPool    func(path string) (string, error)
+		getProject func(path string) (uint32, error)
+		lookupFid  func(path string) (*lustre.Fid, error)
+		submit     func(action llapi.HsmUserAction, archiveID uint, fids []*lustre.Fid) error
+	}
+
+	batchKey struct {
+		action    llapi.HsmUserAction
+		archiveID uint
+	}
+
+	batch struct {
+		fids  []*lustre.Fid
+		paths []string
+		seen  map[lustre.Fid]bool
+	}
+)
+
+const defaultBatchSize = 1000
+
+// OptEngineDryRun causes the actions that would be submitted to be
+// written to w instead.
+func OptEngineDryRun(w io.Writer) EngineOption {
+	return func(e *Engine) {
+		e.dryRun = w
+	}
+}
+
+// OptEngineBatchSize sets the number of files queued before the
+// pending requests are submitted.
+func OptEngineBatchSize(size int) EngineOption {
+	return func(e *Engine) {
+		e.batchSize = size
+	}
+}
+
+// NewEngine returns an Engine for the filesystem in root.
+func NewEngine(root fs.RootDir, cfg *Config, options ...EngineOption) (*Engine, error) {
+	e := &Engine{
+		root:      root,
+		rules:     cfg.Rules,
+		batchSize: defaultBatchSize,
+		pending:   make(map[batchKey]*batch),
+		now:       time.Now,
+	}
+	e.getStatus = func(p string) (*hsm.FileStatus, error) {
+		return hsm.GetFileStatus(root.Join(p))
+	}
+	e.getPool = func(p string) (string, error) {
+		layout, err := llapi.FileDataLayout(root.Join(p))
+		if err != nil {
+			return "", err
+		}
+		return layout.PoolName, nil
+	}
+	e.getProject = func(p string) (uint32, error) {
+		return luser.GetProjectID(root.Join(p))
+	}
+	e.lookupFid = func(p string) (*lustre.Fid, error) {
+		return fs.LookupFid(root.Join(p))
+	}
+	e.submit = func(action llapi.HsmUserAction, archiveID uint, fids []*lustre.Fid) error {
+		r := hsm.NewRequest(action)
+		for _, f := range fids {
+			r.AddFile(f, archiveID)
+		}
+		_, err := r.Submit(root)
+		return err
+	}
+
+	for _, option := range options {
+		option(e)
+	}
+
+	if len(e.rules) == 0 {
+		return nil, errors.New("policy has no rules")
+	}
+	for _, r := range e.rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		e.needPool = e.needPool || r.needsPool()
+		e.needProject = e.needProject || r.needsProject()
+	}
+	return e, nil
+}
+
+// load fills in the fields of the candidate needed by the rules.
+func (e *Engine) load(c *Candidate) error {
+	var err error
+	if c.Fid == nil {
+		if c.Fid, err = e.lookupFid(c.Path); err != nil {
+			return err
+		}
+	}
+	if c.Status == nil {
+		if c.Status, err = e.getStatus(c.Path); err != nil {
+			return err
+		}
+	}
+	if e.needPool {
+		if c.Pool, err = e.getPool(c.Path); err != nil {
+			return err
+		}
+	}
+	if e.needProject {
+		if c.ProjectID, err = e.getProject(c.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluate returns the first rule that matches the candidate and
+// applies to its current HSM state, or nil if there is none.
+func (e *Engine) Evaluate(c *Candidate) (*Rule, error) {
+	if err := e.load(c); err != nil {
+		return nil, err
+	}
+	now := e.now()
+	for _, r := range e.rules {
+		if r.matches(c, now) && r.applies(c.Status) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// Process evaluates the candidate and queues the action selected for
+// it. The pending requests are submitted when the batch size is reached.
+func (e *Engine) Process(c *Candidate) error {
+	if err := e.queue(c); err != nil {
+		return err
+	}
+	return e.flushFull()
+}
+
+// queue evaluates the candidate and adds it to the pending batch for
+// the action selected.
+func (e *Engine) queue(c *Candidate) error {
+	r, err := e.Evaluate(c)
+	if err != nil || r == nil {
+		return err
+	}
+
+	key := batchKey{action: r.action(), archiveID: r.ArchiveID}
+	b, ok := e.pending[key]
+	if !ok {
+		b = &batch{seen: make(map[lustre.Fid]bool)}
+		e.pending[key] = b
+	}
+	if b.seen[*c.Fid] {
+		return nil
+	}
+	b.seen[*c.Fid] = true
+	b.fids = append(b.fids, c.Fid)
+	b.paths = append(b.paths, c.Path)
+	e.pendingCount++
+	return nil
+}
+
+// flushFull submits the pending requests if the batch size is reached.
+func (e *Engine) flushFull() error {
+	if e.pendingCount >= e.batchSize {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Flush submits all pending requests. A request that fails to submit
+// is left pending, so it is retried by the next Flush.
+func (e *Engine) Flush() error {
+	for key, b := range e.pending {
+		if e.dryRun != nil {
+			for i, f := range b.fids {
+				fmt.Fprintf(e.dryRun, "%s %d %s %s\n", key.action, key.archiveID, f, b.paths[i])
+			}
+		} else {
+			debug.Printf("policy: submitting %s for %d files", key.action, len(b.fids))
+			if err := e.submit(key.action, key.archiveID, b.fids); err != nil {
+				return errors.Wrapf(err, "submit %s request", key.action)
+			}
+		}
+		delete(e.pending, key)
+		e.pendingCount -= len(b.fids)
+	}
+	return nil
+}
+
+// Scan walks the filesystem tree below dir, which is relative to the
+// root, and processes every regular file. Files that can't be evaluated
+// are skipped, but the scan stops if a request fails to submit.
+func (e *Engine) Scan(ctx context.Context, dir string) error {
+	err := filepath.Walk(e.root.Join(dir), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			debug.Printf("policy: scan %s: %v", p, err)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fi.IsDir() && p == e.root.Join(".lustre") {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(e.root.Path(), p)
+		if err != nil {
+			return err
+		}
+		if err := e.queue(&Candidate{Path: rel, Info: fi}); err != nil {
+			debug.Printf("policy: %s: %v", rel, err)
+		}
+		return e.flushFull()
+	})
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// candidateRecord returns true if the record may change whether a
+// rule matches the file.
+func candidateRecord(rec changelog.Record) bool {
+	switch rec.TypeCode() {
+	case llapi.OpCreate, llapi.OpHardlink, llapi.OpRename, llapi.OpClose,
+		llapi.OpTrunc, llapi.OpSetattr, llapi.OpMtime, llapi.OpHSM, llapi.OpLayout:
+		return true
+	}
+	return false
+}
+
+// ProcessChangelog processes the files referred to by changelog records
+// until the records are exhausted or ctx is done. The namespace is used
+// to find the path and attributes of each file. It stops if a request
+// fails to submit.
+func (e *Engine) ProcessChangelog(ctx context.Context, records changelog.RecordIterator, ns fs.Namespace) error {
+	for ctx.Err() == nil {
+		rec, err := records.NextRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !candidateRecord(rec) {
+			continue
+		}
+
+		fid := rec.TargetFid()
+		p, err := ns.FidPathname(fid, 0)
+		if err != nil {
+			// The file has since been removed.
+			continue
+		}
+		fi, err := ns.StatFid(fid)
+		if err != nil {
+			continue
+		}
+		f := *fid
+		if err := e.queue(&Candidate{Path: p, Fid: &f, Info: fi}); err != nil {
+			debug.Printf("policy: %s: %v", p, err)
+		}
+		if err := e.flushFull(); err != nil {
+			return err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
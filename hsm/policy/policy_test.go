@@ -0,0 +1,271 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog/simulator"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type testFileInfo struct {
+	size  int64
+	mtime time.Time
+	atime time.Time
+	uid   uint32
+}
+
+func (fi *testFileInfo) Name() string       { return "test" }
+func (fi *testFileInfo) Size() int64        { return fi.size }
+func (fi *testFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *testFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *testFileInfo) IsDir() bool        { return false }
+func (fi *testFileInfo) Sys() interface{} {
+	return &syscall.Stat_t{
+		Uid:  fi.uid,
+		Atim: syscall.NsecToTimespec(fi.atime.UnixNano()),
+	}
+}
+
+const testConfig = `
+rules:
+  - name: release-old
+    action: release
+    atime_older_than: 30d
+    status: [archived, "!dirty"]
+  - name: archive-results
+    action: archive
+    archive_id: 2
+    paths: ["results/*"]
+    pools: [fast]
+    min_size: 1M
+    owners: [500]
+  - action: archive
+    archive_id: 1
+    mtime_older_than: 1h
+    projects: [7]
+`
+
+func testEngine(t *testing.T, cfg string, states map[string]llapi.HsmStateFlag, options ...EngineOption) *Engine {
+	c, err := ParseConfig([]byte(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEngine(fs.RootDir{}, c, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.getStatus = func(p string) (*hsm.FileStatus, error) {
+		return hsm.NewFileStatus(llapi.HsmFileState(states[p]), 1), nil
+	}
+	e.getPool = func(p string) (string, error) {
+		if strings.HasPrefix(p, "results/") {
+			return "fast", nil
+		}
+		return "", nil
+	}
+	e.getProject = func(p string) (uint32, error) {
+		return 7, nil
+	}
+	e.lookupFid = func(p string) (*lustre.Fid, error) {
+		return &lustre.Fid{Seq: 1, Oid: uint32(len(p))}, nil
+	}
+	return e
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules) != 3 {
+		t.Fatalf("got %d rules, expected 3", len(cfg.Rules))
+	}
+	if time.Duration(cfg.Rules[0].AtimeOlderThan) != 30*24*time.Hour {
+		t.Fatalf("unexpected atime_older_than %v", time.Duration(cfg.Rules[0].AtimeOlderThan))
+	}
+	if cfg.Rules[1].MinSize != 1<<20 {
+		t.Fatalf("unexpected min_size %d", cfg.Rules[1].MinSize)
+	}
+
+	json := `{"rules": [{"action": "remove", "min_size": "10", "mtime_older_than": "2h"}]}`
+	cfg, err = ParseConfig([]byte(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Rules[0].Action != "remove" || cfg.Rules[0].MinSize != 10 ||
+		time.Duration(cfg.Rules[0].MtimeOlderThan) != 2*time.Hour {
+		t.Fatalf("unexpected rule from JSON: %+v", cfg.Rules[0])
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	var tests = []string{
+		`rules: [{action: migrate}]`,
+		`rules: [{action: archive, status: [frozen]}]`,
+		`rules: [{action: archive, paths: ["[a-"]}]`,
+		`rules: [{action: archive, min_size: 10M, max_size: 1M}]`,
+		`rules: []`,
+	}
+	for _, cfg := range tests {
+		c, err := ParseConfig([]byte(cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewEngine(fs.RootDir{}, c); err == nil {
+			t.Fatalf("%s: expected error", cfg)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	states := map[string]llapi.HsmStateFlag{
+		"old/archived": llapi.HsmFileExists | llapi.HsmFileArchived,
+		"old/dirty":    llapi.HsmFileExists | llapi.HsmFileArchived | llapi.HsmFileDirty,
+		"noarchive":    llapi.HsmFileNoArchive,
+	}
+	e := testEngine(t, testConfig, states)
+
+	var tests = []struct {
+		path     string
+		info     *testFileInfo
+		expected string
+	}{
+		{"old/archived", &testFileInfo{atime: now.Add(-60 * 24 * time.Hour), mtime: now}, "release-old"},
+		{"old/dirty", &testFileInfo{atime: now.Add(-60 * 24 * time.Hour), mtime: now}, ""},
+		{"results/big", &testFileInfo{size: 2 << 20, uid: 500, mtime: now}, "archive-results"},
+		{"results/small", &testFileInfo{size: 10, uid: 500, mtime: now}, ""},
+		{"results/other", &testFileInfo{size: 2 << 20, uid: 501, mtime: now}, ""},
+		{"results/old", &testFileInfo{size: 10, mtime: now.Add(-2 * time.Hour)}, "archive"},
+		{"noarchive", &testFileInfo{mtime: now.Add(-2 * time.Hour)}, ""},
+	}
+
+	for _, tc := range tests {
+		r, err := e.Evaluate(&Candidate{Path: tc.path, Info: tc.info})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name string
+		if r != nil {
+			name = r.String()
+		}
+		if name != tc.expected {
+			t.Fatalf("%s: matched %q, expected %q", tc.path, name, tc.expected)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var out bytes.Buffer
+	e := testEngine(t, `rules: [{action: archive, archive_id: 3}]`, nil, OptEngineDryRun(&out))
+	e.submit = func(llapi.HsmUserAction, uint, []*lustre.Fid) error {
+		t.Fatal("request submitted in dry run mode")
+		return nil
+	}
+
+	for _, p := range []string{"a", "bb", "a"} {
+		if err := e.Process(&Candidate{Path: p, Info: &testFileInfo{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 actions, got %q", out.String())
+	}
+}
+
+func TestProcessChangelog(t *testing.T) {
+	sim, err := simulator.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sim.AddJob(
+		simulator.OptJobID("job"),
+		simulator.OptJobMaxFileCount(10),
+		simulator.OptJobMaxFilesPerDirectory(100),
+		simulator.OptJobMinFileSize(4096),
+		simulator.OptJobMaxFileSize(4096),
+	); err != nil {
+		t.Fatal(err)
+	}
+	sim.Start()
+	defer sim.Stop()
+
+	e := testEngine(t, `rules: [{action: archive, archive_id: 1, paths: ["job/*/*"], min_size: 4K}]`, nil,
+		OptEngineBatchSize(4))
+	var submitted []*lustre.Fid
+	e.submit = func(action llapi.HsmUserAction, archiveID uint, fids []*lustre.Fid) error {
+		if action != llapi.HsmUserArchive || archiveID != 1 {
+			t.Fatalf("unexpected request %s %d", action, archiveID)
+		}
+		submitted = append(submitted, fids...)
+		return nil
+	}
+
+	if err := e.ProcessChangelog(context.Background(), sim.GetHandle(), sim.Namespace()); err != nil {
+		t.Fatal(err)
+	}
+	// The first entry in each simulated job is a directory.
+	if len(submitted) != 9 {
+		t.Fatalf("submitted %d files, expected 9", len(submitted))
+	}
+}
+
+func TestSubmitFailure(t *testing.T) {
+	cfg := `
+rules:
+  - {action: archive, archive_id: 1, paths: ["a*"]}
+  - {action: archive, archive_id: 2}
+`
+	e := testEngine(t, cfg, nil, OptEngineBatchSize(4))
+	fail := true
+	submitted := make(map[lustre.Fid]bool)
+	e.submit = func(action llapi.HsmUserAction, archiveID uint, fids []*lustre.Fid) error {
+		if fail {
+			return syscall.EAGAIN
+		}
+		for _, f := range fids {
+			submitted[*f] = true
+		}
+		return nil
+	}
+
+	var err error
+	for _, p := range []string{"a", "aa", "bbb", "bbbb"} {
+		if err = e.Process(&Candidate{Path: p, Info: &testFileInfo{}}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Fatal("expected submit error")
+	}
+
+	// Nothing is lost, and the requests are sent by the next flush.
+	fail = false
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 4 {
+		t.Fatalf("submitted %d files, expected 4", len(submitted))
+	}
+	if e.pendingCount != 0 {
+		t.Fatalf("%d files still pending", e.pendingCount)
+	}
+}
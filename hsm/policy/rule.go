@@ -0,0 +1,187 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+// Candidate is a file being considered by the policy engine.
+type Candidate struct {
+	// Path relative to the filesystem root.
+	Path   string
+	Fid    *lustre.Fid
+	Info   os.FileInfo
+	Status *hsm.FileStatus
+
+	// Pool and ProjectID are only loaded if a rule uses them.
+	Pool      string
+	ProjectID uint32
+}
+
+var ruleActions = map[string]llapi.HsmUserAction{
+	"archive": llapi.HsmUserArchive,
+	"release": llapi.HsmUserRelease,
+	"remove":  llapi.HsmUserRemove,
+}
+
+func (r *Rule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Action
+}
+
+// validate checks the rule for errors that can be found before it is
+// used.
+func (r *Rule) validate() error {
+	if _, ok := ruleActions[r.Action]; !ok {
+		return fmt.Errorf("rule %s: unknown action %q", r, r.Action)
+	}
+	for _, p := range r.Paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("rule %s: invalid path pattern %q", r, p)
+		}
+	}
+	valid := make(map[string]bool)
+	for _, name := range hsm.GetStateFlagNames() {
+		valid[name] = true
+	}
+	for _, s := range r.Status {
+		if !valid[strings.TrimPrefix(s, "!")] {
+			return fmt.Errorf("rule %s: unknown status flag %q", r, s)
+		}
+	}
+	if r.MaxSize > 0 && r.MaxSize < r.MinSize {
+		return fmt.Errorf("rule %s: max_size is less than min_size", r)
+	}
+	return nil
+}
+
+func (r *Rule) action() llapi.HsmUserAction {
+	return ruleActions[r.Action]
+}
+
+func (r *Rule) needsPool() bool {
+	return len(r.Pools) > 0
+}
+
+func (r *Rule) needsProject() bool {
+	return len(r.Projects) > 0
+}
+
+func atime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
+
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(status *hsm.FileStatus, name string) bool {
+	for _, f := range status.Flags() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if all of the rule's conditions match the file.
+func (r *Rule) matches(c *Candidate, now time.Time) bool {
+	fi := c.Info
+	if !fi.Mode().IsRegular() {
+		return false
+	}
+	if r.AtimeOlderThan > 0 && now.Sub(atime(fi)) < time.Duration(r.AtimeOlderThan) {
+		return false
+	}
+	if r.MtimeOlderThan > 0 && now.Sub(fi.ModTime()) < time.Duration(r.MtimeOlderThan) {
+		return false
+	}
+	if fi.Size() < int64(r.MinSize) {
+		return false
+	}
+	if r.MaxSize > 0 && fi.Size() > int64(r.MaxSize) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchPath(r.Paths, c.Path) {
+		return false
+	}
+	if len(r.Pools) > 0 && !containsString(r.Pools, c.Pool) {
+		return false
+	}
+	if len(r.Owners) > 0 {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || !containsUint32(r.Owners, st.Uid) {
+			return false
+		}
+	}
+	if len(r.Projects) > 0 && !containsUint32(r.Projects, c.ProjectID) {
+		return false
+	}
+	for _, s := range r.Status {
+		if strings.HasPrefix(s, "!") {
+			if hasFlag(c.Status, s[1:]) {
+				return false
+			}
+		} else if !hasFlag(c.Status, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// applies returns true if the rule's action makes sense for the file's
+// current HSM state, so that files that are already archived aren't
+// archived again, and so on.
+func (r *Rule) applies(status *hsm.FileStatus) bool {
+	switch r.action() {
+	case llapi.HsmUserArchive:
+		return !status.NoArchive() && !status.Released() &&
+			(!status.Archived() || status.Dirty())
+	case llapi.HsmUserRelease:
+		return status.Archived() && !status.Dirty() &&
+			!status.Released() && !status.NoRelease() && !status.Lost()
+	case llapi.HsmUserRemove:
+		return status.Exists() && !status.Released()
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint32(list []uint32, v uint32) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
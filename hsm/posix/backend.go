@@ -0,0 +1,324 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Backend is an hsm.Backend that archives files from a Lustre
+// filesystem into a Store.
+type Backend struct {
+	root  fs.RootDir
+	store *Store
+}
+
+// NewBackend returns a Backend that archives files from the filesystem
+// in root into the store.
+func NewBackend(root fs.RootDir, store *Store) *Backend {
+	return &Backend{root: root, store: store}
+}
+
+// actionFile returns the data file for an action as an *os.File. The
+// caller must close it before the action is ended.
+func actionFile(aih hsm.ActionHandle) (*os.File, error) {
+	fd, err := aih.Fd()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: get fd", aih)
+	}
+	return os.NewFile(uintptr(fd), aih.Fid().String()), nil
+}
+
+// Archive copies the file into the store along with its attributes,
+// user and trusted extended attributes, ACLs and layout.
+func (b *Backend) Archive(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	f, err := actionFile(aih)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	meta := newMetadata(fi)
+	meta.DataVersion, _ = hsm.DataVersionFromContext(ctx)
+
+	meta.Xattrs, err = readXattrs(int(f.Fd()))
+	if err != nil {
+		alert.Warnf("%s: unable to read xattrs: %v", aih, err)
+	}
+
+	meta.Layout, err = llapi.FileDataLayout(fs.FidPath(b.root, aih.Fid()))
+	if err != nil {
+		alert.Warnf("%s: unable to read layout: %v", aih, err)
+	}
+
+	meta.LovEA, err = aih.Layout()
+	if err != nil && !isNoXattr(err) {
+		return 0, errors.Wrapf(err, "%s: get layout", aih)
+	}
+
+	// Only the data segments are stored. The sparse map is set
+	// before the pipe is closed, so it is in place when Put writes
+	// the metadata.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sparse, _, err := hsm.ArchiveSparse(ctx, pw, f, aih)
+		meta.Sparse = sparse
+		pw.CloseWithError(err)
+	}()
+	n, err := b.store.Put(aih.Fid(), pr, meta)
+	pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return 0, err
+	}
+	debug.Printf("%s: archived %d of %d bytes to %s", aih, n, meta.FileSize(), b.store.DataPath(aih.Fid()))
+	return n, nil
+}
+
+// Restore copies the archived data back into the file, recreating any
+// holes, and reapplies the archived extended attributes and ACLs. The
+// checksum is verified when the whole file is restored. The restored
+// data is in new objects, so the data version in the metadata is
+// updated to match the restored file.
+func (b *Backend) Restore(ctx context.Context, aih hsm.ActionHandle) (int64, error) {
+	f, err := actionFile(aih)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	meta, err := b.store.Metadata(aih.Fid())
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if meta.Sparse == nil {
+		_, n, err = b.store.Get(aih.Fid(), hsm.NewProgressWriter(ctx, f, aih))
+	} else {
+		n, err = b.restoreSparse(ctx, f, meta, aih)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Only the layout of the data file is swapped into the file when
+	// the restore ends, so the xattrs are set on the file itself.
+	if err := writeXattrs(fs.FidPath(b.root, aih.Fid()), meta.Xattrs); err != nil {
+		return 0, errors.Wrapf(err, "%s: restore xattrs", aih)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	b.updateDataVersion(aih, meta)
+	debug.Printf("%s: restored %d bytes from %s", aih, n, b.store.DataPath(aih.Fid()))
+	return n, nil
+}
+
+// updateDataVersion records the data version of the restored data file,
+// which the file has once the restore completes. If it can't be read,
+// the data version is cleared, so the copy isn't reported as stale.
+func (b *Backend) updateDataVersion(aih hsm.ActionHandle, meta *Metadata) {
+	dv, err := aih.DataVersion(llapi.DataVersionReadFlush)
+	if err != nil {
+		alert.Warnf("%s: unable to read restored data version: %v", aih, err)
+		dv = 0
+	}
+	if dv == meta.DataVersion {
+		return
+	}
+	meta.DataVersion = dv
+	if err := b.store.putMetadata(aih.Fid(), meta); err != nil {
+		alert.Warnf("%s: unable to update data version: %v", aih, err)
+	}
+}
+
+func (b *Backend) restoreSparse(ctx context.Context, f *os.File, meta *Metadata, aih hsm.ActionHandle) (int64, error) {
+	data, err := b.store.OpenData(aih.Fid())
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+
+	r := newChecksumReaderAt(data)
+	n, err := hsm.RestoreSparse(ctx, f, r, meta.Sparse, aih)
+	if err != nil {
+		return n, err
+	}
+	if sum, ok := r.sum(meta.Size); ok && sum != meta.Checksum {
+		return n, &ChecksumError{Fid: aih.Fid(), Expected: meta.Checksum, Actual: sum}
+	}
+	return n, nil
+}
+
+// checksumReaderAt computes the checksum of the data read, as long as
+// it is read sequentially from the start.
+type checksumReaderAt struct {
+	r    io.ReaderAt
+	h    hash.Hash
+	next int64
+	ok   bool
+}
+
+func newChecksumReaderAt(r io.ReaderAt) *checksumReaderAt {
+	return &checksumReaderAt{r: r, h: sha256.New(), ok: true}
+}
+
+func (c *checksumReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(b, off)
+	if off != c.next {
+		c.ok = false
+	}
+	if c.ok {
+		c.h.Write(b[:n])
+		c.next += int64(n)
+	}
+	return n, err
+}
+
+// sum returns the checksum if all size bytes were read in order.
+func (c *checksumReaderAt) sum(size int64) (string, bool) {
+	if !c.ok || c.next != size {
+		return "", false
+	}
+	return hex.EncodeToString(c.h.Sum(nil)), true
+}
+
+// Layout returns the layout the file had when it was archived, so the
+// Copytool can apply it to the restored file. It implements
+// hsm.LayoutBackend.
+func (b *Backend) Layout(ctx context.Context, aih hsm.ActionHandle) ([]byte, error) {
+	meta, err := b.store.Metadata(aih.Fid())
+	if err != nil {
+		return nil, err
+	}
+	return meta.LovEA, nil
+}
+
+// Remove deletes the archived copy of the file.
+func (b *Backend) Remove(ctx context.Context, aih hsm.ActionHandle) error {
+	return b.store.Remove(aih.Fid())
+}
+
+// RemoveFid deletes the archived copy of a file which no longer exists
+// in the filesystem. It implements gc.Remover.
+func (b *Backend) RemoveFid(ctx context.Context, fid *lustre.Fid) error {
+	return b.store.Remove(fid)
+}
+
+func newMetadata(fi os.FileInfo) *Metadata {
+	meta := &Metadata{
+		Mode:  fi.Mode(),
+		Mtime: fi.ModTime(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		meta.Uid = st.Uid
+		meta.Gid = st.Gid
+		meta.Atime = time.Unix(st.Atim.Unix())
+		meta.Ctime = time.Unix(st.Ctim.Unix())
+	}
+	return meta
+}
+
+// lustreXattrs are trusted xattrs that belong to Lustre itself and are
+// recreated by the filesystem, so they are not preserved.
+var lustreXattrs = map[string]bool{
+	"trusted.dmv":     true,
+	"trusted.fid":     true,
+	"trusted.hsm":     true,
+	"trusted.link":    true,
+	"trusted.lma":     true,
+	"trusted.lmv":     true,
+	"trusted.lov":     true,
+	"trusted.som":     true,
+	"trusted.version": true,
+}
+
+// preserveXattr returns true if the extended attribute is archived with
+// the file: user and trusted attributes, and POSIX ACLs.
+func preserveXattr(name string) bool {
+	switch {
+	case name == "system.posix_acl_access", name == "system.posix_acl_default":
+		return true
+	case strings.HasPrefix(name, "user."):
+		return true
+	case strings.HasPrefix(name, "trusted."):
+		return !lustreXattrs[name]
+	}
+	return false
+}
+
+func isNoXattr(err error) bool {
+	err = errors.Cause(err)
+	return err == syscall.ENODATA || err == syscall.ENOTSUP
+}
+
+// readXattrs returns the extended attributes of the open file which are
+// preserved in the archive.
+func readXattrs(fd int) (map[string][]byte, error) {
+	sz, err := xattr.Flistxattr(fd, nil)
+	if err != nil || sz == 0 {
+		return nil, err
+	}
+	buf := make([]byte, sz)
+	sz, err = xattr.Flistxattr(fd, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 || !preserveXattr(string(name)) {
+			continue
+		}
+		vsz, err := xattr.Fgetxattr(fd, string(name), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getxattr %s", name)
+		}
+		value := make([]byte, vsz)
+		vsz, err = xattr.Fgetxattr(fd, string(name), value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getxattr %s", name)
+		}
+		attrs[string(name)] = value[:vsz]
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the archived extended attributes on the file.
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if !preserveXattr(name) {
+			continue
+		}
+		if err := xattr.Lsetxattr(path, name, value, 0); err != nil {
+			return errors.Wrapf(err, "setxattr %s", name)
+		}
+	}
+	return nil
+}
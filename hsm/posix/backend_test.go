@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/hsm/posix"
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
+)
+
+func TestBackendArchiveRestore(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	tc, err := hsm.NewTestCoordinator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	ct, err := hsm.NewCopytool(tc, posix.NewBackend(tc.Root(), store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ct.Run(ctx)
+
+	data := strings.Repeat("archive me ", 1000)
+	fid, err := tc.CreateFile("file", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := tc.Path(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetFileLayout(fid, []byte("layout")); err != nil {
+		t.Fatal(err)
+	}
+	hasXattrs := setXattr(t, path, "user.project", []byte("demo"))
+
+	if err := tc.RequestArchive(fid, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Wait(ctx, fid); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.Metadata(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len(data)) {
+		t.Fatalf("archived %d bytes, expected %d", meta.Size, len(data))
+	}
+	if meta.Sparse == nil || meta.FileSize() != int64(len(data)) {
+		t.Fatalf("unexpected sparse map: %+v", meta.Sparse)
+	}
+	if meta.DataVersion != 1 {
+		t.Fatalf("archived data version %d, expected 1", meta.DataVersion)
+	}
+	if string(meta.LovEA) != "layout" {
+		t.Fatalf("archived layout %q, expected %q", meta.LovEA, "layout")
+	}
+
+	// The file is released with a different layout, which the
+	// restore must not keep.
+	if err := tc.SetFileLayout(fid, []byte("released")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed after the archive, so the restore must reapply it to the
+	// file itself.
+	if hasXattrs {
+		setXattr(t, path, "user.project", []byte("changed"))
+	}
+	if err := tc.RequestRelease(fid); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := ioutil.ReadFile(path); len(buf) != 0 {
+		t.Fatalf("released file still has %d bytes", len(buf))
+	}
+
+	if err := tc.RequestRestore(fid); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Wait(ctx, fid); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != data {
+		t.Fatalf("restored %d bytes of unexpected data", len(buf))
+	}
+	if layout, _ := tc.FileLayout(fid); string(layout) != "layout" {
+		t.Fatalf("restored layout %q, expected %q", layout, "layout")
+	}
+	dv, err := tc.DataVersion(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = store.Metadata(fid); err != nil {
+		t.Fatal(err)
+	}
+	if dv == 1 || meta.DataVersion != dv {
+		t.Fatalf("data version %d after restore, recorded %d", dv, meta.DataVersion)
+	}
+	if hasXattrs {
+		value := make([]byte, 64)
+		n, err := xattr.Lgetxattr(path, "user.project", value)
+		if err != nil {
+			t.Fatalf("restored file: %v", err)
+		}
+		if string(value[:n]) != "demo" {
+			t.Fatalf("restored xattr %q, expected %q", value[:n], "demo")
+		}
+	}
+}
+
+// setXattr sets an xattr on the file, and returns false if the
+// filesystem doesn't support user xattrs.
+func setXattr(t *testing.T, path, name string, value []byte) bool {
+	if err := xattr.Lsetxattr(path, name, value, 0); err != nil {
+		if err == syscall.ENOTSUP {
+			t.Logf("%s: user xattrs not supported", path)
+			return false
+		}
+		t.Fatal(err)
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/hsm/reconcile"
+)
+
+// Objects calls fn for each complete object in the store. It
+// implements reconcile.Archive.
+func (s *Store) Objects(ctx context.Context, fn func(*reconcile.Object) error) error {
+	return filepath.Walk(s.root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fi.IsDir() || !strings.HasSuffix(name, metaSuffix) {
+			return nil
+		}
+		base := strings.TrimSuffix(filepath.Base(name), metaSuffix)
+		if base == "" {
+			return nil
+		}
+		f, err := lustre.ParseFid(base)
+		if err != nil {
+			// Not one of ours.
+			return nil
+		}
+		meta, err := s.Metadata(f)
+		if err != nil {
+			return err
+		}
+		// The data is written before the metadata and removed
+		// before it, so this is an interrupted Remove.
+		if _, err := os.Stat(s.DataPath(f)); os.IsNotExist(err) {
+			return nil
+		}
+		return fn(&reconcile.Object{
+			Fid:         f,
+			Size:        meta.FileSize(),
+			Checksum:    meta.Checksum,
+			DataVersion: meta.DataVersion,
+		})
+	})
+}
+
+// Checksum returns the checksum of the file data in r in the form
+// recorded in the object's Metadata. If only the data segments of the
+// file were stored, only those segments are included. It implements
+// reconcile.Archive.
+func (s *Store) Checksum(o *reconcile.Object, r io.ReaderAt) (string, error) {
+	meta, err := s.Metadata(o.Fid)
+	if err != nil {
+		return "", err
+	}
+	segments := []hsm.Segment{{Offset: 0, Length: meta.Size}}
+	if meta.Sparse != nil {
+		segments = meta.Sparse.Segments
+	}
+
+	h := sha256.New()
+	for _, seg := range segments {
+		if _, err := io.Copy(h, io.NewSectionReader(r, seg.Offset, seg.Length)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
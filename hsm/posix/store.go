@@ -0,0 +1,240 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	// Metadata is the sidecar stored alongside each archived file. It
+	// records the attributes of the file at the time it was archived
+	// and the checksum of the archived data.
+	Metadata struct {
+		Fid      *lustre.Fid       `json:"fid"`
+		Size     int64             `json:"size"`
+		Mode     os.FileMode       `json:"mode"`
+		Uid      uint32            `json:"uid"`
+		Gid      uint32            `json:"gid"`
+		Atime    time.Time         `json:"atime"`
+		Mtime    time.Time         `json:"mtime"`
+		Ctime    time.Time         `json:"ctime"`
+		Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+		Layout   *llapi.DataLayout `json:"layout,omitempty"`
+		Checksum string            `json:"checksum"`
+
+		// LovEA is the full layout of the file, including any
+		// composite components and the pool, which is applied to
+		// the file when it is restored.
+		LovEA []byte `json:"lov_ea,omitempty"`
+
+		// DataVersion is the Lustre data version of the file when
+		// it was archived or last restored, if known.
+		DataVersion uint64 `json:"data_version,omitempty"`
+
+		// Sparse records where the stored data belongs in the file,
+		// if only the data segments were stored. Size is then the
+		// number of bytes stored, not the size of the file.
+		Sparse *hsm.SparseMap `json:"sparse,omitempty"`
+	}
+
+	// Store is a directory tree containing archived file data, keyed by
+	// the FID of the Lustre file.
+	Store struct {
+		root string
+	}
+
+	// ChecksumError is returned when the data read from the store does
+	// not match the checksum recorded when it was archived.
+	ChecksumError struct {
+		Fid      *lustre.Fid
+		Expected string
+		Actual   string
+	}
+)
+
+const (
+	dataSuffix = ".data"
+	metaSuffix = ".meta"
+)
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: checksum mismatch: expected %s, got %s", e.Fid, e.Expected, e.Actual)
+}
+
+// NewStore returns a Store rooted at the directory, creating it if
+// necessary.
+func NewStore(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "create archive root")
+	}
+	return &Store{root: root}, nil
+}
+
+// Root returns the directory containing the store.
+func (s *Store) Root() string {
+	return s.root
+}
+
+// fidPath returns the path for a fid without a suffix. Objects are
+// spread across subdirectories by the low bits of the Oid to keep the
+// directories a reasonable size.
+func (s *Store) fidPath(f *lustre.Fid) string {
+	return filepath.Join(s.root,
+		fmt.Sprintf("%04x", f.Oid&0xffff),
+		fmt.Sprintf("%04x", (f.Oid>>16)&0xffff),
+		fmt.Sprintf("0x%x:0x%x:0x%x", f.Seq, f.Oid, f.Ver))
+}
+
+// DataPath returns the path of the archived data for the fid.
+func (s *Store) DataPath(f *lustre.Fid) string {
+	return s.fidPath(f) + dataSuffix
+}
+
+// MetadataPath returns the path of the metadata sidecar for the fid.
+func (s *Store) MetadataPath(f *lustre.Fid) string {
+	return s.fidPath(f) + metaSuffix
+}
+
+// writeAtomic writes the contents of r to a temporary file in the
+// same directory as name, and renames it into place once the data is
+// safely on disk.
+func writeAtomic(name string, r io.Reader) (int64, error) {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(name)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// Put copies the data from r into the store and records the metadata
+// for the fid, replacing any previous copy. The Size and Checksum fields
+// of meta are set from the data that was copied.
+func (s *Store) Put(f *lustre.Fid, r io.Reader, meta *Metadata) (int64, error) {
+	h := sha256.New()
+	n, err := writeAtomic(s.DataPath(f), io.TeeReader(r, h))
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s: write data", f)
+	}
+
+	meta.Fid = f
+	meta.Size = n
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	if err := s.putMetadata(f, meta); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *Store) putMetadata(f *lustre.Fid, meta *Metadata) error {
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "%s: encode metadata", f)
+	}
+	buf = append(buf, '\n')
+	if _, err := writeAtomic(s.MetadataPath(f), bytes.NewReader(buf)); err != nil {
+		return errors.Wrapf(err, "%s: write metadata", f)
+	}
+	return nil
+}
+
+// Metadata returns the metadata recorded for the fid.
+func (s *Store) Metadata(f *lustre.Fid) (*Metadata, error) {
+	buf, err := ioutil.ReadFile(s.MetadataPath(f))
+	if err != nil {
+		return nil, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(buf, &meta); err != nil {
+		return nil, errors.Wrapf(err, "%s: decode metadata", f)
+	}
+	return &meta, nil
+}
+
+// FileSize returns the size of the archived file.
+func (meta *Metadata) FileSize() int64 {
+	if meta.Sparse != nil {
+		return meta.Sparse.Size
+	}
+	return meta.Size
+}
+
+// OpenData opens the archived data for the fid for reading.
+func (s *Store) OpenData(f *lustre.Fid) (*os.File, error) {
+	return os.Open(s.DataPath(f))
+}
+
+// Get copies the archived data for the fid to w and verifies it against
+// the recorded checksum. A *ChecksumError is returned if the data does
+// not match, in which case w has already received the bad data.
+func (s *Store) Get(f *lustre.Fid, w io.Writer) (*Metadata, int64, error) {
+	meta, err := s.Metadata(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := os.Open(s.DataPath(f))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer data.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), data)
+	if err != nil {
+		return nil, n, errors.Wrapf(err, "%s: read data", f)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != meta.Checksum {
+		return meta, n, &ChecksumError{Fid: f, Expected: meta.Checksum, Actual: sum}
+	}
+	return meta, n, nil
+}
+
+// Remove deletes the archived data and metadata for the fid. It is not
+// an error to remove a fid that is not in the store.
+func (s *Store) Remove(f *lustre.Fid) error {
+	for _, name := range []string{s.DataPath(f), s.MetadataPath(f)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm/posix"
+	"github.com/intel-hpdd/go-lustre/hsm/reconcile"
+)
+
+func newStore(t *testing.T) (*posix.Store, func()) {
+	dir, err := ioutil.TempDir("", "posix-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := posix.NewStore(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestStorePutGet(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	fid := &lustre.Fid{Seq: 0x200000400, Oid: 0x12345, Ver: 0}
+	data := strings.Repeat("lustre", 1000)
+	meta := &posix.Metadata{
+		Mode:   0644,
+		Uid:    500,
+		Xattrs: map[string][]byte{"user.foo": []byte("bar")},
+	}
+
+	n, err := store.Put(fid, strings.NewReader(data), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("put %d bytes, expected %d", n, len(data))
+	}
+
+	var buf bytes.Buffer
+	got, n, err := store.Get(fid, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || buf.String() != data {
+		t.Fatalf("got %d bytes of unexpected data", n)
+	}
+	if *got.Fid != *fid || got.Size != n || got.Uid != 500 || got.Mode != 0644 {
+		t.Fatalf("unexpected metadata: %+v", got)
+	}
+	if string(got.Xattrs["user.foo"]) != "bar" {
+		t.Fatalf("unexpected xattrs: %v", got.Xattrs)
+	}
+
+	// No temporary files should be left behind.
+	entries, err := ioutil.ReadDir(filepath.Dir(store.DataPath(fid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected data and metadata files, found %d entries", len(entries))
+	}
+}
+
+func TestStoreChecksum(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	fid := &lustre.Fid{Seq: 0x200000400, Oid: 1, Ver: 0}
+	if _, err := store.Put(fid, strings.NewReader("original data"), &posix.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.DataPath(fid), []byte("corrupt data!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := store.Get(fid, ioutil.Discard)
+	if _, ok := err.(*posix.ChecksumError); !ok {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+}
+
+func TestStoreRemove(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	fid := &lustre.Fid{Seq: 0x200000400, Oid: 2, Ver: 0}
+	if _, err := store.Put(fid, strings.NewReader("data"), &posix.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove(fid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Metadata(fid); !os.IsNotExist(err) {
+		t.Fatalf("expected metadata to be removed, got %v", err)
+	}
+	if _, err := os.Stat(store.DataPath(fid)); !os.IsNotExist(err) {
+		t.Fatalf("expected data to be removed, got %v", err)
+	}
+
+	// Removing again is not an error.
+	if err := store.Remove(fid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreObjects(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	want := make(map[lustre.Fid]int64)
+	for i := uint32(1); i <= 5; i++ {
+		fid := &lustre.Fid{Seq: 0x200000400, Oid: i << 15}
+		data := strings.Repeat("x", int(i)*100)
+		if _, err := store.Put(fid, strings.NewReader(data), &posix.Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+		want[*fid] = int64(len(data))
+	}
+	// An interrupted Remove leaves only the metadata.
+	partial := &lustre.Fid{Seq: 0x200000400, Oid: 6}
+	if _, err := store.Put(partial, strings.NewReader("gone"), &posix.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(store.DataPath(partial)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(store.Root(), "gc.journal"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Objects(context.Background(), func(o *reconcile.Object) error {
+		size, ok := want[*o.Fid]
+		if !ok {
+			t.Errorf("unexpected object %s", o.Fid)
+			return nil
+		}
+		if o.Size != size {
+			t.Errorf("%s: size %d, want %d", o.Fid, o.Size, size)
+		}
+		sum, err := store.Checksum(o, strings.NewReader(strings.Repeat("x", int(size))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.Checksum != sum {
+			t.Errorf("%s: checksum %s, want %s", o.Fid, o.Checksum, sum)
+		}
+		delete(want, *o.Fid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 0 {
+		t.Errorf("objects not listed: %v", want)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// ProgressOption is a configuration option for the progress
+	// reporting wrappers.
+	ProgressOption func(*progressUpdater)
+
+	// progressUpdater tracks the bytes copied for an action and
+	// reports them to the coordinator. Progress is always reported as
+	// the extent from the start of the action to the last byte copied.
+	progressUpdater struct {
+		ctx          context.Context
+		aih          ActionHandle
+		interval     time.Duration
+		byteInterval int64
+		total        int64
+
+		mu         sync.Mutex
+		started    time.Time
+		copied     int64
+		lastUpdate time.Time
+		lastCopied int64
+	}
+
+	// ProgressReader is an io.Reader that reports the progress of an
+	// action as data is read.
+	ProgressReader struct {
+		*progressUpdater
+		r io.Reader
+	}
+
+	// ProgressWriter is an io.Writer that reports the progress of an
+	// action as data is written.
+	ProgressWriter struct {
+		*progressUpdater
+		w io.Writer
+	}
+)
+
+const (
+	defaultUpdateInterval = 10 * time.Second
+	copyBufferSize        = 1024 * 1024
+)
+
+// OptProgressInterval sets the minimum time between progress updates.
+func OptProgressInterval(interval time.Duration) ProgressOption {
+	return func(p *progressUpdater) {
+		p.interval = interval
+	}
+}
+
+// OptProgressByteInterval causes progress to be reported after every
+// count bytes, in addition to the time interval.
+func OptProgressByteInterval(count int64) ProgressOption {
+	return func(p *progressUpdater) {
+		p.byteInterval = count
+	}
+}
+
+// OptProgressTotal sets the total length reported with each update. By
+// default this is the length of the action's extent, or 0 (unknown) if
+// the extent runs to EOF.
+func OptProgressTotal(total int64) ProgressOption {
+	return func(p *progressUpdater) {
+		p.total = total
+	}
+}
+
+func newProgressUpdater(ctx context.Context, aih ActionHandle, options ...ProgressOption) *progressUpdater {
+	now := time.Now()
+	p := &progressUpdater{
+		ctx:        ctx,
+		aih:        aih,
+		interval:   defaultUpdateInterval,
+		started:    now,
+		lastUpdate: now,
+	}
+	if aih.Length() != lustre.MaxExtentLength {
+		p.total = aih.Length()
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// limit returns the number of bytes that may still be copied within the
+// action's extent, or -1 if the extent runs to EOF.
+func (p *progressUpdater) limit() int64 {
+	if p.aih.Length() == lustre.MaxExtentLength {
+		return -1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.aih.Length() - p.copied
+}
+
+func (p *progressUpdater) update(n int) {
+	p.mu.Lock()
+	p.copied += int64(n)
+	now := time.Now()
+	due := now.Sub(p.lastUpdate) >= p.interval ||
+		(p.byteInterval > 0 && p.copied-p.lastCopied >= p.byteInterval)
+	if !due {
+		p.mu.Unlock()
+		return
+	}
+	p.lastUpdate = now
+	p.lastCopied = p.copied
+	copied := p.copied
+	p.mu.Unlock()
+
+	if err := p.aih.Progress(p.aih.Offset(), copied, p.total, 0); err != nil {
+		debug.Printf("%s: progress failed: %v", p.aih, err)
+	}
+}
+
+// Copied returns the number of bytes copied so far.
+func (p *progressUpdater) Copied() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.copied
+}
+
+// Throughput returns the average rate of the copy in bytes per second.
+func (p *progressUpdater) Throughput() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.copied) / elapsed
+}
+
+// NewProgressReader returns a ProgressReader for the action. Reads are
+// limited to the action's extent. If r is an io.ReaderAt, reads start
+// at the action's offset; otherwise r must already be positioned there.
+func NewProgressReader(ctx context.Context, r io.Reader, aih ActionHandle, options ...ProgressOption) *ProgressReader {
+	if ra, ok := r.(io.ReaderAt); ok {
+		length := aih.Length()
+		if length == lustre.MaxExtentLength {
+			length = 1<<63 - 1 - aih.Offset()
+		}
+		r = io.NewSectionReader(ra, aih.Offset(), length)
+	}
+	return &ProgressReader{
+		progressUpdater: newProgressUpdater(ctx, aih, options...),
+		r:               r,
+	}
+}
+
+// Read implements io.Reader. Reads are limited to the bandwidth set in
+// the context by the Copytool.
+func (pr *ProgressReader) Read(b []byte) (int, error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if limit := pr.limit(); limit >= 0 {
+		if limit == 0 {
+			return 0, io.EOF
+		}
+		if int64(len(b)) > limit {
+			b = b[:limit]
+		}
+	}
+	n, err := pr.r.Read(b)
+	pr.update(n)
+	if werr := WaitBandwidth(pr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, so io.Copy uses a large buffer and
+// still reports progress.
+func (pr *ProgressReader) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		nr, err := pr.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// NewProgressWriter returns a ProgressWriter for the action. If w is an
+// io.WriterAt, writes start at the action's offset; otherwise w must
+// already be positioned there.
+func NewProgressWriter(ctx context.Context, w io.Writer, aih ActionHandle, options ...ProgressOption) *ProgressWriter {
+	return &ProgressWriter{
+		progressUpdater: newProgressUpdater(ctx, aih, options...),
+		w:               w,
+	}
+}
+
+// Write implements io.Writer. Writing beyond the end of the action's
+// extent returns io.ErrShortWrite. Writes are limited to the bandwidth
+// set in the context by the Copytool.
+func (pw *ProgressWriter) Write(b []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := WaitBandwidth(pw.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	var short bool
+	if limit := pw.limit(); limit >= 0 && int64(len(b)) > limit {
+		b = b[:limit]
+		short = true
+	}
+
+	var n int
+	var err error
+	if wa, ok := pw.w.(io.WriterAt); ok {
+		n, err = wa.WriteAt(b, pw.aih.Offset()+pw.Copied())
+	} else {
+		n, err = pw.w.Write(b)
+	}
+	pw.update(n)
+	if err == nil && short {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
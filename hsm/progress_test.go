@@ -0,0 +1,145 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+)
+
+// collectProgress records the progress updates for a request until the
+// returned function is called.
+func collectProgress(req *hsm.TestRequest) func() []*hsm.TestProgressUpdate {
+	var updates []*hsm.TestProgressUpdate
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case p, ok := <-req.ProgressUpdates():
+				if !ok {
+					<-done
+					return
+				}
+				updates = append(updates, p)
+			case <-done:
+				// Take the updates still buffered.
+				for {
+					select {
+					case p, ok := <-req.ProgressUpdates():
+						if !ok {
+							return
+						}
+						updates = append(updates, p)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() []*hsm.TestProgressUpdate {
+		close(done)
+		<-stopped
+		return updates
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var tests = []struct {
+		offset   int64
+		length   int64
+		expected string
+	}{
+		{0, lustre.MaxExtentLength, "0123456789"},
+		{2, lustre.MaxExtentLength, "23456789"},
+		{2, 5, "23456"},
+	}
+
+	for _, tc := range tests {
+		req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+		req.SetExtent(tc.offset, tc.length)
+		stop := collectProgress(req)
+
+		pr := hsm.NewProgressReader(context.Background(), strings.NewReader("0123456789"), req,
+			hsm.OptProgressByteInterval(1))
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, pr); err != nil {
+			t.Fatal(err)
+		}
+		updates := stop()
+
+		if buf.String() != tc.expected {
+			t.Fatalf("%d:%d: read %q, expected %q", tc.offset, tc.length, buf.String(), tc.expected)
+		}
+		if pr.Copied() != int64(len(tc.expected)) {
+			t.Fatalf("copied %d, expected %d", pr.Copied(), len(tc.expected))
+		}
+		if len(updates) == 0 {
+			t.Fatal("no progress updates")
+		}
+		last := updates[len(updates)-1]
+		if last.Offset != tc.offset || last.Length != int64(len(tc.expected)) {
+			t.Fatalf("unexpected final update: %s", last)
+		}
+	}
+}
+
+func TestProgressInterval(t *testing.T) {
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	stop := collectProgress(req)
+
+	pr := hsm.NewProgressReader(context.Background(), strings.NewReader(strings.Repeat("x", 100)), req,
+		hsm.OptProgressInterval(time.Hour))
+	if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+		t.Fatal(err)
+	}
+	if updates := stop(); len(updates) != 0 {
+		t.Fatalf("expected no updates within interval, got %d", len(updates))
+	}
+	if pr.Throughput() <= 0 {
+		t.Fatal("expected non-zero throughput")
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	req := hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	req.SetExtent(0, 4)
+	stop := collectProgress(req)
+	defer stop()
+
+	var buf bytes.Buffer
+	pw := hsm.NewProgressWriter(context.Background(), &buf, req)
+	n, err := pw.Write([]byte("0123456789"))
+	if err != io.ErrShortWrite {
+		t.Fatalf("expected short write, got %v", err)
+	}
+	if n != 4 || buf.String() != "0123" {
+		t.Fatalf("wrote %d bytes %q", n, buf.String())
+	}
+}
+
+func TestProgressCanceled(t *testing.T) {
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	stop := collectProgress(req)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pr := hsm.NewProgressReader(ctx, strings.NewReader("data"), req)
+	if _, err := io.Copy(ioutil.Discard, pr); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package reconcile compares the HSM state of files in a Lustre
+// filesystem with the contents of an archive.
+package reconcile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	// Object describes a copy of a file stored in an archive.
+	Object struct {
+		Fid      *lustre.Fid
+		Size     int64
+		Checksum string
+
+		// DataVersion is the data version of the file when it was
+		// archived or last restored, or 0 if the archive doesn't
+		// record it. A restore writes new objects, so the archive
+		// must update it then for the comparison to hold.
+		DataVersion uint64
+	}
+
+	// Archive is implemented by backends which can list the copies
+	// they hold.
+	Archive interface {
+		// Objects calls fn for each object in the archive.
+		Objects(ctx context.Context, fn func(*Object) error) error
+
+		// Checksum returns the checksum of the file data in r, in
+		// the form recorded for the object. The object may
+		// determine which parts of the file are included.
+		Checksum(o *Object, r io.ReaderAt) (string, error)
+	}
+
+	// Kind is a category of inconsistency between the filesystem and
+	// the archive.
+	Kind int
+
+	// Finding is an inconsistency found by a Reconciler.
+	Finding struct {
+		Kind   Kind
+		Path   string
+		Fid    *lustre.Fid
+		Detail string
+
+		// Repaired is set if the repair succeeded, and Err if it
+		// failed.
+		Repaired bool
+		Err      error
+	}
+
+	// Report is the result of a reconciliation.
+	Report struct {
+		Files    int
+		Objects  int
+		Findings []*Finding
+	}
+
+	// ReconcilerOption is a configuration option for a Reconciler.
+	ReconcilerOption func(*Reconciler)
+
+	// Reconciler walks a filesystem tree and compares the HSM state
+	// of each file with the objects in an archive.
+	Reconciler struct {
+		root      fs.RootDir
+		archive   Archive
+		archiveID uint32
+		verify    bool
+		repair    bool
+
+		// Hooks to replace the Lustre calls in tests.
+		getStatus   func(path string) (*hsm.FileStatus, error)
+		setStatus   func(path string, set, clear llapi.HsmStateFlag) error
+		lookupFid   func(path string) (*lustre.Fid, error)
+		statFid     func(fid *lustre.Fid) error
+		dataVersion func(path string) (uint64, error)
+		archiveFids func(fids []*lustre.Fid) error
+	}
+)
+
+// Kinds of Finding.
+const (
+	// Orphan is an archive object with no live file.
+	Orphan Kind = iota
+	// Missing is a file marked archived with no archive object.
+	Missing
+	// Mismatch is an archive object whose size, checksum or data
+	// version doesn't match the file.
+	Mismatch
+	// Lost is a released file with no archive object. Its data is
+	// gone.
+	Lost
+)
+
+var kindNames = map[Kind]string{
+	Orphan:   "orphan",
+	Missing:  "missing",
+	Mismatch: "mismatch",
+	Lost:     "lost",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+func (f *Finding) String() string {
+	name := f.Path
+	if name == "" {
+		name = f.Fid.String()
+	}
+	s := fmt.Sprintf("%s %s", f.Kind, name)
+	if f.Detail != "" {
+		s += ": " + f.Detail
+	}
+	switch {
+	case f.Err != nil:
+		s += fmt.Sprintf(" (repair failed: %v)", f.Err)
+	case f.Repaired:
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Count returns the number of findings of a kind.
+func (r *Report) Count(kind Kind) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// OptReconcileVerifyChecksums causes the data of each archived, clean
+// file to be read and compared with the checksum of its archive copy.
+func OptReconcileVerifyChecksums() ReconcilerOption {
+	return func(r *Reconciler) {
+		r.verify = true
+	}
+}
+
+// OptReconcileRepair causes inconsistencies to be repaired where
+// possible. Files with a missing or mismatched copy are archived
+// again, unless released, and released files with no copy are marked
+// lost.
+func OptReconcileRepair() ReconcilerOption {
+	return func(r *Reconciler) {
+		r.repair = true
+	}
+}
+
+// OptReconcileDataVersion replaces the function used to read a file's
+// data version, for comparison with Object.DataVersion.
+func OptReconcileDataVersion(fn func(path string) (uint64, error)) ReconcilerOption {
+	return func(r *Reconciler) {
+		r.dataVersion = fn
+	}
+}
+
+// NewReconciler returns a *Reconciler which compares the files in root
+// which belong to archiveID with the objects in archive.
+func NewReconciler(root fs.RootDir, archiveID uint32, archive Archive, options ...ReconcilerOption) *Reconciler {
+	r := &Reconciler{
+		root:      root,
+		archive:   archive,
+		archiveID: archiveID,
+		getStatus: hsm.GetFileStatus,
+		setStatus: func(path string, set, clear llapi.HsmStateFlag) error {
+			return hsm.SetFileStatus(path, uint64(set), uint64(clear), 0)
+		},
+		lookupFid: fs.LookupFid,
+		statFid: func(fid *lustre.Fid) error {
+			_, err := fs.StatFid(root, fid)
+			return err
+		},
+		dataVersion: func(path string) (uint64, error) {
+			return hsm.GetDataVersion(path, llapi.DataVersionReadFlush)
+		},
+		archiveFids: func(fids []*lustre.Fid) error {
+			return hsm.RequestArchive(root, uint(archiveID), fids)
+		},
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// Run reconciles the files under dir with the archive.
+func (r *Reconciler) Run(ctx context.Context, dir string) (*Report, error) {
+	report := &Report{}
+
+	objects := make(map[lustre.Fid]*Object)
+	err := r.archive.Objects(ctx, func(o *Object) error {
+		objects[*o.Fid] = o
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing archive failed")
+	}
+	report.Objects = len(objects)
+
+	var rearchive []*lustre.Fid
+	var rearchiveFindings []*Finding
+	seen := make(map[lustre.Fid]bool)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		report.Files++
+
+		f, err := r.checkFile(path, fi, objects, seen)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return nil
+		}
+		report.Findings = append(report.Findings, f)
+		if r.repair {
+			if r.repairFile(f) {
+				rearchive = append(rearchive, f.Fid)
+				rearchiveFindings = append(rearchiveFindings, f)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if len(rearchive) > 0 {
+		err := r.archiveFids(rearchive)
+		for _, f := range rearchiveFindings {
+			f.Repaired = err == nil
+			f.Err = err
+		}
+	}
+
+	var orphans []*Finding
+	for fid, o := range objects {
+		if seen[fid] {
+			continue
+		}
+		// The file may be outside the tree that was walked.
+		if err := r.statFid(o.Fid); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		orphans = append(orphans, &Finding{Kind: Orphan, Fid: o.Fid})
+	}
+	sort.Sort(byFid(orphans))
+	report.Findings = append(report.Findings, orphans...)
+
+	return report, ctx.Err()
+}
+
+type byFid []*Finding
+
+func (s byFid) Len() int      { return len(s) }
+func (s byFid) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFid) Less(i, j int) bool {
+	a, b := s[i].Fid, s[j].Fid
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	if a.Oid != b.Oid {
+		return a.Oid < b.Oid
+	}
+	return a.Ver < b.Ver
+}
+
+// checkFile compares one file with its archive object, if any.
+func (r *Reconciler) checkFile(path string, fi os.FileInfo, objects map[lustre.Fid]*Object, seen map[lustre.Fid]bool) (*Finding, error) {
+	fid, err := r.lookupFid(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: lookup fid", path)
+	}
+	if _, ok := objects[*fid]; ok {
+		seen[*fid] = true
+	}
+
+	s, err := r.getStatus(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: get HSM status", path)
+	}
+	if !s.Exists() || s.ArchiveID != r.archiveID || s.Lost() {
+		return nil, nil
+	}
+
+	o, ok := objects[*fid]
+	switch {
+	case !ok && s.Released():
+		return &Finding{Kind: Lost, Path: path, Fid: fid}, nil
+	case !ok && s.Archived():
+		return &Finding{Kind: Missing, Path: path, Fid: fid}, nil
+	case !ok || !s.Archived() || s.Dirty() || s.Released():
+		// Not archived yet, or the copy is known to be stale.
+		return nil, nil
+	}
+
+	if o.Size != fi.Size() {
+		return &Finding{Kind: Mismatch, Path: path, Fid: fid,
+			Detail: fmt.Sprintf("size %d, archived %d", fi.Size(), o.Size)}, nil
+	}
+	if o.DataVersion != 0 && r.dataVersion != nil {
+		dv, err := r.dataVersion(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: get data version", path)
+		}
+		if dv != o.DataVersion {
+			return &Finding{Kind: Mismatch, Path: path, Fid: fid,
+				Detail: fmt.Sprintf("data version %d, archived %d", dv, o.DataVersion)}, nil
+		}
+	}
+	if r.verify && o.Checksum != "" {
+		sum, err := r.checksum(path, o)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: checksum", path)
+		}
+		if sum != o.Checksum {
+			return &Finding{Kind: Mismatch, Path: path, Fid: fid,
+				Detail: fmt.Sprintf("checksum %s, archived %s", sum, o.Checksum)}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *Reconciler) checksum(path string, o *Object) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return r.archive.Checksum(o, f)
+}
+
+// repairFile marks a file lost, or clears its archived flag so it can
+// be archived again. It returns true if the file should be archived.
+func (r *Reconciler) repairFile(f *Finding) bool {
+	switch f.Kind {
+	case Lost:
+		f.Err = r.setStatus(f.Path, llapi.HsmFileLost, 0)
+		f.Repaired = f.Err == nil
+	case Missing, Mismatch:
+		f.Err = r.setStatus(f.Path, llapi.HsmFileDirty, llapi.HsmFileArchived)
+		return f.Err == nil
+	}
+	return false
+}
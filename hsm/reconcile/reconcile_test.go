@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package reconcile
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type testArchive struct {
+	objects []*Object
+}
+
+func (a *testArchive) Objects(ctx context.Context, fn func(*Object) error) error {
+	for _, o := range a.objects {
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *testArchive) Checksum(o *Object, r io.ReaderAt) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, o.Size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checksum(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+type testFile struct {
+	name    string
+	data    string
+	state   llapi.HsmStateFlag
+	archive uint32
+	object  *Object
+}
+
+const archived = llapi.HsmFileExists | llapi.HsmFileArchived
+
+func testFid(n int) *lustre.Fid {
+	return &lustre.Fid{Seq: 0x200000400, Oid: uint32(n)}
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reconcile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*testFile{
+		{name: "ok", data: "hello", state: archived, archive: 1,
+			object: &Object{Size: 5, Checksum: checksum("hello")}},
+		{name: "unarchived", data: "new"},
+		{name: "other-archive", data: "x", state: archived, archive: 2},
+		{name: "missing", data: "gone", state: archived, archive: 1},
+		{name: "lost", state: archived | llapi.HsmFileReleased, archive: 1},
+		{name: "already-lost", state: archived | llapi.HsmFileReleased | llapi.HsmFileLost, archive: 1},
+		{name: "released", state: archived | llapi.HsmFileReleased, archive: 1,
+			object: &Object{Size: 100, Checksum: checksum("whatever")}},
+		{name: "dirty", data: "changed", state: archived | llapi.HsmFileDirty, archive: 1,
+			object: &Object{Size: 3, Checksum: checksum("old")}},
+		{name: "short", data: "truncated", state: archived, archive: 1,
+			object: &Object{Size: 100}},
+		{name: "corrupt", data: "abcde", state: archived, archive: 1,
+			object: &Object{Size: 5, Checksum: checksum("ABCDE")}},
+		{name: "stale", data: "12345", state: archived, archive: 1,
+			object: &Object{Size: 5, Checksum: checksum("12345"), DataVersion: 7}},
+	}
+
+	archive := &testArchive{}
+	fids := make(map[string]*lustre.Fid)
+	byPath := make(map[string]*testFile)
+	for i, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fids[path] = testFid(i + 1)
+		byPath[path] = f
+		if f.object != nil {
+			f.object.Fid = fids[path]
+			archive.objects = append(archive.objects, f.object)
+		}
+	}
+	// An object whose file is gone, and one whose file lives
+	// outside the tree.
+	archive.objects = append(archive.objects,
+		&Object{Fid: testFid(100), Size: 1},
+		&Object{Fid: testFid(101), Size: 1})
+
+	var archivedFids []*lustre.Fid
+	r := NewReconciler(fs.RootDir{}, 1, archive,
+		OptReconcileVerifyChecksums(),
+		OptReconcileRepair(),
+		OptReconcileDataVersion(func(path string) (uint64, error) { return 8, nil }))
+	r.lookupFid = func(path string) (*lustre.Fid, error) { return fids[path], nil }
+	r.getStatus = func(path string) (*hsm.FileStatus, error) {
+		f := byPath[path]
+		return hsm.NewFileStatus(llapi.HsmFileState(f.state), f.archive), nil
+	}
+	r.setStatus = func(path string, set, clear llapi.HsmStateFlag) error {
+		f := byPath[path]
+		f.state = (f.state | set) &^ clear
+		return nil
+	}
+	r.statFid = func(fid *lustre.Fid) error {
+		if fid.Oid == 101 {
+			return nil
+		}
+		return os.ErrNotExist
+	}
+	r.archiveFids = func(fids []*lustre.Fid) error {
+		archivedFids = append(archivedFids, fids...)
+		return nil
+	}
+
+	report, err := r.Run(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != len(files) || report.Objects != len(archive.objects) {
+		t.Errorf("got %d files, %d objects", report.Files, report.Objects)
+	}
+
+	var got []string
+	for _, f := range report.Findings {
+		if !f.Repaired && f.Kind != Orphan {
+			t.Errorf("%s: not repaired", f)
+		}
+		got = append(got, f.Kind.String()+" "+filepath.Base(f.Path))
+	}
+	sort.Strings(got)
+	want := []string{
+		"lost lost",
+		"mismatch corrupt",
+		"mismatch short",
+		"mismatch stale",
+		"missing missing",
+		"orphan .",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("findings %v, want %v", got, want)
+	}
+	if report.Count(Mismatch) != 3 {
+		t.Errorf("got %d mismatches, want 3", report.Count(Mismatch))
+	}
+
+	if byPath[filepath.Join(dir, "lost")].state&llapi.HsmFileLost == 0 {
+		t.Error("lost file not marked lost")
+	}
+	for _, name := range []string{"missing", "short", "corrupt", "stale"} {
+		state := byPath[filepath.Join(dir, name)].state
+		if state&llapi.HsmFileArchived != 0 || state&llapi.HsmFileDirty == 0 {
+			t.Errorf("%s: state %#x not reset for archiving", name, state)
+		}
+	}
+	if len(archivedFids) != 4 {
+		t.Errorf("archived %d files, want 4", len(archivedFids))
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package release frees space on a Lustre filesystem by releasing the
+// data of archived files when OSTs fill up.
+package release
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/status"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// UsageFunc returns the usage of the OSTs being watched.
+	UsageFunc func() ([]*status.TargetUsage, error)
+
+	// DaemonOption is a configuration option for a Daemon.
+	DaemonOption func(*Daemon)
+
+	// Daemon watches the fill level of the OSTs returned by a
+	// UsageFunc. When the fullest rises above the high watermark, the
+	// daemon releases archived, clean files with data on the OSTs above
+	// the low watermark, least recently used first, until they all drop
+	// below the low watermark.
+	Daemon struct {
+		root      fs.RootDir
+		index     *AtimeIndex
+		usage     UsageFunc
+		high      float64
+		low       float64
+		interval  time.Duration
+		batchSize int
+		stats     Stats
+
+		// Hooks to replace the Lustre calls in tests.
+		getStatus func(fid *lustre.Fid) (*hsm.FileStatus, error)
+		getLayout func(fid *lustre.Fid) (*llapi.DataLayout, error)
+		release   func(fids []*lustre.Fid) error
+	}
+
+	// Stats counts the files handled by a Daemon.
+	Stats struct {
+		Cycles   int
+		Released int
+		Skipped  int
+		Failed   int
+	}
+)
+
+const (
+	defaultInterval  = time.Minute
+	defaultBatchSize = 100
+)
+
+// OptDaemonInterval sets how often the fill level is checked.
+func OptDaemonInterval(interval time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.interval = interval
+	}
+}
+
+// OptDaemonBatchSize sets the number of files released in each
+// request. The fill level is checked again after each batch.
+func OptDaemonBatchSize(size int) DaemonOption {
+	return func(d *Daemon) {
+		d.batchSize = size
+	}
+}
+
+// NewDaemon returns a *Daemon which releases files in root, chosen
+// from index, to keep the fill level between the low and high
+// watermarks.
+func NewDaemon(root fs.RootDir, index *AtimeIndex, usage UsageFunc, high, low float64, options ...DaemonOption) (*Daemon, error) {
+	if low < 0 || high > 1 || low >= high {
+		return nil, errors.Errorf("invalid watermarks: low %v, high %v", low, high)
+	}
+	d := &Daemon{
+		root:      root,
+		index:     index,
+		usage:     usage,
+		high:      high,
+		low:       low,
+		interval:  defaultInterval,
+		batchSize: defaultBatchSize,
+		getStatus: func(fid *lustre.Fid) (*hsm.FileStatus, error) {
+			return hsm.GetFileStatus(fs.FidPath(root, fid))
+		},
+		getLayout: func(fid *lustre.Fid) (*llapi.DataLayout, error) {
+			return llapi.FileDataLayout(fs.FidPath(root, fid))
+		},
+		release: func(fids []*lustre.Fid) error {
+			return hsm.RequestRelease(root, 0, fids)
+		},
+	}
+	for _, option := range options {
+		option(d)
+	}
+	if d.batchSize < 1 {
+		d.batchSize = 1
+	}
+	return d, nil
+}
+
+// Stats returns the counts of files handled so far.
+func (d *Daemon) Stats() Stats {
+	return d.stats
+}
+
+// Run checks the fill level every interval until ctx is done.
+func (d *Daemon) Run(ctx context.Context) error {
+	for {
+		if err := d.Check(ctx); err != nil {
+			alert.Warnf("release: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// Check releases files if the fill level is above the high watermark.
+func (d *Daemon) Check(ctx context.Context) error {
+	usage, err := d.usage()
+	if err != nil {
+		return errors.Wrap(err, "reading usage failed")
+	}
+	used := maxUsage(usage)
+	if used < d.high {
+		return nil
+	}
+	d.stats.Cycles++
+	debug.Printf("release: usage %.1f%% above high watermark %.1f%%", used*100, d.high*100)
+
+	// Candidates that can't be released now stay in the index, but
+	// are passed over for the rest of this cycle.
+	skip := make(map[lustre.Fid]bool)
+	for used > d.low && ctx.Err() == nil {
+		batch := d.nextBatch(skip, d.fullTargets(usage))
+		if len(batch) == 0 {
+			return fmt.Errorf("no candidates left to release, usage %.1f%%", used*100)
+		}
+		if err := d.release(batch); err != nil {
+			d.stats.Failed += len(batch)
+			return errors.Wrap(err, "release request failed")
+		}
+		d.verify(batch)
+
+		if usage, err = d.usage(); err != nil {
+			return errors.Wrap(err, "reading usage failed")
+		}
+		used = maxUsage(usage)
+	}
+	debug.Printf("release: usage %.1f%%", used*100)
+	return ctx.Err()
+}
+
+// fullTargets returns the indexes of the OSTs above the low watermark.
+func (d *Daemon) fullTargets(usage []*status.TargetUsage) map[int]bool {
+	full := make(map[int]bool)
+	for _, u := range usage {
+		if u.UsedFraction() <= d.low {
+			continue
+		}
+		idx, err := ostIndex(u.Target)
+		if err != nil {
+			alert.Warnf("release: %v", err)
+			continue
+		}
+		full[idx] = true
+	}
+	return full
+}
+
+// ostIndex returns the index of an OST from its name, such as
+// lustre-OST000a.
+func ostIndex(target string) (int, error) {
+	i := strings.LastIndex(target, "-OST")
+	if i < 0 {
+		return 0, errors.Errorf("%s: not an OST", target)
+	}
+	idx, err := strconv.ParseUint(target[i+len("-OST"):], 16, 32)
+	if err != nil {
+		return 0, errors.Errorf("%s: invalid OST index", target)
+	}
+	return int(idx), nil
+}
+
+// nextBatch returns the least recently used files which are eligible
+// for release and have data on the full OSTs, up to the batch size.
+func (d *Daemon) nextBatch(skip map[lustre.Fid]bool, full map[int]bool) []*lustre.Fid {
+	var batch []*lustre.Fid
+	want := len(skip) + d.batchSize
+	for len(batch) < d.batchSize {
+		fids := d.index.Oldest(want)
+		examined := 0
+		for _, fid := range fids {
+			if skip[*fid] {
+				continue
+			}
+			examined++
+			skip[*fid] = true
+			if d.eligible(fid) && d.onTargets(fid, full) {
+				batch = append(batch, fid)
+				if len(batch) == d.batchSize {
+					break
+				}
+			}
+		}
+		if examined == 0 {
+			break
+		}
+		want += d.batchSize
+	}
+	return batch
+}
+
+func (d *Daemon) eligible(fid *lustre.Fid) bool {
+	s, err := d.getStatus(fid)
+	if err != nil {
+		// Most likely removed since it was indexed.
+		debug.Printf("release: %v: %v", fid, err)
+		d.index.Remove(fid)
+		return false
+	}
+	if s.Released() {
+		d.index.Remove(fid)
+		return false
+	}
+	if !s.Archived() || s.Dirty() || s.NoRelease() {
+		d.stats.Skipped++
+		return false
+	}
+	return true
+}
+
+// onTargets returns true if the file has data on any of the OSTs.
+func (d *Daemon) onTargets(fid *lustre.Fid, targets map[int]bool) bool {
+	layout, err := d.getLayout(fid)
+	if err != nil {
+		debug.Printf("release: %v: %v", fid, err)
+		return false
+	}
+	for _, o := range layout.Objects {
+		if targets[o.Index] {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks that each file was released.
+func (d *Daemon) verify(fids []*lustre.Fid) {
+	for _, fid := range fids {
+		s, err := d.getStatus(fid)
+		if err == nil && s.Released() {
+			d.stats.Released++
+			d.index.Remove(fid)
+			continue
+		}
+		d.stats.Failed++
+		if err != nil {
+			alert.Warnf("release: %v: %v", fid, err)
+		} else {
+			alert.Warnf("release: %v: not released (%s)", fid, s)
+		}
+	}
+}
+
+// OSTUsage returns a UsageFunc which reports the usage of the OSTs
+// used by the client. If pool is not empty, only the OSTs in that pool
+// are reported.
+func OSTUsage(c *status.LustreClient, pool string) UsageFunc {
+	return func() ([]*status.TargetUsage, error) {
+		usage, err := c.OSTUsage()
+		if err != nil {
+			return nil, err
+		}
+		if pool == "" {
+			return usage, nil
+		}
+		targets, err := c.PoolTargets(pool)
+		if err != nil {
+			return nil, err
+		}
+		return poolUsage(usage, targets), nil
+	}
+}
+
+// poolUsage returns the usage of the OSTs which are pool members.
+func poolUsage(usage []*status.TargetUsage, members []string) []*status.TargetUsage {
+	inPool := make(map[string]bool)
+	for _, t := range members {
+		inPool[t] = true
+	}
+	var result []*status.TargetUsage
+	for _, u := range usage {
+		if inPool[u.Target] {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// maxUsage returns the fill level of the fullest OST.
+func maxUsage(usage []*status.TargetUsage) float64 {
+	var max float64
+	for _, u := range usage {
+		if f := u.UsedFraction(); f > max {
+			max = f
+		}
+	}
+	return max
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package release
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	// AtimeIndex keeps files ordered by their last access time, so the
+	// least recently used files can be found without scanning the
+	// filesystem. It is maintained from changelog records, and can be
+	// saved so it survives a restart.
+	AtimeIndex struct {
+		mu        sync.Mutex
+		lru       *list.List // front is least recently used
+		entries   map[lustre.Fid]*list.Element
+		lastIndex int64
+	}
+
+	indexEntry struct {
+		fid   lustre.Fid
+		atime time.Time
+	}
+
+	// savedIndex is the header of a saved AtimeIndex, which is
+	// followed by a savedEntry for each file, least recently used
+	// first.
+	savedIndex struct {
+		LastIndex int64 `json:"last_index"`
+		Count     int   `json:"count"`
+	}
+
+	savedEntry struct {
+		Fid   *lustre.Fid `json:"fid"`
+		Atime time.Time   `json:"atime"`
+	}
+)
+
+// NewAtimeIndex returns an empty *AtimeIndex.
+func NewAtimeIndex() *AtimeIndex {
+	return &AtimeIndex{
+		lru:     list.New(),
+		entries: make(map[lustre.Fid]*list.Element),
+	}
+}
+
+// LoadAtimeIndex returns the index saved in the file at path, or an
+// empty index if the file doesn't exist.
+func LoadAtimeIndex(path string) (*AtimeIndex, error) {
+	idx := NewAtimeIndex()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var hdr savedIndex
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, errors.Wrapf(err, "%s: corrupt index", path)
+	}
+	for i := 0; i < hdr.Count; i++ {
+		var se savedEntry
+		if err := dec.Decode(&se); err != nil || se.Fid == nil {
+			return nil, errors.Wrapf(err, "%s: corrupt index entry %d", path, i)
+		}
+		idx.entries[*se.Fid] = idx.lru.PushBack(&indexEntry{fid: *se.Fid, atime: se.Atime})
+	}
+	idx.lastIndex = hdr.LastIndex
+	return idx, nil
+}
+
+// Save writes the index to the file at path, replacing it atomically.
+// It returns the index of the last changelog record applied to the
+// saved index, up to which the changelog may be cleared.
+func (idx *AtimeIndex) Save(path string) (int64, error) {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(bw)
+
+	idx.mu.Lock()
+	lastIndex := idx.lastIndex
+	err = enc.Encode(&savedIndex{LastIndex: lastIndex, Count: idx.lru.Len()})
+	for e := idx.lru.Front(); e != nil && err == nil; e = e.Next() {
+		entry := e.Value.(*indexEntry)
+		fid := entry.fid
+		err = enc.Encode(&savedEntry{Fid: &fid, Atime: entry.atime})
+	}
+	idx.mu.Unlock()
+
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, errors.Wrapf(err, "%s: save index", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return lastIndex, nil
+}
+
+// LastIndex returns the index of the last changelog record applied.
+// Following the changelog should resume after it.
+func (idx *AtimeIndex) LastIndex() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.lastIndex
+}
+
+// Len returns the number of files in the index.
+func (idx *AtimeIndex) Len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.lru.Len()
+}
+
+// Touch records an access of the file at time t. Times earlier than
+// the one already recorded for the file are ignored.
+func (idx *AtimeIndex) Touch(f *lustre.Fid, t time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if e, ok := idx.entries[*f]; ok {
+		entry := e.Value.(*indexEntry)
+		if !t.After(entry.atime) {
+			return
+		}
+		entry.atime = t
+		idx.lru.Remove(e)
+		idx.entries[*f] = idx.insert(entry)
+		return
+	}
+	idx.entries[*f] = idx.insert(&indexEntry{fid: *f, atime: t})
+}
+
+// insert places the entry in atime order. Records usually arrive in
+// time order, so the search starts from the most recent end.
+func (idx *AtimeIndex) insert(entry *indexEntry) *list.Element {
+	for e := idx.lru.Back(); e != nil; e = e.Prev() {
+		if !e.Value.(*indexEntry).atime.After(entry.atime) {
+			return idx.lru.InsertAfter(entry, e)
+		}
+	}
+	return idx.lru.PushFront(entry)
+}
+
+// Remove drops the file from the index.
+func (idx *AtimeIndex) Remove(f *lustre.Fid) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if e, ok := idx.entries[*f]; ok {
+		idx.lru.Remove(e)
+		delete(idx.entries, *f)
+	}
+}
+
+// Oldest returns up to n files, least recently used first.
+func (idx *AtimeIndex) Oldest(n int) []*lustre.Fid {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var fids []*lustre.Fid
+	for e := idx.lru.Front(); e != nil && len(fids) < n; e = e.Next() {
+		f := e.Value.(*indexEntry).fid
+		fids = append(fids, &f)
+	}
+	return fids
+}
+
+// Apply updates the index from a changelog record. Records at or below
+// the last index applied are ignored, as they are already reflected in
+// the index.
+func (idx *AtimeIndex) Apply(rec changelog.Record) {
+	idx.mu.Lock()
+	if rec.Index() <= idx.lastIndex {
+		idx.mu.Unlock()
+		return
+	}
+	idx.lastIndex = rec.Index()
+	idx.mu.Unlock()
+
+	fid := rec.TargetFid()
+	if fid == nil || fid.IsZero() {
+		return
+	}
+
+	switch rec.TypeCode() {
+	case llapi.OpCreate, llapi.OpOpen, llapi.OpClose, llapi.OpTrunc,
+		llapi.OpMtime, llapi.OpAtime:
+		idx.Touch(fid, rec.Time())
+	case llapi.OpUnlink:
+		if last, _ := rec.IsLastUnlink(); last {
+			idx.Remove(fid)
+		}
+	case llapi.OpRename:
+		// A rename over an existing file removes the target.
+		if last, _ := rec.IsLastRename(); last {
+			idx.Remove(fid)
+		}
+	case llapi.OpHSM:
+		event, ok := rec.HsmEvent()
+		if !ok || rec.HsmError() != 0 {
+			return
+		}
+		switch event {
+		case llapi.HsmEventRelease:
+			// Released files have no data left to release.
+			idx.Remove(fid)
+		case llapi.HsmEventRestore:
+			idx.Touch(fid, rec.Time())
+		}
+	}
+}
+
+// Follow applies records to the index until ctx is done. When the
+// records are exhausted, it waits for interval before trying again.
+func (idx *AtimeIndex) Follow(ctx context.Context, records changelog.RecordIterator, interval time.Duration) error {
+	for {
+		rec, err := records.NextRecord()
+		switch {
+		case err == io.EOF:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+			continue
+		case err != nil:
+			return err
+		}
+		idx.Apply(rec)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
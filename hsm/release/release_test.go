@@ -0,0 +1,347 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package release
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/changelog/simulator"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/status"
+)
+
+func oids(fids []*lustre.Fid) []uint32 {
+	var result []uint32
+	for _, f := range fids {
+		result = append(result, f.Oid)
+	}
+	return result
+}
+
+func equalOids(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAtimeIndex(t *testing.T) {
+	base := time.Now()
+	at := func(sec int) simulator.RecordOption {
+		return simulator.OptRecordTime(base.Add(time.Duration(sec) * time.Second))
+	}
+	fid := simulator.TestFid
+
+	idx := NewAtimeIndex()
+	for _, rec := range []changelog.Record{
+		simulator.NewTestRecord(1, llapi.OpCreate, fid(1), at(0)),
+		simulator.NewTestRecord(2, llapi.OpCreate, fid(2), at(1)),
+		simulator.NewTestRecord(3, llapi.OpCreate, fid(3), at(2)),
+		simulator.NewTestRecord(4, llapi.OpCreate, fid(4), at(3)),
+		simulator.NewTestRecord(5, llapi.OpCreate, fid(5), at(4)),
+		// 1 is accessed again, so it is now the most recent.
+		simulator.NewTestRecord(6, llapi.OpAtime, fid(1), at(5)),
+		// A late record for 4 arrives out of order.
+		simulator.NewTestRecord(7, llapi.OpClose, fid(4), at(2)),
+		simulator.NewTestRecord(8, llapi.OpClose, fid(6), at(1)),
+		// Not the last link, so 3 stays.
+		simulator.NewTestRecord(9, llapi.OpUnlink, fid(3), at(6)),
+		simulator.NewTestRecord(10, llapi.OpUnlink, fid(2), at(6), simulator.OptRecordLast(false)),
+		simulator.NewTestRecord(11, llapi.OpHSM, fid(5), at(7), simulator.OptRecordHsmEvent(llapi.HsmEventRelease, 0)),
+		// A failed release leaves the file in the index.
+		simulator.NewTestRecord(12, llapi.OpHSM, fid(3), at(7), simulator.OptRecordHsmEvent(llapi.HsmEventRelease, 1)),
+	} {
+		idx.Apply(rec)
+	}
+
+	got := oids(idx.Oldest(10))
+	want := []uint32{6, 3, 4, 1}
+	if !equalOids(got, want) {
+		t.Fatalf("Oldest() = %v, want %v", got, want)
+	}
+	if got := oids(idx.Oldest(2)); !equalOids(got, want[:2]) {
+		t.Fatalf("Oldest(2) = %v, want %v", got, want[:2])
+	}
+
+	idx.Apply(simulator.NewTestRecord(13, llapi.OpHSM, fid(5), at(8), simulator.OptRecordHsmEvent(llapi.HsmEventRestore, 0)))
+	idx.Apply(simulator.NewTestRecord(14, llapi.OpRename, fid(6), at(9), simulator.OptRecordLast(false)))
+	want = []uint32{3, 4, 1, 5}
+	if got := oids(idx.Oldest(10)); !equalOids(got, want) {
+		t.Fatalf("Oldest() = %v, want %v", got, want)
+	}
+
+	// Records already applied are ignored.
+	idx.Apply(simulator.NewTestRecord(14, llapi.OpAtime, fid(3), at(10)))
+	if got := oids(idx.Oldest(10)); !equalOids(got, want) {
+		t.Fatalf("Oldest() = %v after replayed record, want %v", got, want)
+	}
+}
+
+func TestAtimeIndexSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	idx, err := LoadAtimeIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len() != 0 || idx.LastIndex() != 0 {
+		t.Fatalf("new index has %d files, last index %d", idx.Len(), idx.LastIndex())
+	}
+
+	base := time.Now()
+	for i, n := range []uint32{3, 1, 2} {
+		idx.Apply(simulator.NewTestRecord(int64(i+10), llapi.OpCreate, simulator.TestFid(n),
+			simulator.OptRecordTime(base.Add(time.Duration(i)*time.Second))))
+	}
+	saved, err := idx.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 12 {
+		t.Fatalf("Save() = %d, want 12", saved)
+	}
+
+	idx, err = LoadAtimeIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.LastIndex() != 12 {
+		t.Fatalf("LastIndex() = %d after load, want 12", idx.LastIndex())
+	}
+	want := []uint32{3, 1, 2}
+	if got := oids(idx.Oldest(10)); !equalOids(got, want) {
+		t.Fatalf("Oldest() = %v after load, want %v", got, want)
+	}
+	idx.Touch(simulator.TestFid(3), base.Add(time.Minute))
+	if got := oids(idx.Oldest(1)); !equalOids(got, []uint32{1}) {
+		t.Fatalf("Oldest(1) = %v after touch, want [1]", got)
+	}
+}
+
+// testFS is a filesystem of OSTs of 100 KB each.
+type testFS struct {
+	size     map[lustre.Fid]uint64
+	ost      map[lustre.Fid]int
+	state    map[lustre.Fid]llapi.HsmStateFlag
+	used     []uint64
+	requests int
+}
+
+func newTestFS(osts int) *testFS {
+	return &testFS{
+		size:  make(map[lustre.Fid]uint64),
+		ost:   make(map[lustre.Fid]int),
+		state: make(map[lustre.Fid]llapi.HsmStateFlag),
+		used:  make([]uint64, osts),
+	}
+}
+
+// add adds a file of size KB on an OST.
+func (tfs *testFS) add(idx *AtimeIndex, n uint32, ost int, size uint64, state llapi.HsmStateFlag) {
+	f := simulator.TestFid(n)
+	tfs.size[*f] = size
+	tfs.ost[*f] = ost
+	tfs.state[*f] = state
+	tfs.used[ost] += size
+	idx.Touch(f, time.Unix(int64(n), 0))
+}
+
+func (tfs *testFS) released(n uint32) bool {
+	return tfs.state[*simulator.TestFid(n)]&llapi.HsmFileReleased != 0
+}
+
+func newTestDaemon(t *testing.T, idx *AtimeIndex, tfs *testFS, options ...DaemonOption) *Daemon {
+	usage := func() ([]*status.TargetUsage, error) {
+		var usage []*status.TargetUsage
+		for i, used := range tfs.used {
+			usage = append(usage, &status.TargetUsage{
+				Target:      fmt.Sprintf("fs-OST%04x", i),
+				KBytesTotal: 100,
+				KBytesFree:  100 - used,
+			})
+		}
+		return usage, nil
+	}
+	d, err := NewDaemon(fs.RootDir{}, idx, usage, 0.9, 0.5, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.getStatus = func(fid *lustre.Fid) (*hsm.FileStatus, error) {
+		return hsm.NewFileStatus(llapi.HsmFileState(tfs.state[*fid]), 1), nil
+	}
+	d.getLayout = func(fid *lustre.Fid) (*llapi.DataLayout, error) {
+		return &llapi.DataLayout{Objects: []llapi.OstData{{Index: tfs.ost[*fid]}}}, nil
+	}
+	d.release = func(fids []*lustre.Fid) error {
+		tfs.requests++
+		for _, fid := range fids {
+			tfs.state[*fid] |= llapi.HsmFileReleased
+			tfs.used[tfs.ost[*fid]] -= tfs.size[*fid]
+		}
+		return nil
+	}
+	return d
+}
+
+const (
+	archived  = llapi.HsmFileExists | llapi.HsmFileArchived
+	dirty     = archived | llapi.HsmFileDirty
+	noRelease = archived | llapi.HsmFileNoRelease
+)
+
+func TestDaemonCheck(t *testing.T) {
+	idx := NewAtimeIndex()
+	tfs := newTestFS(1)
+	tfs.add(idx, 1, 0, 10, dirty)
+	tfs.add(idx, 2, 0, 10, archived)
+	tfs.add(idx, 3, 0, 10, 0)
+	tfs.add(idx, 4, 0, 10, noRelease)
+	tfs.add(idx, 5, 0, 10, archived)
+	tfs.add(idx, 6, 0, 10, archived)
+	tfs.add(idx, 7, 0, 10, archived)
+	tfs.add(idx, 8, 0, 10, archived)
+	tfs.add(idx, 9, 0, 5, archived)
+
+	d := newTestDaemon(t, idx, tfs, OptDaemonBatchSize(2))
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 85% is below the high watermark, so nothing happens.
+	if tfs.requests != 0 {
+		t.Fatalf("got %d requests below high watermark", tfs.requests)
+	}
+
+	tfs.add(idx, 10, 0, 10, archived)
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for n, wantReleased := range map[uint32]bool{
+		1: false, 2: true, 3: false, 4: false, 5: true,
+		6: true, 7: true, 8: true, 9: true, 10: false,
+	} {
+		if released := tfs.released(n); released != wantReleased {
+			t.Errorf("file %d released: %v, want %v", n, released, wantReleased)
+		}
+	}
+	if tfs.used[0] > 50 {
+		t.Errorf("usage %d%% above low watermark", tfs.used[0])
+	}
+	if tfs.requests != 3 {
+		t.Errorf("got %d requests, want 3", tfs.requests)
+	}
+	stats := d.Stats()
+	if stats.Released != 6 || stats.Failed != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if got := oids(idx.Oldest(1)); !equalOids(got, []uint32{1}) {
+		t.Errorf("Oldest(1) = %v, want [1]", got)
+	}
+
+	// Not enough eligible files left to reach the low watermark.
+	for n := 1; n <= 8; n++ {
+		tfs.add(idx, uint32(20+n), 0, 10, dirty)
+	}
+	if err := d.Check(context.Background()); err == nil {
+		t.Error("expected error when candidates are exhausted")
+	}
+}
+
+func TestDaemonFullOST(t *testing.T) {
+	idx := NewAtimeIndex()
+	tfs := newTestFS(2)
+	// The least recently used files are on the OST with space.
+	for n := uint32(1); n <= 4; n++ {
+		tfs.add(idx, n, 1, 10, archived)
+	}
+	for n := uint32(5); n <= 9; n++ {
+		tfs.add(idx, n, 0, 19, archived)
+	}
+
+	d := newTestDaemon(t, idx, tfs, OptDaemonBatchSize(1))
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for n := uint32(1); n <= 4; n++ {
+		if tfs.released(n) {
+			t.Errorf("file %d on OST0001 released", n)
+		}
+	}
+	// Releasing 3 files brings OST0000 from 95% down to 38%.
+	if tfs.used[0] != 38 || tfs.requests != 3 {
+		t.Errorf("OST0000 at %d%% after %d requests, want 38%% after 3", tfs.used[0], tfs.requests)
+	}
+
+	// Files on other OSTs don't count towards releasing space on a full
+	// OST.
+	for n := uint32(5); n <= 9; n++ {
+		tfs.state[*simulator.TestFid(n)] = dirty
+	}
+	tfs.used[0] = 95
+	if err := d.Check(context.Background()); err == nil {
+		t.Error("expected error with no candidates on the full OST")
+	}
+	for n := uint32(1); n <= 4; n++ {
+		if tfs.released(n) {
+			t.Errorf("file %d on OST0001 released", n)
+		}
+	}
+}
+
+func TestNewDaemonWatermarks(t *testing.T) {
+	usage := func() ([]*status.TargetUsage, error) { return nil, nil }
+	for _, w := range [][2]float64{{0.5, 0.9}, {0.8, 0.8}, {1.1, 0.5}, {0.9, -0.1}} {
+		if _, err := NewDaemon(fs.RootDir{}, NewAtimeIndex(), usage, w[0], w[1]); err == nil {
+			t.Errorf("expected error for high %v, low %v", w[0], w[1])
+		}
+	}
+}
+
+func TestMaxUsage(t *testing.T) {
+	usage := []*status.TargetUsage{
+		{Target: "fs-OST0000", KBytesTotal: 100, KBytesFree: 50},
+		{Target: "fs-OST0001", KBytesTotal: 100, KBytesFree: 10},
+		{Target: "fs-OST0002", KBytesTotal: 100, KBytesFree: 30},
+	}
+	if got := maxUsage(usage); got != 0.9 {
+		t.Errorf("maxUsage() = %v, want 0.9", got)
+	}
+	pool := poolUsage(usage, []string{"fs-OST0000", "fs-OST0002"})
+	if got := maxUsage(pool); got != 0.7 {
+		t.Errorf("maxUsage(pool) = %v, want 0.7", got)
+	}
+
+	d := &Daemon{low: 0.6}
+	if full := d.fullTargets(usage); len(full) != 2 || !full[1] || !full[2] {
+		t.Errorf("fullTargets() = %v, want OSTs 1 and 2", full)
+	}
+	if idx, err := ostIndex("fs-OST001a"); err != nil || idx != 26 {
+		t.Errorf("ostIndex() = %d, %v, want 26", idx, err)
+	}
+	if _, err := ostIndex("fs-MDT0000"); err == nil {
+		t.Error("expected error for an MDT")
+	}
+}
@@ -5,9 +5,13 @@
 package hsm
 
 import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
 	"github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/go-lustre/fs"
 	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/debug"
 )
 
 // RequestArchive submits a request to the coordinator for the
@@ -41,8 +45,163 @@ func RequestCancel(root fs.RootDir, archiveID uint, fids []*lustre.Fid) error {
 }
 
 func hsmRequest(root fs.RootDir, cmd llapi.HsmUserAction, archiveID uint, fids []*lustre.Fid) error {
-	if _, err := llapi.HsmRequest(root.Path(), cmd, archiveID, fids); err != nil {
-		return err
+	r := NewRequest(cmd)
+	for _, f := range fids {
+		r.AddFile(f, archiveID)
+	}
+	_, err := r.Submit(root)
+	return err
+}
+
+type (
+	// Request builds an HSM request with per-file extents, flags and
+	// opaque data for the copytool. Files for different archive IDs
+	// are submitted as separate requests.
+	Request struct {
+		action    llapi.HsmUserAction
+		flags     llapi.HsmRequestFlag
+		data      []byte
+		batchSize int
+		// goodBatch is the largest batch accepted, and maxBatch is
+		// the largest batch that may be tried.
+		goodBatch int
+		maxBatch  int
+		archives  []uint
+		items     map[uint][]llapi.HsmUserItem
+	}
+
+	// requestSender submits one batch of a request.
+	requestSender func(archiveID uint, items []llapi.HsmUserItem) error
+)
+
+// maxRequestBatchSize is the most files sent in one request.
+const maxRequestBatchSize = 1000
+
+// NewRequest returns an empty Request for the action.
+func NewRequest(action llapi.HsmUserAction) *Request {
+	return &Request{
+		action:    action,
+		batchSize: llapi.MaxBatchSize,
+		maxBatch:  maxRequestBatchSize,
+		items:     make(map[uint][]llapi.HsmUserItem),
+	}
+}
+
+// AddFile adds the whole file to the request.
+func (r *Request) AddFile(f *lustre.Fid, archiveID uint) *Request {
+	return r.AddExtent(f, archiveID, 0, lustre.MaxExtentLength)
+}
+
+// AddExtent adds part of a file to the request. A length of
+// lustre.MaxExtentLength extends to the end of the file.
+func (r *Request) AddExtent(f *lustre.Fid, archiveID uint, offset, length int64) *Request {
+	if _, ok := r.items[archiveID]; !ok {
+		r.archives = append(r.archives, archiveID)
+	}
+	r.items[archiveID] = append(r.items[archiveID], llapi.HsmUserItem{
+		Fid:    f,
+		Extent: llapi.HsmExtent{Offset: offset, Length: length},
+	})
+	return r
+}
+
+// SetFlags sets the request flags, such as llapi.HsmForceAction.
+func (r *Request) SetFlags(flags llapi.HsmRequestFlag) *Request {
+	r.flags = flags
+	return r
+}
+
+// SetData sets opaque data that is passed to the copytool with each
+// action, and is available from ActionHandle.Data().
+func (r *Request) SetData(data []byte) *Request {
+	r.data = data
+	return r
+}
+
+// SetBatchSize sets the initial number of files sent in each request.
+// The batch size is reduced automatically if the kernel rejects a
+// request as too large, and increased while requests are accepted.
+func (r *Request) SetBatchSize(size int) *Request {
+	if size > 0 {
+		r.batchSize = size
+	}
+	return r
+}
+
+// Len returns the number of files in the request.
+func (r *Request) Len() int {
+	var count int
+	for _, items := range r.items {
+		count += len(items)
+	}
+	return count
+}
+
+// Submit sends the request to the coordinator for the filesystem, and
+// returns the number of files successfully submitted.
+func (r *Request) Submit(root fs.RootDir) (int, error) {
+	return r.submit(func(archiveID uint, items []llapi.HsmUserItem) error {
+		return llapi.HsmRequestItems(root.Path(), r.action, archiveID, r.flags, items, r.data)
+	})
+}
+
+func (r *Request) submit(send requestSender) (int, error) {
+	if r.Len() == 0 {
+		return 0, errors.New("request must include at least 1 file")
+	}
+
+	var sent int
+	for _, archiveID := range r.archives {
+		items := r.items[archiveID]
+		for len(items) > 0 {
+			batch := items
+			if len(batch) > r.batchSize {
+				batch = batch[:r.batchSize]
+			}
+
+			err := send(archiveID, batch)
+			if err == unix.E2BIG && len(batch) > 1 {
+				r.rejected(len(batch))
+				debug.Printf("request too large, reducing batch size to %d", r.batchSize)
+				continue
+			}
+			if err != nil {
+				return sent, errors.Wrapf(err, "%s request for archive %d", r.action, archiveID)
+			}
+			if len(batch) == r.batchSize {
+				r.accepted(len(batch))
+			}
+			sent += len(batch)
+			items = items[len(batch):]
+		}
+	}
+	return sent, nil
+}
+
+// rejected reduces the batch size after a batch of size files was
+// rejected as too large, back to the largest batch accepted if that is
+// smaller.
+func (r *Request) rejected(size int) {
+	r.maxBatch = size - 1
+	if r.goodBatch > 0 && r.goodBatch < size {
+		r.batchSize = r.goodBatch
+	} else {
+		r.batchSize = size / 2
+	}
+}
+
+// accepted increases the batch size after a full batch of size files
+// was accepted. It doubles until a batch is rejected, and then moves
+// halfway towards the smallest batch rejected.
+func (r *Request) accepted(size int) {
+	if size > r.goodBatch {
+		r.goodBatch = size
+	}
+	next := (size + r.maxBatch + 1) / 2
+	if next > 2*size {
+		next = 2 * size
+	}
+	if next > size {
+		r.batchSize = next
 	}
-	return nil
 }
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+func TestRequestSplitsArchives(t *testing.T) {
+	r := NewRequest(llapi.HsmUserArchive)
+	for i := uint32(1); i <= 6; i++ {
+		r.AddFile(&lustre.Fid{Seq: 1, Oid: i}, uint(i%2+1))
+	}
+	r.AddExtent(&lustre.Fid{Seq: 1, Oid: 7}, 2, 100, 200)
+
+	sent := make(map[uint][]llapi.HsmUserItem)
+	count, err := r.submit(func(archiveID uint, items []llapi.HsmUserItem) error {
+		sent[archiveID] = append(sent[archiveID], items...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 7 {
+		t.Fatalf("sent %d items, expected 7", count)
+	}
+	if len(sent[1]) != 3 || len(sent[2]) != 4 {
+		t.Fatalf("unexpected split: %d for archive 1, %d for archive 2", len(sent[1]), len(sent[2]))
+	}
+	last := sent[2][3]
+	if last.Extent.Offset != 100 || last.Extent.Length != 200 {
+		t.Fatalf("unexpected extent %s", last.Extent)
+	}
+}
+
+func TestRequestAdaptiveBatch(t *testing.T) {
+	const maxItems = 3
+
+	r := NewRequest(llapi.HsmUserRestore).SetBatchSize(16)
+	for i := uint32(0); i < 20; i++ {
+		r.AddFile(&lustre.Fid{Seq: 1, Oid: i}, 1)
+	}
+
+	var batches int
+	count, err := r.submit(func(archiveID uint, items []llapi.HsmUserItem) error {
+		if len(items) > maxItems {
+			return unix.E2BIG
+		}
+		batches++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 20 {
+		t.Fatalf("sent %d items, expected 20", count)
+	}
+	if r.batchSize > maxItems {
+		t.Fatalf("batch size %d not reduced", r.batchSize)
+	}
+	// Batches of 2 and then 3, once the batch size grows back.
+	if batches != 7 {
+		t.Fatalf("sent %d batches, expected 7", batches)
+	}
+}
+
+func TestRequestBatchGrows(t *testing.T) {
+	var tests = []struct {
+		maxItems int
+		expected int
+	}{
+		// Grows back to the largest batch accepted after a batch
+		// is rejected.
+		{maxItems: 30, expected: 30},
+		// Grows beyond the initial size while batches are accepted.
+		{maxItems: maxRequestBatchSize, expected: 4 * llapi.MaxBatchSize},
+	}
+
+	for _, tc := range tests {
+		r := NewRequest(llapi.HsmUserArchive)
+		for i := uint32(0); i < 500; i++ {
+			r.AddFile(&lustre.Fid{Seq: 1, Oid: i}, 1)
+		}
+
+		var largest int
+		count, err := r.submit(func(archiveID uint, items []llapi.HsmUserItem) error {
+			if len(items) > tc.maxItems {
+				return unix.E2BIG
+			}
+			if len(items) > largest {
+				largest = len(items)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 500 {
+			t.Fatalf("sent %d items, expected 500", count)
+		}
+		if largest != tc.expected {
+			t.Fatalf("limit %d: largest batch was %d, expected %d", tc.maxItems, largest, tc.expected)
+		}
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	r := NewRequest(llapi.HsmUserArchive)
+	r.AddFile(&lustre.Fid{Seq: 1, Oid: 1}, 1)
+
+	_, err := r.submit(func(uint, []llapi.HsmUserItem) error {
+		return unix.E2BIG
+	})
+	if err == nil {
+		t.Fatal("expected error for single item rejected as too large")
+	}
+}
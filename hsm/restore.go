@@ -0,0 +1,212 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	// RestoreResult is the result of restoring a file. Restored is
+	// true if the file was released and has been restored, and false
+	// if the file was already resident. Err is a *FileError if the
+	// file could not be restored.
+	RestoreResult struct {
+		Path     string
+		Restored bool
+		Err      error
+	}
+
+	// Restorer restores released files and waits for them to become
+	// readable. The zero value is ready to use.
+	Restorer struct {
+		// PollInterval is how often file state is checked. The
+		// default is one second.
+		PollInterval time.Duration
+
+		// Progress, if set, is called when the number of bytes
+		// restored for a file changes.
+		Progress func(path string, bytesCopied int64)
+
+		// Hooks to replace the Lustre calls in tests.
+		getStatus func(string) (*FileStatus, error)
+		getAction func(string) (*CurrentFileAction, error)
+		lookupFid func(string) (*lustre.Fid, error)
+		request   func(fs.RootDir, uint, []*lustre.Fid) error
+	}
+
+	restoreFile struct {
+		result *RestoreResult
+		fid    *lustre.Fid
+		copied int64
+		idle   int
+	}
+)
+
+const defaultRestorePollInterval = time.Second
+
+// RestoreAndWait restores any of the files that are released, and
+// waits until they are all readable or ctx is done. It returns a result
+// for each path, in the same order.
+func RestoreAndWait(ctx context.Context, root fs.RootDir, paths ...string) []*RestoreResult {
+	var r Restorer
+	return r.RestoreAndWait(ctx, root, paths...)
+}
+
+func (r *Restorer) init() {
+	if r.PollInterval == 0 {
+		r.PollInterval = defaultRestorePollInterval
+	}
+	if r.getStatus == nil {
+		r.getStatus = GetFileStatus
+	}
+	if r.getAction == nil {
+		r.getAction = GetFileAction
+	}
+	if r.lookupFid == nil {
+		r.lookupFid = fs.LookupFid
+	}
+	if r.request == nil {
+		r.request = RequestRestore
+	}
+}
+
+func (rf *restoreFile) fail(err error) {
+	rf.result.Err = &FileError{Path: rf.result.Path, Err: err}
+}
+
+// RestoreAndWait restores any of the files that are released, and
+// waits until they are all readable or ctx is done. It returns a result
+// for each path, in the same order.
+func (r *Restorer) RestoreAndWait(ctx context.Context, root fs.RootDir, paths ...string) []*RestoreResult {
+	r.init()
+
+	results := make([]*RestoreResult, len(paths))
+	var pending []*restoreFile
+	byArchive := make(map[uint][]*restoreFile)
+	var archives []uint
+
+	for i, path := range paths {
+		results[i] = &RestoreResult{Path: path}
+		rf := &restoreFile{result: results[i]}
+
+		st, err := r.getStatus(path)
+		if err != nil {
+			rf.fail(err)
+			continue
+		}
+		if !st.Released() {
+			continue
+		}
+		if st.Lost() {
+			rf.fail(ErrLost)
+			continue
+		}
+		rf.fid, err = r.lookupFid(path)
+		if err != nil {
+			rf.fail(err)
+			continue
+		}
+
+		archiveID := uint(st.ArchiveID)
+		if _, ok := byArchive[archiveID]; !ok {
+			archives = append(archives, archiveID)
+		}
+		byArchive[archiveID] = append(byArchive[archiveID], rf)
+	}
+
+	for _, archiveID := range archives {
+		files := byArchive[archiveID]
+		fids := make([]*lustre.Fid, len(files))
+		for i, rf := range files {
+			fids[i] = rf.fid
+		}
+		if err := r.request(root, archiveID, fids); err != nil {
+			for _, rf := range files {
+				rf.fail(err)
+			}
+			continue
+		}
+		pending = append(pending, files...)
+	}
+
+	r.wait(ctx, pending)
+	return results
+}
+
+// wait polls the files until they are no longer released.
+func (r *Restorer) wait(ctx context.Context, pending []*restoreFile) {
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+
+	for len(pending) > 0 {
+		var remaining []*restoreFile
+		for _, rf := range pending {
+			if !r.check(rf) {
+				remaining = append(remaining, rf)
+			}
+		}
+		pending = remaining
+		if len(pending) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, rf := range pending {
+				rf.fail(ctx.Err())
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check updates the result for the file and returns true if the restore
+// has finished.
+func (r *Restorer) check(rf *restoreFile) bool {
+	path := rf.result.Path
+
+	cfa, err := r.getAction(path)
+	if err != nil {
+		rf.fail(err)
+		return true
+	}
+	if cfa.action == llapi.HsmUserRestore && cfa.BytesCopied != rf.copied {
+		rf.copied = cfa.BytesCopied
+		if r.Progress != nil {
+			r.Progress(path, rf.copied)
+		}
+	}
+
+	st, err := r.getStatus(path)
+	switch {
+	case err != nil:
+		rf.fail(err)
+		return true
+	case !st.Released():
+		rf.result.Restored = true
+		return true
+	case st.Lost():
+		rf.fail(ErrLost)
+		return true
+	case inProgress(cfa):
+		rf.idle = 0
+		return false
+	}
+
+	rf.idle++
+	if rf.idle >= defaultIdlePolls {
+		rf.fail(ErrActionFailed)
+		return true
+	}
+	return false
+}
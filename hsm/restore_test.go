@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+// fakeFiles simulates the HSM state of files for a Restorer. Restores
+// requested for a file complete after a number of polls.
+type fakeFiles struct {
+	state    map[string]llapi.HsmStateFlag
+	polls    map[string]int
+	restored map[string]bool
+}
+
+func newFakeFiles() *fakeFiles {
+	return &fakeFiles{
+		state:    make(map[string]llapi.HsmStateFlag),
+		polls:    make(map[string]int),
+		restored: make(map[string]bool),
+	}
+}
+
+func (ff *fakeFiles) restorer() *Restorer {
+	names := make(map[lustre.Fid]string)
+	return &Restorer{
+		PollInterval: time.Millisecond,
+		getStatus: func(path string) (*FileStatus, error) {
+			state, ok := ff.state[path]
+			if !ok {
+				return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOENT}
+			}
+			return &FileStatus{ArchiveID: 1, state: llapi.HsmFileState(state)}, nil
+		},
+		getAction: func(path string) (*CurrentFileAction, error) {
+			if !ff.restored[path] {
+				return &CurrentFileAction{action: llapi.HsmUserNone}, nil
+			}
+			ff.polls[path]++
+			if ff.polls[path] < 3 {
+				return &CurrentFileAction{
+					action:      llapi.HsmUserRestore,
+					state:       llapi.HsmProgressRunning,
+					BytesCopied: int64(ff.polls[path] * 100),
+				}, nil
+			}
+			ff.state[path] &^= llapi.HsmFileReleased
+			return &CurrentFileAction{action: llapi.HsmUserNone}, nil
+		},
+		lookupFid: func(path string) (*lustre.Fid, error) {
+			fid := &lustre.Fid{Seq: 1, Oid: uint32(len(names) + 1)}
+			names[*fid] = path
+			return fid, nil
+		},
+		request: func(root fs.RootDir, archiveID uint, fids []*lustre.Fid) error {
+			for _, f := range fids {
+				path := names[*f]
+				if path != "stuck" {
+					ff.restored[path] = true
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func TestRestoreAndWait(t *testing.T) {
+	released := llapi.HsmFileExists | llapi.HsmFileArchived | llapi.HsmFileReleased
+	ff := newFakeFiles()
+	ff.state["resident"] = llapi.HsmFileExists | llapi.HsmFileArchived
+	ff.state["released"] = released
+	ff.state["lost"] = released | llapi.HsmFileLost
+	ff.state["stuck"] = released
+
+	r := ff.restorer()
+	var progress []int64
+	r.Progress = func(path string, copied int64) {
+		progress = append(progress, copied)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	paths := []string{"resident", "released", "lost", "stuck", "missing"}
+	results := r.RestoreAndWait(ctx, fs.RootDir{}, paths...)
+
+	for i, res := range results {
+		if res.Path != paths[i] {
+			t.Fatalf("result %d is for %s, expected %s", i, res.Path, paths[i])
+		}
+	}
+	if res := results[0]; res.Err != nil || res.Restored {
+		t.Fatalf("resident: unexpected result %+v", res)
+	}
+	if res := results[1]; res.Err != nil || !res.Restored {
+		t.Fatalf("released: unexpected result %+v", res)
+	}
+	if err := results[2].Err; errors.Cause(err) != ErrLost {
+		t.Fatalf("lost: expected ErrLost, got %v", err)
+	}
+	if err := results[3].Err; errors.Cause(err) != ErrActionFailed {
+		t.Fatalf("stuck: expected ErrActionFailed, got %v", err)
+	}
+	if _, ok := results[4].Err.(*FileError); !ok {
+		t.Fatalf("missing: expected *FileError, got %v", results[4].Err)
+	}
+	if len(progress) != 2 || progress[1] != 200 {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+}
+
+func TestRestoreAndWaitTimeout(t *testing.T) {
+	ff := newFakeFiles()
+	ff.state["file"] = llapi.HsmFileExists | llapi.HsmFileArchived | llapi.HsmFileReleased
+
+	r := ff.restorer()
+	r.getAction = func(string) (*CurrentFileAction, error) {
+		return &CurrentFileAction{action: llapi.HsmUserRestore, state: llapi.HsmProgressWaiting}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	results := r.RestoreAndWait(ctx, fs.RootDir{}, "file")
+	if err := results[0].Err; errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// ArchiveLimits restricts the actions run for an archive ID. A
+	// zero value means no limit.
+	ArchiveLimits struct {
+		// Concurrency is the number of actions run at once.
+		Concurrency int
+		// Bandwidth is the rate data is copied, in bytes per
+		// second, shared by all running actions.
+		Bandwidth int64
+	}
+
+	// RestoreOrderer is implemented by a Backend that can order queued
+	// restores for faster retrieval, for example by tape and position
+	// on tape. OrderRestores sorts the restores in place, and the
+	// first is started next. It is called with the scheduler locked,
+	// so it must not block.
+	RestoreOrderer interface {
+		OrderRestores(restores []ActionRequest)
+	}
+
+	// QueueDepth is the number of actions queued and running for an
+	// archive ID.
+	QueueDepth struct {
+		ArchiveID uint
+		Restores  int
+		// Other counts the queued archive and remove actions.
+		Other   int
+		Running int
+	}
+
+	// scheduler queues actions for the Copytool's workers. Restores
+	// are started before other actions, archive IDs take turns, and
+	// the limits of each archive ID are enforced.
+	scheduler struct {
+		mu       sync.Mutex
+		cond     *sync.Cond
+		queues   map[uint]*archiveQueue
+		ids      []uint // archive IDs in the order they take turns
+		turn     int
+		closed   bool
+		draining bool
+
+		limits  map[uint]ArchiveLimits
+		orderer func(archiveID uint) RestoreOrderer
+	}
+
+	archiveQueue struct {
+		id       uint
+		limits   ArchiveLimits
+		limiter  *rateLimiter
+		restores []*pendingAction
+		other    []*pendingAction
+		running  int
+		// ordered is false if restores were queued since they were
+		// last ordered.
+		ordered bool
+	}
+
+	// rateLimiter is a token bucket shared by the actions of an
+	// archive ID.
+	rateLimiter struct {
+		mu     sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+
+	rateLimiterKey struct{}
+)
+
+func newScheduler(limits map[uint]ArchiveLimits, orderer func(uint) RestoreOrderer) *scheduler {
+	s := &scheduler{
+		queues:  make(map[uint]*archiveQueue),
+		limits:  limits,
+		orderer: orderer,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// queue returns the queue for the archive ID, creating it if needed.
+// The caller must hold s.mu.
+func (s *scheduler) queue(id uint) *archiveQueue {
+	q, ok := s.queues[id]
+	if !ok {
+		q = &archiveQueue{id: id, limits: s.limits[id]}
+		if q.limits.Bandwidth > 0 {
+			q.limiter = newRateLimiter(q.limits.Bandwidth)
+		}
+		s.queues[id] = q
+		s.ids = append(s.ids, id)
+	}
+	return q
+}
+
+// push queues an action. Its context carries the archive's bandwidth
+// limit, if any.
+func (s *scheduler) push(pa *pendingAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(pa.ArchiveID())
+	if q.limiter != nil {
+		pa.ctx = context.WithValue(pa.ctx, rateLimiterKey{}, q.limiter)
+	}
+	if pa.Action() == RESTORE {
+		q.restores = append(q.restores, pa)
+		q.ordered = false
+	} else {
+		q.other = append(q.other, pa)
+	}
+	s.cond.Signal()
+}
+
+// pop blocks until an action may be started, and returns false once
+// the scheduler is closed and empty.
+func (s *scheduler) pop() (*pendingAction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if pa := s.take(); pa != nil {
+			return pa, true
+		}
+		if s.closed && s.empty() {
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+}
+
+// take returns the next action to start, or nil if none can be started.
+// The caller must hold s.mu.
+func (s *scheduler) take() *pendingAction {
+	for _, restores := range []bool{true, false} {
+		for i := range s.ids {
+			q := s.queues[s.ids[(s.turn+i)%len(s.ids)]]
+			if !s.draining && q.limits.Concurrency > 0 && q.running >= q.limits.Concurrency {
+				continue
+			}
+			var pa *pendingAction
+			if restores {
+				pa = s.takeRestore(q)
+			} else if len(q.other) > 0 {
+				pa, q.other = q.other[0], q.other[1:]
+			}
+			if pa != nil {
+				q.running++
+				s.turn = (s.turn + i + 1) % len(s.ids)
+				return pa
+			}
+		}
+	}
+	return nil
+}
+
+// takeRestore returns the first restore in the queue, ordering the
+// queue first if the backend supports it.
+func (s *scheduler) takeRestore(q *archiveQueue) *pendingAction {
+	if len(q.restores) == 0 {
+		return nil
+	}
+	if !q.ordered && len(q.restores) > 1 {
+		if o := s.orderer(q.id); o != nil {
+			ars := make([]ActionRequest, len(q.restores))
+			for i, pa := range q.restores {
+				ars[i] = pa
+			}
+			o.OrderRestores(ars)
+			for i, ar := range ars {
+				q.restores[i] = ar.(*pendingAction)
+			}
+		}
+	}
+	q.ordered = true
+	pa := q.restores[0]
+	q.restores = q.restores[1:]
+	return pa
+}
+
+func (s *scheduler) empty() bool {
+	for _, q := range s.queues {
+		if len(q.restores) > 0 || len(q.other) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// done releases the slot of a finished action.
+func (s *scheduler) done(pa *pendingAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue(pa.ArchiveID()).running--
+	s.cond.Broadcast()
+}
+
+// drain lifts the concurrency limits, so queued actions can be failed
+// quickly while the copytool shuts down.
+func (s *scheduler) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	s.cond.Broadcast()
+}
+
+// close stops pop from blocking once the queues are empty.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func (s *scheduler) depths() []QueueDepth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	depths := make([]QueueDepth, 0, len(s.queues))
+	for _, q := range s.queues {
+		depths = append(depths, QueueDepth{
+			ArchiveID: q.id,
+			Restores:  len(q.restores),
+			Other:     len(q.other),
+			Running:   q.running,
+		})
+	}
+	sort.Slice(depths, func(i, j int) bool { return depths[i].ArchiveID < depths[j].ArchiveID })
+	return depths
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, which
+// allows bursts of up to one second of data.
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n more bytes may be copied, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitBandwidth blocks until n more bytes may be copied under the
+// bandwidth limit of the action's archive ID, or until ctx is done. The
+// Copytool sets the limit in the context passed to the Backend, and the
+// progress reporting wrappers call WaitBandwidth for each copy, so
+// Backends only need to call it for data they copy by other means.
+func WaitBandwidth(ctx context.Context, n int) error {
+	l, ok := ctx.Value(rateLimiterKey{}).(*rateLimiter)
+	if !ok || n <= 0 {
+		return nil
+	}
+	return l.wait(ctx, n)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWaitBandwidth(t *testing.T) {
+	if err := WaitBandwidth(context.Background(), 1<<30); err != nil {
+		t.Fatalf("unlimited wait failed: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), rateLimiterKey{}, newRateLimiter(1000))
+	start := time.Now()
+	// The first second of data is allowed as a burst.
+	if err := WaitBandwidth(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitBandwidth(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("copied 1100 bytes at 1000 B/s in %v", elapsed)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := WaitBandwidth(cctx, 1000); err != context.Canceled {
+		t.Fatalf("got %v from canceled wait, expected context.Canceled", err)
+	}
+}
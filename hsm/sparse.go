@@ -0,0 +1,217 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+type (
+	// Segment is a range of file data.
+	Segment struct {
+		Offset int64 `json:"offset"`
+		Length int64 `json:"length"`
+	}
+
+	// SparseMap records where the data of a sparse file is. Ranges
+	// not covered by a Segment are holes.
+	SparseMap struct {
+		Size     int64     `json:"size"`
+		Segments []Segment `json:"segments"`
+	}
+)
+
+// End returns the offset following the segment.
+func (s Segment) End() int64 {
+	return s.Offset + s.Length
+}
+
+// DataLength returns the number of bytes of data in the map.
+func (m *SparseMap) DataLength() int64 {
+	var n int64
+	for _, s := range m.Segments {
+		n += s.Length
+	}
+	return n
+}
+
+// extentEnd returns the end of the action's extent, limited to size.
+func extentEnd(aih ActionHandle, size int64) int64 {
+	if aih.Length() == lustre.MaxExtentLength || aih.Offset()+aih.Length() > size {
+		return size
+	}
+	return aih.Offset() + aih.Length()
+}
+
+// DataSegments returns the segments of f containing data between
+// offset and end, found with SEEK_DATA and SEEK_HOLE. If the
+// filesystem doesn't support them, the whole range is data.
+func DataSegments(f *os.File, offset, end int64) ([]Segment, error) {
+	var segments []Segment
+	fd := int(f.Fd())
+	for pos := offset; pos < end; {
+		data, err := unix.Seek(fd, pos, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// Only a hole remains.
+			break
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return []Segment{{Offset: offset, Length: end - offset}}, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: seek data", f.Name())
+		}
+		if data >= end {
+			break
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: seek hole", f.Name())
+		}
+		if hole > end {
+			hole = end
+		}
+		segments = append(segments, Segment{Offset: data, Length: hole - data})
+		pos = hole
+	}
+	return segments, nil
+}
+
+// copySegment copies length bytes from r at roff to w, reporting the
+// progress to p. The copy is limited to the bandwidth set in ctx.
+func copySegment(ctx context.Context, w io.Writer, r io.ReaderAt, roff, length int64, p *progressUpdater, buf []byte) (int64, error) {
+	var copied int64
+	for copied < length {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		chunk := buf
+		if remain := length - copied; remain < int64(len(chunk)) {
+			chunk = chunk[:remain]
+		}
+		nr, err := r.ReadAt(chunk, roff+copied)
+		if nr > 0 {
+			if err := WaitBandwidth(ctx, nr); err != nil {
+				return copied, err
+			}
+			nw, werr := w.Write(chunk[:nr])
+			copied += int64(nw)
+			p.update(nw)
+			if werr != nil {
+				return copied, werr
+			}
+		}
+		if err == io.EOF && copied < length {
+			return copied, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// ArchiveSparse copies the data within the action's extent from src to
+// w, skipping holes. The data segments are written to w end to end,
+// and the returned map records where they belong in the file. Progress
+// is reported for the extent, with skipped holes counted as copied.
+func ArchiveSparse(ctx context.Context, w io.Writer, src *os.File, aih ActionHandle, options ...ProgressOption) (*SparseMap, int64, error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := extentEnd(aih, fi.Size())
+	segments, err := DataSegments(src, aih.Offset(), end)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	options = append([]ProgressOption{OptProgressTotal(end - aih.Offset())}, options...)
+	p := newProgressUpdater(ctx, aih, options...)
+	buf := make([]byte, copyBufferSize)
+	pos := aih.Offset()
+	var written int64
+	for _, s := range segments {
+		p.update(int(s.Offset - pos))
+		n, err := copySegment(ctx, w, src, s.Offset, s.Length, p, buf)
+		written += n
+		if err != nil {
+			return nil, written, err
+		}
+		pos = s.End()
+	}
+	p.update(int(end - pos))
+
+	return &SparseMap{Size: fi.Size(), Segments: segments}, written, nil
+}
+
+// offsetWriter writes sequentially to an io.WriterAt.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(b []byte) (int, error) {
+	n, err := ow.w.WriteAt(b, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
+
+// RestoreSparse copies data archived by ArchiveSparse from r to dst,
+// leaving holes where the map has no data. Only the data within the
+// action's extent is restored, so partial restores read just the
+// segments they need. The file is extended to its full size if
+// necessary. It returns the number of data bytes restored.
+func RestoreSparse(ctx context.Context, dst *os.File, r io.ReaderAt, m *SparseMap, aih ActionHandle, options ...ProgressOption) (int64, error) {
+	start := aih.Offset()
+	end := extentEnd(aih, m.Size)
+
+	options = append([]ProgressOption{OptProgressTotal(end - start)}, options...)
+	p := newProgressUpdater(ctx, aih, options...)
+	buf := make([]byte, copyBufferSize)
+	pos := start
+	var packed, restored int64
+	for _, s := range m.Segments {
+		from, to := s.Offset, s.End()
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if from < to {
+			p.update(int(from - pos))
+			w := &offsetWriter{w: dst, off: from}
+			n, err := copySegment(ctx, w, r, packed+from-s.Offset, to-from, p, buf)
+			restored += n
+			if err != nil {
+				return restored, err
+			}
+			pos = to
+		}
+		packed += s.Length
+	}
+	if pos < end {
+		p.update(int(end - pos))
+	}
+
+	fi, err := dst.Stat()
+	if err != nil {
+		return restored, err
+	}
+	if fi.Size() < m.Size {
+		if err := dst.Truncate(m.Size); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
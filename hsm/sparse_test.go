@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+)
+
+const (
+	sparseBlock = 64 * 1024
+	sparseSize  = 64 * sparseBlock
+)
+
+// createSparseFile creates a file with data in two separate blocks and
+// holes everywhere else, including at the end.
+func createSparseFile(t *testing.T) (*os.File, []byte) {
+	f, err := ioutil.TempFile("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, sparseSize)
+	for i, off := range []int64{4 * sparseBlock, 32 * sparseBlock} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, sparseBlock)
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[off:], data)
+	}
+	if err := f.Truncate(sparseSize); err != nil {
+		t.Fatal(err)
+	}
+	return f, expected
+}
+
+func TestDataSegments(t *testing.T) {
+	f, expected := createSparseFile(t)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	segments, err := hsm.DataSegments(f, 0, sparseSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filesystems may report more data than was written, or none of
+	// the holes at all, but never less.
+	for off := 0; off < sparseSize; off += sparseBlock {
+		if expected[off] == 0 {
+			continue
+		}
+		found := false
+		for _, s := range segments {
+			if s.Offset <= int64(off) && s.End() >= int64(off+sparseBlock) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("data at %d not in segments %v", off, segments)
+		}
+	}
+}
+
+func TestSparseArchiveRestore(t *testing.T) {
+	src, expected := createSparseFile(t)
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	req := hsm.NewTestRequest(1, hsm.ARCHIVE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+	stop := collectProgress(req)
+	var packed bytes.Buffer
+	m, n, err := hsm.ArchiveSparse(context.Background(), &packed, src, req, hsm.OptProgressByteInterval(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := stop()
+
+	if m.Size != sparseSize || n != int64(packed.Len()) || n != m.DataLength() {
+		t.Fatalf("size %d, wrote %d, packed %d, data %d", m.Size, n, packed.Len(), m.DataLength())
+	}
+	if len(updates) == 0 {
+		t.Fatal("no progress updates")
+	}
+	last := updates[len(updates)-1]
+	if last.Length != sparseSize || last.Total != sparseSize {
+		t.Fatalf("unexpected final update: %s", last)
+	}
+
+	var tests = []struct {
+		offset int64
+		length int64
+	}{
+		{0, lustre.MaxExtentLength},
+		{30 * sparseBlock, 4 * sparseBlock},
+		{4*sparseBlock + 100, 10},
+		{10 * sparseBlock, sparseBlock},
+	}
+	for _, tc := range tests {
+		dst, err := ioutil.TempFile("", "sparse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(dst.Name())
+		defer dst.Close()
+
+		req := hsm.NewTestRequest(1, hsm.RESTORE, &lustre.Fid{Seq: 1, Oid: 2}, nil)
+		req.SetExtent(tc.offset, tc.length)
+		stop := collectProgress(req)
+		_, err = hsm.RestoreSparse(context.Background(), dst, bytes.NewReader(packed.Bytes()), m, req)
+		stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored, err := ioutil.ReadFile(dst.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restored) != sparseSize {
+			t.Fatalf("%d:%d: restored size %d, expected %d", tc.offset, tc.length, len(restored), sparseSize)
+		}
+		start, end := tc.offset, tc.offset+tc.length
+		if tc.length == lustre.MaxExtentLength {
+			end = sparseSize
+		}
+		for i := range restored {
+			want := byte(0)
+			if int64(i) >= start && int64(i) < end {
+				want = expected[i]
+			}
+			if restored[i] != want {
+				t.Fatalf("%d:%d: byte %d is %q, expected %q", tc.offset, tc.length, i, restored[i], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,676 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// TestCoordinator implements ActionSource with an in-process
+	// coordinator that tracks the HSM state of files in a temporary
+	// directory. Requests made through it are delivered as actions
+	// with real file descriptors, and the file state is updated when
+	// each action is ended, so copytools can be tested end to end
+	// without Lustre.
+	TestCoordinator struct {
+		dir string
+
+		mu       sync.Mutex // protects everything below
+		files    map[lustre.Fid]*coordinatorFile
+		nextOid  uint32
+		in       chan ActionRequest
+		actions  <-chan ActionRequest
+		shutdown bool
+	}
+
+	coordinatorFile struct {
+		fid       lustre.Fid
+		path      string
+		size      int64
+		state     llapi.HsmFileState
+		archiveID uint
+		pending   *coordinatorAction
+		lastErr   error
+		done      chan struct{}
+
+		// dataVersion is incremented whenever the data is written.
+		dataVersion uint64
+
+		// layout is the layout EA of the file. A restored file
+		// gets the layout set on its volatile data file.
+		layout []byte
+	}
+
+	// coordinatorAction implements ActionRequest and ActionHandle for
+	// the TestCoordinator.
+	coordinatorAction struct {
+		tc        *TestCoordinator
+		file      *coordinatorFile
+		action    llapi.HsmAction
+		archiveID uint
+		cookie    uint64
+
+		mu             sync.Mutex
+		f              *os.File
+		dataFid        lustre.Fid
+		dataVersion    uint64
+		hasDataVersion bool
+		layout         []byte
+
+		// volatileVersion is the data version of the volatile file
+		// of a restore, which the file gets when the restore
+		// completes, as its data is in new objects.
+		volatileVersion uint64
+	}
+)
+
+const (
+	testCoordinatorSeq    = 0x200000400
+	testCoordinatorFsName = "testfs"
+)
+
+// NewTestCoordinator returns a TestCoordinator with a new, empty
+// temporary directory. Close removes the directory.
+func NewTestCoordinator() (*TestCoordinator, error) {
+	dir, err := ioutil.TempDir("", "hsm-coordinator")
+	if err != nil {
+		return nil, err
+	}
+	tc := &TestCoordinator{
+		dir:   dir,
+		files: make(map[lustre.Fid]*coordinatorFile),
+		in:    make(chan ActionRequest),
+	}
+	tc.actions = bufferedActionChannel(tc.in)
+	return tc, nil
+}
+
+// Close removes the coordinator's directory.
+func (tc *TestCoordinator) Close() error {
+	return os.RemoveAll(tc.dir)
+}
+
+// Dir returns the directory containing the coordinator's files.
+func (tc *TestCoordinator) Dir() string {
+	return tc.dir
+}
+
+// Root returns the coordinator's directory as the root of a filesystem.
+// Its files can be opened by fid with fs.FidPath.
+func (tc *TestCoordinator) Root() fs.RootDir {
+	root, _ := fs.TestID(tc.dir).Root()
+	return root
+}
+
+// Actions returns a channel for callers to receive ActionRequests
+func (tc *TestCoordinator) Actions() <-chan ActionRequest {
+	return tc.actions
+}
+
+// Err always returns nil, as the TestCoordinator only shuts down when
+// its context is canceled.
+func (tc *TestCoordinator) Err() error {
+	return nil
+}
+
+// Start signals the coordinator to begin sending actions. The actions
+// channel is closed when ctx is canceled.
+func (tc *TestCoordinator) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		debug.Print("Shutting down test coordinator")
+		tc.mu.Lock()
+		tc.shutdown = true
+		close(tc.in)
+		tc.mu.Unlock()
+	}()
+	return nil
+}
+
+func (tc *TestCoordinator) allocFid() lustre.Fid {
+	tc.nextOid++
+	return lustre.Fid{Seq: testCoordinatorSeq, Oid: tc.nextOid}
+}
+
+// CreateFile creates a file containing data and returns its fid. The
+// new file has no HSM state.
+func (tc *TestCoordinator) CreateFile(name string, data []byte) (*lustre.Fid, error) {
+	path := filepath.Join(tc.dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	fid := tc.allocFid()
+	fidPath := fs.FidPath(tc.Root(), &fid)
+	if err := os.MkdirAll(filepath.Dir(fidPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Link(path, fidPath); err != nil {
+		return nil, err
+	}
+	tc.files[fid] = &coordinatorFile{
+		fid:         fid,
+		path:        path,
+		size:        int64(len(data)),
+		dataVersion: 1,
+	}
+	return &fid, nil
+}
+
+// WriteFile replaces the data of a file, which is marked dirty if it
+// has been archived. It may be called while an action is running on
+// the file, to simulate a concurrent modification.
+func (tc *TestCoordinator) WriteFile(f *lustre.Fid, data []byte) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	if cf.state.HasFlag(llapi.HsmFileReleased) {
+		return unix.ENODATA
+	}
+	if err := ioutil.WriteFile(cf.path, data, 0644); err != nil {
+		return err
+	}
+	cf.size = int64(len(data))
+	cf.dataVersion++
+	if cf.state.HasFlag(llapi.HsmFileExists) {
+		cf.state |= llapi.HsmFileState(llapi.HsmFileDirty)
+	}
+	return nil
+}
+
+// SetFileLayout sets the layout EA of a file.
+func (tc *TestCoordinator) SetFileLayout(f *lustre.Fid, lovEA []byte) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	cf.layout = lovEA
+	return nil
+}
+
+// FileLayout returns the layout EA of a file.
+func (tc *TestCoordinator) FileLayout(f *lustre.Fid) ([]byte, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return cf.layout, nil
+}
+
+func (tc *TestCoordinator) getFile(f *lustre.Fid) (*coordinatorFile, error) {
+	cf, ok := tc.files[*f]
+	if !ok {
+		return nil, &os.PathError{Op: "hsm", Path: f.String(), Err: unix.ENOENT}
+	}
+	return cf, nil
+}
+
+// Path returns the path of the file with the fid.
+func (tc *TestCoordinator) Path(f *lustre.Fid) (string, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return "", err
+	}
+	return cf.path, nil
+}
+
+// DataVersion returns the data version of the file.
+func (tc *TestCoordinator) DataVersion(f *lustre.Fid) (uint64, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return 0, err
+	}
+	return cf.dataVersion, nil
+}
+
+// GetFileStatus returns the HSM state and archive ID of the file.
+func (tc *TestCoordinator) GetFileStatus(f *lustre.Fid) (llapi.HsmFileState, uint, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cf.state, cf.archiveID, nil
+}
+
+// SetFileStatus sets and clears HSM state flags on the file, as
+// llapi.SetHsmFileStatus does. It can be used to simulate a file being
+// modified (dirty) or its archive copy being lost.
+func (tc *TestCoordinator) SetFileStatus(f *lustre.Fid, set, clear llapi.HsmStateFlag) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	cf.state = llapi.HsmFileState((uint32(cf.state) | uint32(set)) &^ uint32(clear))
+	return nil
+}
+
+// queue sends an action for the file to the copytool.
+func (tc *TestCoordinator) queue(cf *coordinatorFile, action llapi.HsmAction, archiveID uint) error {
+	if tc.shutdown {
+		return errors.New("coordinator shut down")
+	}
+	if cf.pending != nil {
+		return unix.EBUSY
+	}
+	ca := &coordinatorAction{
+		tc:        tc,
+		file:      cf,
+		action:    action,
+		archiveID: archiveID,
+		cookie:    atomic.AddUint64(&nextCookie, 1),
+		dataFid:   cf.fid,
+	}
+	cf.pending = ca
+	cf.lastErr = nil
+	cf.done = make(chan struct{})
+	tc.in <- ca
+	return nil
+}
+
+// RequestArchive queues an ARCHIVE action for the file.
+func (tc *TestCoordinator) RequestArchive(f *lustre.Fid, archiveID uint) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cf.state.HasFlag(llapi.HsmFileNoArchive):
+		return unix.EPERM
+	case cf.state.HasFlag(llapi.HsmFileReleased):
+		return unix.EALREADY
+	}
+	return tc.queue(cf, ARCHIVE, archiveID)
+}
+
+// RequestRestore queues a RESTORE action for a released file.
+func (tc *TestCoordinator) RequestRestore(f *lustre.Fid) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cf.state.HasFlag(llapi.HsmFileLost):
+		return unix.ENODATA
+	case !cf.state.HasFlag(llapi.HsmFileReleased):
+		return unix.EALREADY
+	}
+	return tc.queue(cf, RESTORE, cf.archiveID)
+}
+
+// RequestRemove queues a REMOVE action for the file's archived copy.
+func (tc *TestCoordinator) RequestRemove(f *lustre.Fid) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cf.state.HasFlag(llapi.HsmFileReleased):
+		return unix.EBUSY
+	case !cf.state.HasFlag(llapi.HsmFileExists):
+		return unix.ENOENT
+	}
+	return tc.queue(cf, REMOVE, cf.archiveID)
+}
+
+// RequestCancel sends a CANCEL action for the file's pending action. As
+// with the real coordinator, the CANCEL has the cookie of the action it
+// cancels, so ending it ends that action.
+func (tc *TestCoordinator) RequestCancel(f *lustre.Fid) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	if tc.shutdown {
+		return errors.New("coordinator shut down")
+	}
+	if cf.pending == nil {
+		return unix.EALREADY
+	}
+	tc.in <- &coordinatorAction{
+		tc:        tc,
+		file:      cf,
+		action:    CANCEL,
+		archiveID: cf.pending.archiveID,
+		cookie:    cf.pending.cookie,
+		dataFid:   cf.fid,
+	}
+	return nil
+}
+
+// RequestRelease releases the file's data, which must have an up to
+// date archive copy. Release is handled by the coordinator itself, so
+// it completes immediately.
+func (tc *TestCoordinator) RequestRelease(f *lustre.Fid) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cf.pending != nil:
+		return unix.EBUSY
+	case cf.state.HasFlag(llapi.HsmFileReleased):
+		return unix.EALREADY
+	case cf.state.HasFlag(llapi.HsmFileNoRelease):
+		return unix.EPERM
+	case !cf.state.HasFlag(llapi.HsmFileArchived),
+		cf.state.HasFlag(llapi.HsmFileDirty),
+		cf.state.HasFlag(llapi.HsmFileLost):
+		return unix.EPERM
+	}
+
+	fi, err := os.Stat(cf.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(cf.path, 0); err != nil {
+		return err
+	}
+	cf.size = fi.Size()
+	cf.state |= llapi.HsmFileState(llapi.HsmFileReleased)
+	return nil
+}
+
+// Wait blocks until there is no action pending for the file, and returns
+// the error the last action completed with.
+func (tc *TestCoordinator) Wait(ctx context.Context, f *lustre.Fid) error {
+	tc.mu.Lock()
+	cf, err := tc.getFile(f)
+	if err != nil {
+		tc.mu.Unlock()
+		return err
+	}
+	done := cf.done
+	tc.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return cf.lastErr
+}
+
+// complete applies the result of an action to the file state. Ending a
+// CANCEL ends the action with its cookie.
+func (tc *TestCoordinator) complete(ca *coordinatorAction, errval int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	cf := ca.file
+	if ca.action == CANCEL && cf.pending != nil && cf.pending.cookie == ca.cookie {
+		ca = cf.pending
+	}
+	if cf.pending != ca {
+		return
+	}
+	cf.pending = nil
+	defer close(cf.done)
+
+	// The coordinator rejects an archive of data which has changed.
+	if errval == 0 && ca.action == ARCHIVE && ca.hasDataVersion &&
+		ca.dataVersion != cf.dataVersion {
+		errval = int(unix.EBUSY)
+	}
+	if errval != 0 {
+		cf.lastErr = unix.Errno(errval)
+		return
+	}
+
+	switch ca.action {
+	case ARCHIVE:
+		cf.state |= llapi.HsmFileState(llapi.HsmFileExists | llapi.HsmFileArchived)
+		cf.state &^= llapi.HsmFileState(llapi.HsmFileDirty)
+		cf.archiveID = ca.archiveID
+	case RESTORE:
+		cf.state &^= llapi.HsmFileState(llapi.HsmFileReleased)
+		cf.layout = ca.layout
+		cf.dataVersion = ca.volatileVersion
+	case REMOVE:
+		cf.state &^= llapi.HsmFileState(llapi.HsmFileExists | llapi.HsmFileArchived |
+			llapi.HsmFileDirty | llapi.HsmFileLost)
+		cf.archiveID = 0
+	}
+}
+
+func (ca *coordinatorAction) String() string {
+	return fmt.Sprintf("COORD %s %s 0x%x", ca.action, &ca.file.fid, ca.cookie)
+}
+
+// Begin opens the data file for the action. Restores are written to a
+// new volatile file whose data replaces that of the original when the
+// action ends successfully.
+func (ca *coordinatorAction) Begin(openFlags int, isError bool) (ActionHandle, error) {
+	if isError {
+		return ca, nil
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	var err error
+	switch ca.action {
+	case ARCHIVE:
+		ca.f, err = os.Open(ca.file.path)
+	case RESTORE:
+		ca.f, err = ioutil.TempFile(ca.tc.dir, ".volatile")
+		if err == nil {
+			ca.tc.mu.Lock()
+			ca.dataFid = ca.tc.allocFid()
+			ca.volatileVersion = ca.file.dataVersion + 1
+			// The volatile file gets the layout of the file,
+			// unless SetLayout replaces it.
+			ca.layout = ca.file.layout
+			ca.tc.mu.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// FailImmediately completes the action with the error.
+func (ca *coordinatorAction) FailImmediately(errval int) {
+	ca.End(0, 0, retryFlags(errval), errval)
+}
+
+// ArchiveID returns the archive id for the action.
+func (ca *coordinatorAction) ArchiveID() uint {
+	return ca.archiveID
+}
+
+// FsName returns the name of the test filesystem.
+func (ca *coordinatorAction) FsName() string {
+	return testCoordinatorFsName
+}
+
+// Action returns the HSM action type
+func (ca *coordinatorAction) Action() llapi.HsmAction {
+	return ca.action
+}
+
+// Cookie returns the action identifier.
+func (ca *coordinatorAction) Cookie() uint64 {
+	return ca.cookie
+}
+
+// Fid returns the FID of the file.
+func (ca *coordinatorAction) Fid() *lustre.Fid {
+	fid := ca.file.fid
+	return &fid
+}
+
+// DataFid returns the FID of the file used for data transfer.
+func (ca *coordinatorAction) DataFid() (*lustre.Fid, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	fid := ca.dataFid
+	return &fid, nil
+}
+
+// Fd returns a new file descriptor for the data file, which the caller
+// must close.
+func (ca *coordinatorAction) Fd() (int, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.f == nil {
+		return -1, unix.EBADF
+	}
+	return unix.Dup(int(ca.f.Fd()))
+}
+
+// Offset returns the offset for the action.
+func (ca *coordinatorAction) Offset() int64 {
+	return 0
+}
+
+// Length returns the length of the action, which is always to EOF.
+func (ca *coordinatorAction) Length() int64 {
+	return lustre.MaxExtentLength
+}
+
+// Data returns the additional request data.
+func (ca *coordinatorAction) Data() []byte {
+	return nil
+}
+
+// DataVersion returns the data version of the data file, which is the
+// volatile file for a restore.
+func (ca *coordinatorAction) DataVersion(flags llapi.DataVersionFlag) (uint64, error) {
+	if ca.action == RESTORE {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		return ca.volatileVersion, nil
+	}
+	ca.tc.mu.Lock()
+	defer ca.tc.mu.Unlock()
+	return ca.file.dataVersion, nil
+}
+
+// SetDataVersion records the data version of the file that was
+// archived. The archive fails when it ends if the file has changed
+// since.
+func (ca *coordinatorAction) SetDataVersion(dv uint64) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.dataVersion = dv
+	ca.hasDataVersion = true
+}
+
+// Layout returns the layout EA of the file.
+func (ca *coordinatorAction) Layout() ([]byte, error) {
+	ca.tc.mu.Lock()
+	defer ca.tc.mu.Unlock()
+	return ca.file.layout, nil
+}
+
+// SetLayout replaces the layout of the volatile file of a restore,
+// which the file gets when the restore completes. A nil layout copies
+// the current layout of the file.
+func (ca *coordinatorAction) SetLayout(lovEA []byte) error {
+	if ca.action != RESTORE {
+		return fmt.Errorf("%s: layout can only be set for restore", ca)
+	}
+	if lovEA == nil {
+		ca.tc.mu.Lock()
+		lovEA = ca.file.layout
+		ca.tc.mu.Unlock()
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.layout = lovEA
+	return nil
+}
+
+// Progress is accepted and ignored.
+func (ca *coordinatorAction) Progress(offset, length, totalLength int64, flags int) error {
+	return nil
+}
+
+// End completes the action and updates the state of the file.
+func (ca *coordinatorAction) End(offset, length int64, flags int, errval int) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.f != nil {
+		ca.f.Close()
+		if ca.action == RESTORE {
+			if errval == 0 {
+				if err := swapData(ca.f.Name(), ca.file.path); err != nil {
+					errval = int(unix.EIO)
+				}
+			}
+			os.Remove(ca.f.Name())
+		}
+		ca.f = nil
+	}
+	ca.tc.complete(ca, errval)
+	return nil
+}
+
+// swapData replaces the data of the file at path with the data of the
+// volatile file, as a layout swap does. The file keeps its inode, and
+// so its links and xattrs, while those of the volatile file are lost.
+func swapData(volatile, path string) error {
+	data, err := ioutil.ReadFile(volatile)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
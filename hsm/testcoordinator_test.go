@@ -0,0 +1,238 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+func startCoordinator(t *testing.T, backend hsm.Backend) (*hsm.TestCoordinator, func()) {
+	tc, err := hsm.NewTestCoordinator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := hsm.NewCopytool(tc, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ct.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	return tc, func() {
+		cancel()
+		<-done
+		tc.Close()
+	}
+}
+
+func waitAction(t *testing.T, tc *hsm.TestCoordinator, fid *lustre.Fid) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := tc.Wait(ctx, fid)
+	if err == context.DeadlineExceeded {
+		t.Fatalf("%s: timed out waiting for action", fid)
+	}
+	return err
+}
+
+func checkState(t *testing.T, tc *hsm.TestCoordinator, fid *lustre.Fid, expected llapi.HsmStateFlag) {
+	state, _, err := tc.GetFileStatus(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(state) != uint32(expected) {
+		t.Fatalf("%s: got state %v, expected %v", fid, state.Flags(), llapi.HsmFileState(expected).Flags())
+	}
+}
+
+func TestCoordinatorTransitions(t *testing.T) {
+	tc, stop := startCoordinator(t, &testBackend{})
+	defer stop()
+
+	fid, err := tc.CreateFile("file", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tc.RequestRelease(fid); err != syscall.EPERM {
+		t.Fatalf("release before archive: got %v, expected EPERM", err)
+	}
+
+	if err := tc.RequestArchive(fid, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, tc, fid, llapi.HsmFileExists|llapi.HsmFileArchived)
+
+	if err := tc.RequestRelease(fid); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, tc, fid, llapi.HsmFileExists|llapi.HsmFileArchived|llapi.HsmFileReleased)
+
+	if err := tc.RequestRemove(fid); err != syscall.EBUSY {
+		t.Fatalf("remove released file: got %v, expected EBUSY", err)
+	}
+
+	if err := tc.RequestRestore(fid); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, tc, fid, llapi.HsmFileExists|llapi.HsmFileArchived)
+
+	if err := tc.SetFileStatus(fid, llapi.HsmFileDirty, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.RequestRelease(fid); err != syscall.EPERM {
+		t.Fatalf("release dirty file: got %v, expected EPERM", err)
+	}
+
+	if err := tc.RequestRemove(fid); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, tc, fid, 0)
+}
+
+func TestCoordinatorFailure(t *testing.T) {
+	tc, stop := startCoordinator(t, &testBackend{err: syscall.ENOSPC})
+	defer stop()
+
+	fid, err := tc.CreateFile("file", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.RequestArchive(fid, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != syscall.ENOSPC {
+		t.Fatalf("got %v, expected ENOSPC", err)
+	}
+	checkState(t, tc, fid, 0)
+}
+
+func TestCoordinatorStaleArchive(t *testing.T) {
+	tc, err := hsm.NewTestCoordinator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc.Start(ctx)
+
+	fid, err := tc.CreateFile("file", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.RequestArchive(fid, 1); err != nil {
+		t.Fatal(err)
+	}
+	ar := <-tc.Actions()
+	aih, err := ar.Begin(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dv, err := aih.DataVersion(llapi.DataVersionReadFlush)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aih.SetDataVersion(dv)
+
+	// Modified after the copy, before the action ends.
+	if err := tc.WriteFile(fid, []byte("new data")); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := aih.DataVersion(0); after == dv {
+		t.Fatal("data version not changed by write")
+	}
+	if err := aih.End(0, 4, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != syscall.EBUSY {
+		t.Fatalf("got %v, expected EBUSY", err)
+	}
+	checkState(t, tc, fid, 0)
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	backend := &blockingBackend{started: make(chan struct{})}
+	tc, stop := startCoordinator(t, backend)
+	defer stop()
+
+	fid, err := tc.CreateFile("file", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.RequestArchive(fid, 1); err != nil {
+		t.Fatal(err)
+	}
+	<-backend.started
+	if err := tc.RequestCancel(fid); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != syscall.ECANCELED {
+		t.Fatalf("got %v, expected ECANCELED", err)
+	}
+	checkState(t, tc, fid, 0)
+}
+
+func TestCoordinatorRestoreLayout(t *testing.T) {
+	tc, err := hsm.NewTestCoordinator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc.Start(ctx)
+
+	fid, err := tc.CreateFile("file", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetFileLayout(fid, []byte("striped")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetFileStatus(fid, llapi.HsmFileExists|llapi.HsmFileArchived|llapi.HsmFileReleased, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restore run without a Copytool keeps the layout of the file.
+	if err := tc.RequestRestore(fid); err != nil {
+		t.Fatal(err)
+	}
+	aih, err := (<-tc.Actions()).Begin(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aih.End(0, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitAction(t, tc, fid); err != nil {
+		t.Fatal(err)
+	}
+	if layout, _ := tc.FileLayout(fid); string(layout) != "striped" {
+		t.Fatalf("got layout %q after restore, expected %q", layout, "striped")
+	}
+}
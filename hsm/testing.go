@@ -7,9 +7,12 @@ package hsm
 import (
 	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 
 	"github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/go-lustre/llapi"
@@ -26,6 +29,10 @@ type (
 	TestSource struct {
 		outgoing chan ActionRequest
 		rng      *rand.Rand
+
+		closeOnce sync.Once
+		mu        sync.Mutex // protects err
+		err       error
 	}
 
 	// TestRequest implements hsm.ActionRequest with additional
@@ -36,8 +43,20 @@ type (
 		action                 llapi.HsmAction
 		extent                 llapi.HsmExtent
 		testFid                *lustre.Fid
+		fsName                 string
 		handleProgressReceived chan *TestProgressUpdate
 		data                   []byte
+
+		mu                  sync.Mutex // protects the data versions and layouts
+		fileDataVersion     uint64
+		archivedDataVersion uint64
+		hasArchivedVersion  bool
+		fileLayout          []byte
+		restoredLayout      []byte
+		hasRestoredLayout   bool
+
+		updateMu sync.Mutex // serializes updates with End
+		ended    bool
 	}
 
 	// TestProgressUpdate contains information about progress updates
@@ -53,7 +72,13 @@ type (
 	}
 )
 
+// testProgressBuffer is the number of progress updates buffered for
+// a TestRequest, so a request can be failed or ended without a reader.
+const testProgressBuffer = 64
+
 var (
+	// nextCookie is updated atomically, as test requests may be
+	// created concurrently.
 	nextCookie uint64 = 0x1000
 )
 
@@ -76,7 +101,9 @@ func (s *TestSource) Inject(ar ActionRequest) {
 
 // GenerateRandomAction generates a random action request
 func (s *TestSource) GenerateRandomAction() {
-	s.Inject(&TestRequest{})
+	actions := []llapi.HsmAction{ARCHIVE, RESTORE, REMOVE}
+	fid := &lustre.Fid{Seq: 0x200000400, Oid: uint32(s.rng.Int31()), Ver: 0}
+	s.Inject(NewTestRequest(1, actions[s.rng.Intn(len(actions))], fid, nil))
 }
 
 // Actions returns a channel for callers to receive ActionRequests
@@ -87,7 +114,23 @@ func (s *TestSource) Actions() <-chan ActionRequest {
 func (s *TestSource) closer(ctx context.Context) {
 	<-ctx.Done()
 	debug.Print("Shutting down test action generator")
-	close(s.outgoing)
+	s.closeOnce.Do(func() { close(s.outgoing) })
+}
+
+// Fail shuts down the source with an error, as if it had lost its
+// connection to the coordinator.
+func (s *TestSource) Fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	s.closeOnce.Do(func() { close(s.outgoing) })
+}
+
+// Err returns the error passed to Fail, if any.
+func (s *TestSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
 }
 
 // Start starts the action generator
@@ -99,18 +142,30 @@ func (s *TestSource) Start(ctx context.Context) error {
 
 // NewTestRequest returns a new *TestRequest
 func NewTestRequest(archive uint, action llapi.HsmAction, fid *lustre.Fid, data []byte) *TestRequest {
-	nextCookie++
 	return &TestRequest{
-		cookie:                 nextCookie,
+		cookie:                 atomic.AddUint64(&nextCookie, 1),
 		testFid:                fid,
 		archive:                archive,
 		action:                 action,
-		extent:                 llapi.HsmExtent{0, 0},
-		handleProgressReceived: make(chan *TestProgressUpdate),
+		extent:                 llapi.HsmExtent{Offset: 0, Length: lustre.MaxExtentLength},
+		handleProgressReceived: make(chan *TestProgressUpdate, testProgressBuffer),
 		data: data,
 	}
 }
 
+// NewTestCancelRequest returns a new *TestRequest that cancels r.
+func NewTestCancelRequest(r *TestRequest) *TestRequest {
+	return &TestRequest{
+		cookie:                 r.cookie,
+		testFid:                r.testFid,
+		fsName:                 r.fsName,
+		archive:                r.archive,
+		action:                 CANCEL,
+		extent:                 r.extent,
+		handleProgressReceived: make(chan *TestProgressUpdate, testProgressBuffer),
+	}
+}
+
 func (r *TestRequest) String() string {
 	return fmt.Sprintf("TEST %s %s %s 0x%x %s", r.action, r.testFid, r.extent, r.cookie, r.data)
 }
@@ -122,7 +177,7 @@ func (r *TestRequest) Begin(flags int, isError bool) (ActionHandle, error) {
 
 // FailImmediately immediately fails the request
 func (r *TestRequest) FailImmediately(errval int) {
-	return
+	r.End(0, 0, retryFlags(errval), errval)
 }
 
 // ArchiveID returns the backend archive number
@@ -130,6 +185,16 @@ func (r *TestRequest) ArchiveID() uint {
 	return r.archive
 }
 
+// FsName returns the filesystem name set with SetFsName.
+func (r *TestRequest) FsName() string {
+	return r.fsName
+}
+
+// SetFsName sets the name of the filesystem the request is for.
+func (r *TestRequest) SetFsName(name string) {
+	r.fsName = name
+}
+
 // Action returns the HSM action type
 func (r *TestRequest) Action() llapi.HsmAction {
 	return r.action
@@ -143,8 +208,14 @@ func (r *TestRequest) ProgressUpdates() chan *TestProgressUpdate {
 	return r.handleProgressReceived
 }
 
-// Progress updates current state of data transfer request.
+// Progress updates current state of data transfer request. Updates
+// after the request has ended are ignored.
 func (r *TestRequest) Progress(offset, length, total int64, flags int) error {
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+	if r.ended {
+		return nil
+	}
 	r.handleProgressReceived <- &TestProgressUpdate{
 		Cookie: r.cookie,
 		Offset: offset,
@@ -155,8 +226,27 @@ func (r *TestRequest) Progress(offset, length, total int64, flags int) error {
 	return nil
 }
 
-// End completes an HSM actions with success or failure status.
+// End completes an HSM actions with success or failure status. Like
+// the real coordinator, a successful archive is failed with EBUSY if a
+// data version was set and the file's data version has changed. Only
+// the first End is reported.
 func (r *TestRequest) End(offset, length int64, flags int, errval int) error {
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+	if r.ended {
+		return nil
+	}
+	r.ended = true
+
+	r.mu.Lock()
+	if r.action == ARCHIVE && errval == 0 && r.hasArchivedVersion &&
+		r.archivedDataVersion != r.fileDataVersion {
+		offset, length = 0, 0
+		flags |= llapi.HsmProgressFlagRetry
+		errval = int(unix.EBUSY)
+	}
+	r.mu.Unlock()
+
 	r.handleProgressReceived <- &TestProgressUpdate{
 		Cookie:   r.cookie,
 		Offset:   offset,
@@ -190,17 +280,91 @@ func (r *TestRequest) Fd() (int, error) {
 	return 0, nil
 }
 
+// SetExtent sets the extent of the file data to be transferred.
+func (r *TestRequest) SetExtent(offset, length int64) {
+	r.extent = llapi.HsmExtent{Offset: offset, Length: length}
+}
+
 // Offset is the starting offset for a data transfer.
 func (r *TestRequest) Offset() int64 {
-	return 0
+	return r.extent.Offset
 }
 
 // Length is lenght of data transfer that begins at Offset.
 func (r *TestRequest) Length() int64 {
-	return 0
+	return r.extent.Length
 }
 
 // Data is extra data that may have been provided through the HSM_REQUEST API.
 func (r *TestRequest) Data() []byte {
 	return r.data
 }
+
+// DataVersion returns the data version of the test file.
+func (r *TestRequest) DataVersion(flags llapi.DataVersionFlag) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fileDataVersion, nil
+}
+
+// SetDataVersion records the data version of the file that was
+// archived.
+func (r *TestRequest) SetDataVersion(dv uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.archivedDataVersion = dv
+	r.hasArchivedVersion = true
+}
+
+// SetFileDataVersion sets the data version of the test file, as if it
+// had been modified.
+func (r *TestRequest) SetFileDataVersion(dv uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fileDataVersion = dv
+}
+
+// ArchivedDataVersion returns the data version set by SetDataVersion,
+// if any.
+func (r *TestRequest) ArchivedDataVersion() (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.archivedDataVersion, r.hasArchivedVersion
+}
+
+// Layout returns the layout of the test file.
+func (r *TestRequest) Layout() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fileLayout, nil
+}
+
+// SetLayout records the layout applied to the restored file. A nil
+// layout keeps the current layout of the test file.
+func (r *TestRequest) SetLayout(lovEA []byte) error {
+	if r.action != RESTORE {
+		return fmt.Errorf("%s: layout can only be set for restore", r)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if lovEA == nil {
+		lovEA = r.fileLayout
+	}
+	r.restoredLayout = lovEA
+	r.hasRestoredLayout = true
+	return nil
+}
+
+// SetFileLayout sets the layout of the test file.
+func (r *TestRequest) SetFileLayout(lovEA []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fileLayout = lovEA
+}
+
+// RestoredLayout returns the layout set by SetLayout, if any.
+func (r *TestRequest) RestoredLayout() ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.restoredLayout, r.hasRestoredLayout
+}
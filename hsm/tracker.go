@@ -0,0 +1,263 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// TrackResult is the final result of a tracked HSM request for a
+	// file. Err is nil if the action succeeded.
+	TrackResult struct {
+		Fid *lustre.Fid
+		Err error
+	}
+
+	// TrackerOption is a configuration option for a Tracker.
+	TrackerOption func(*Tracker)
+
+	// Tracker reports when the HSM actions for a submitted request
+	// have completed. It follows HSM events in the changelog if one
+	// is provided, and otherwise polls the state of each file.
+	Tracker struct {
+		root         fs.RootDir
+		action       llapi.HsmUserAction
+		records      changelog.RecordIterator
+		pollInterval time.Duration
+		idlePolls    int
+		status       statusFunc
+	}
+
+	// statusFunc returns the HSM state and current action of a file.
+	statusFunc func(*lustre.Fid) (*FileStatus, *CurrentFileAction, error)
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+
+	// Number of consecutive polls with no action in progress before
+	// a file that hasn't reached the expected state is considered to
+	// have failed.
+	defaultIdlePolls = 2
+)
+
+var trackEvents = map[llapi.HsmUserAction]llapi.HsmEvent{
+	llapi.HsmUserArchive: llapi.HsmEventArchive,
+	llapi.HsmUserRestore: llapi.HsmEventRestore,
+	llapi.HsmUserRelease: llapi.HsmEventRelease,
+	llapi.HsmUserRemove:  llapi.HsmEventRemove,
+	llapi.HsmUserCancel:  llapi.HsmEventCancel,
+}
+
+// OptTrackerChangelog causes the tracker to follow HSM events from the
+// changelog records. The records should start from before the request
+// was submitted.
+func OptTrackerChangelog(records changelog.RecordIterator) TrackerOption {
+	return func(t *Tracker) {
+		t.records = records
+	}
+}
+
+// OptTrackerPollInterval sets how often file state is polled, or how
+// often the changelog is checked for new records once it is exhausted.
+func OptTrackerPollInterval(interval time.Duration) TrackerOption {
+	return func(t *Tracker) {
+		t.pollInterval = interval
+	}
+}
+
+// NewTracker returns a Tracker for requests of the action on the
+// filesystem.
+func NewTracker(root fs.RootDir, action llapi.HsmUserAction, options ...TrackerOption) *Tracker {
+	t := &Tracker{
+		root:         root,
+		action:       action,
+		pollInterval: defaultPollInterval,
+		idlePolls:    defaultIdlePolls,
+	}
+	t.status = t.fileStatus
+	for _, option := range options {
+		option(t)
+	}
+	return t
+}
+
+func (t *Tracker) fileStatus(f *lustre.Fid) (*FileStatus, *CurrentFileAction, error) {
+	path := fs.FidPath(t.root, f)
+	st, err := GetFileStatus(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfa, err := GetFileAction(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, cfa, nil
+}
+
+// Track returns a channel that receives a result for each of the fids,
+// and is closed once all results have been sent. If ctx is done before
+// an action completes, the result for that file has ctx.Err().
+func (t *Tracker) Track(ctx context.Context, fids []*lustre.Fid) <-chan *TrackResult {
+	out := make(chan *TrackResult, len(fids))
+	pending := make(map[lustre.Fid]bool)
+	for _, f := range fids {
+		pending[*f] = true
+	}
+
+	go func() {
+		defer close(out)
+		if t.records != nil {
+			if err := t.follow(ctx, pending, out); err != nil {
+				debug.Printf("tracker: changelog failed, polling instead: %v", err)
+				t.poll(ctx, pending, out)
+			}
+		} else {
+			t.poll(ctx, pending, out)
+		}
+
+		for f := range pending {
+			fid := f
+			out <- &TrackResult{Fid: &fid, Err: ctx.Err()}
+		}
+	}()
+
+	return out
+}
+
+func complete(pending map[lustre.Fid]bool, out chan<- *TrackResult, f *lustre.Fid, err error) {
+	delete(pending, *f)
+	fid := *f
+	out <- &TrackResult{Fid: &fid, Err: err}
+}
+
+// follow reads changelog records until all pending files have an HSM
+// event for the tracked action, or ctx is done.
+func (t *Tracker) follow(ctx context.Context, pending map[lustre.Fid]bool, out chan<- *TrackResult) error {
+	event, ok := trackEvents[t.action]
+	if !ok {
+		return errors.New("no HSM event for action " + t.action.String())
+	}
+
+	// The reader stops once follow returns.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	records := make(chan changelog.Record)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			rec, err := t.records.NextRecord()
+			if err == io.EOF {
+				select {
+				case <-time.After(t.pollInterval):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case records <- rec:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case rec := <-records:
+			if rec.TypeCode() != llapi.OpHSM || !pending[*rec.TargetFid()] {
+				continue
+			}
+			if e, ok := rec.HsmEvent(); !ok || e != event {
+				continue
+			}
+			var err error
+			if code := rec.HsmError(); code != 0 {
+				err = syscall.Errno(code)
+			}
+			complete(pending, out, rec.TargetFid(), err)
+		}
+	}
+	return nil
+}
+
+// reached returns true if the file is in the state expected after the
+// tracked action has completed.
+func (t *Tracker) reached(st *FileStatus) bool {
+	switch t.action {
+	case llapi.HsmUserArchive:
+		return st.Archived() && !st.Dirty()
+	case llapi.HsmUserRestore:
+		return !st.Released()
+	case llapi.HsmUserRelease:
+		return st.Released()
+	case llapi.HsmUserRemove:
+		return !st.Exists()
+	}
+	return true
+}
+
+func inProgress(cfa *CurrentFileAction) bool {
+	return cfa != nil && !cfa.IsNone() && (cfa.Waiting() || cfa.Running())
+}
+
+// poll checks the state of each pending file until all have completed,
+// or ctx is done.
+func (t *Tracker) poll(ctx context.Context, pending map[lustre.Fid]bool, out chan<- *TrackResult) {
+	idle := make(map[lustre.Fid]int)
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+
+	for len(pending) > 0 {
+		for f := range pending {
+			fid := f
+			st, cfa, err := t.status(&fid)
+			switch {
+			case err != nil:
+				complete(pending, out, &fid, err)
+			case inProgress(cfa):
+				idle[fid] = 0
+			case t.reached(st):
+				complete(pending, out, &fid, nil)
+			default:
+				idle[fid]++
+				if idle[fid] >= t.idlePolls {
+					complete(pending, out, &fid, ErrActionFailed)
+				}
+			}
+		}
+		if len(pending) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
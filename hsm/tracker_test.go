@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/changelog/simulator"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+// countingRecords counts the calls to NextRecord.
+type countingRecords struct {
+	simulator.RecordList
+	calls int64
+}
+
+func (c *countingRecords) NextRecord() (changelog.Record, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.RecordList.NextRecord()
+}
+
+// hsmRecord returns an OpHSM record for event on fid.
+func hsmRecord(fid *lustre.Fid, event llapi.HsmEvent, errval int) changelog.Record {
+	return simulator.NewTestRecord(0, llapi.OpHSM, fid, simulator.OptRecordHsmEvent(event, errval))
+}
+
+func collectResults(results <-chan *TrackResult) map[lustre.Fid]error {
+	out := make(map[lustre.Fid]error)
+	for r := range results {
+		out[*r.Fid] = r.Err
+	}
+	return out
+}
+
+func TestTrackerChangelog(t *testing.T) {
+	f1 := &lustre.Fid{Seq: 1, Oid: 1}
+	f2 := &lustre.Fid{Seq: 1, Oid: 2}
+	f3 := &lustre.Fid{Seq: 1, Oid: 3}
+	records := simulator.RecordList{
+		hsmRecord(f1, llapi.HsmEventRestore, 0),
+		hsmRecord(f1, llapi.HsmEventArchive, 0),
+		hsmRecord(f2, llapi.HsmEventArchive, int(syscall.ENOSPC)),
+	}
+
+	tracker := NewTracker(fs.RootDir{}, llapi.HsmUserArchive,
+		OptTrackerChangelog(&records),
+		OptTrackerPollInterval(10*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := collectResults(tracker.Track(ctx, []*lustre.Fid{f1, f2, f3}))
+
+	if err, ok := results[*f1]; !ok || err != nil {
+		t.Fatalf("%s: expected success, got %v", f1, err)
+	}
+	if err := results[*f2]; err != syscall.ENOSPC {
+		t.Fatalf("%s: expected ENOSPC, got %v", f2, err)
+	}
+	if err := results[*f3]; err != context.DeadlineExceeded {
+		t.Fatalf("%s: expected deadline exceeded, got %v", f3, err)
+	}
+}
+
+func TestTrackerStopsReading(t *testing.T) {
+	f1 := &lustre.Fid{Seq: 1, Oid: 1}
+	records := &countingRecords{RecordList: simulator.RecordList{
+		hsmRecord(f1, llapi.HsmEventArchive, 0),
+	}}
+
+	tracker := NewTracker(fs.RootDir{}, llapi.HsmUserArchive,
+		OptTrackerChangelog(records),
+		OptTrackerPollInterval(time.Millisecond))
+	results := collectResults(tracker.Track(context.Background(), []*lustre.Fid{f1}))
+	if err, ok := results[*f1]; !ok || err != nil {
+		t.Fatalf("%s: expected success, got %v", f1, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	calls := atomic.LoadInt64(&records.calls)
+	time.Sleep(20 * time.Millisecond)
+	if after := atomic.LoadInt64(&records.calls); after != calls {
+		t.Fatalf("changelog still read after tracking ended: %d calls, was %d", after, calls)
+	}
+}
+
+func TestTrackerPoll(t *testing.T) {
+	archived := &FileStatus{state: llapi.HsmFileState(llapi.HsmFileExists | llapi.HsmFileArchived)}
+	running := &CurrentFileAction{action: llapi.HsmUserArchive, state: llapi.HsmProgressRunning}
+	idle := &CurrentFileAction{action: llapi.HsmUserNone}
+
+	f1 := &lustre.Fid{Seq: 1, Oid: 1}
+	f2 := &lustre.Fid{Seq: 1, Oid: 2}
+	polls := make(map[lustre.Fid]int)
+
+	tracker := NewTracker(fs.RootDir{}, llapi.HsmUserArchive,
+		OptTrackerPollInterval(time.Millisecond))
+	tracker.status = func(f *lustre.Fid) (*FileStatus, *CurrentFileAction, error) {
+		polls[*f]++
+		switch {
+		case *f == *f1 && polls[*f] < 3:
+			return &FileStatus{}, running, nil
+		case *f == *f1:
+			return archived, idle, nil
+		}
+		return &FileStatus{}, idle, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	results := collectResults(tracker.Track(ctx, []*lustre.Fid{f1, f2}))
+
+	if err, ok := results[*f1]; !ok || err != nil {
+		t.Fatalf("%s: expected success, got %v", f1, err)
+	}
+	if err := results[*f2]; err != ErrActionFailed {
+		t.Fatalf("%s: expected ErrActionFailed, got %v", f2, err)
+	}
+}
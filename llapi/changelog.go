@@ -52,6 +52,16 @@ func (he *HsmEvent) String() string {
 	}
 }
 
+// HSM events reported in the flags of OpHSM changelog records.
+const (
+	HsmEventArchive = HsmEvent(C.HE_ARCHIVE)
+	HsmEventRestore = HsmEvent(C.HE_RESTORE)
+	HsmEventCancel  = HsmEvent(C.HE_CANCEL)
+	HsmEventRelease = HsmEvent(C.HE_RELEASE)
+	HsmEventRemove  = HsmEvent(C.HE_REMOVE)
+	HsmEventState   = HsmEvent(C.HE_STATE)
+)
+
 // Changelog is opaque data representing an open changelog.
 type Changelog struct {
 	priv *byte
@@ -296,6 +306,29 @@ func (r *ChangelogRecord) flagStrings() []string {
 	return flagStrings
 }
 
+// Flags returns the raw flags of the record.
+func (r *ChangelogRecord) Flags() uint {
+	return r.flags
+}
+
+// HsmEvent returns the HSM event of an OpHSM record. The second
+// value is false for all other record types.
+func (r *ChangelogRecord) HsmEvent() (HsmEvent, bool) {
+	if r.rType != OpHSM {
+		return 0, false
+	}
+	return HsmEvent(C.hsm_get_cl_event(C.__u16(r.flags))), true
+}
+
+// HsmError returns the error reported by an OpHSM record, or 0 if the
+// HSM action succeeded or this is not an OpHSM record.
+func (r *ChangelogRecord) HsmError() int {
+	if r.rType != OpHSM {
+		return 0
+	}
+	return int(C.hsm_get_cl_error(C.int(r.flags)))
+}
+
 // IsLastUnlink returns a tuple of boolean values to indicate:
 // 1) Whether or not the unlink was for the the last hardlink
 // 2) Whether or not there may still be an archive of the file in HSM
@@ -0,0 +1,37 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package llapi
+
+/*
+#include <lustre/lustreapi.h>
+*/
+import "C"
+
+// DataVersionFlag controls how the data version is read.
+type DataVersionFlag uint64
+
+const (
+	// DataVersionNoFlush reads the version without taking a lock, so
+	// it doesn't reflect data still cached by clients.
+	DataVersionNoFlush = DataVersionFlag(0)
+	// DataVersionReadFlush takes a read lock, which flushes dirty
+	// data cached by clients before the version is read.
+	DataVersionReadFlush = DataVersionFlag(C.LL_DV_RD_FLUSH)
+	// DataVersionWriteFlush takes a write lock, which flushes dirty
+	// data and drops cached data on all clients.
+	DataVersionWriteFlush = DataVersionFlag(C.LL_DV_WR_FLUSH)
+)
+
+// GetDataVersion returns the data version of an open file. The data
+// version changes whenever the file data is modified, so it can be
+// used to detect writes made during a copy.
+func GetDataVersion(fd int, flags DataVersionFlag) (uint64, error) {
+	var dv C.__u64
+	rc, err := C.llapi_get_data_version(C.int(fd), &dv, C.__u64(flags))
+	if err := isError(rc, err); err != nil {
+		return 0, err
+	}
+	return uint64(dv), nil
+}
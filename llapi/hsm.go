@@ -117,14 +117,37 @@ const (
 	CopytoolNonBlock = HsmCopytoolFlags(C.O_NONBLOCK)
 )
 
+// HSM progress flags, passed to HsmActionProgress and HsmActionEnd
+const (
+	// HsmProgressFlagCompleted indicates the action has completed.
+	HsmProgressFlagCompleted = int(C.HP_FLAG_COMPLETED)
+	// HsmProgressFlagRetry asks the coordinator to reschedule a failed action.
+	HsmProgressFlagRetry = int(C.HP_FLAG_RETRY)
+)
+
 // HsmCopytoolRegister connects the agent to the HSM Coordinators on all the MDTs.
 // if CopytooLNonBLock flag is passed, then the HsmCopytoolRecv() will not block
 // and poll() could used on the coordinator's descriptor.
+// The agent receives actions for the first archiveCount archive IDs in
+// archives, or for all archives if archiveCount is 0.
 func HsmCopytoolRegister(path string, archiveCount int, archives []int, flags HsmCopytoolFlags) (*HsmCopytoolPrivate, error) {
 	var hcp *C.struct_hsm_copytool_private
+	if archiveCount < 0 || archiveCount > len(archives) {
+		return nil, fmt.Errorf("invalid archive count %d for %d archives", archiveCount, len(archives))
+	}
+
+	var carchives *C.int
+	if archiveCount > 0 {
+		ids := make([]C.int, archiveCount)
+		for i := range ids {
+			ids[i] = C.int(archives[i])
+		}
+		carchives = &ids[0]
+	}
+
 	cpath := C.CString(string(path))
 	defer C.free(unsafe.Pointer(cpath))
-	rc, err := C.llapi_hsm_copytool_register(&hcp, cpath, 0, nil, C.int(flags))
+	rc, err := C.llapi_hsm_copytool_register(&hcp, cpath, C.int(archiveCount), carchives, C.int(flags))
 	if err := isError(rc, err); err != nil {
 		return nil, err
 	}
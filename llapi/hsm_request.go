@@ -7,6 +7,7 @@ package llapi
 //
 // #include <fcntl.h>
 // #include <stdlib.h>
+// #include <string.h>
 // #include <lustre/lustreapi.h>
 //
 // /* CGO 1.5 doesn't support zero byte fields at the
@@ -15,10 +16,23 @@ package llapi
 // struct hsm_user_item *_hur_user_item(struct hsm_user_request  *hur) {
 //     return &hur->hur_user_item[0];
 // }
+//
+// /* hur_data() is inline in lustre_user.h */
+// void *_hur_data(struct hsm_user_request *hur) {
+//     return hur_data(hur);
+// }
+//
+// /* The size llapi_hsm_user_request_alloc() allocates. */
+// size_t _hur_alloc_len(int itemcount, int data_len) {
+//     return sizeof(struct hsm_user_request) +
+//         sizeof(struct hsm_user_item) * itemcount + data_len;
+// }
 import "C"
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"syscall"
 	"unsafe"
 
 	"github.com/intel-hpdd/go-lustre"
@@ -48,6 +62,24 @@ const (
 	HsmUserCancel = HsmUserAction(C.HUA_CANCEL)
 )
 
+// HsmRequestFlag modifies how the coordinator handles a request.
+type HsmRequestFlag uint64
+
+const (
+	// HsmForceAction causes the action to be performed even if the
+	// coordinator considers it unnecessary.
+	HsmForceAction = HsmRequestFlag(C.HSM_FORCE_ACTION)
+	// HsmGhostCopy causes an archive copy to be made without updating
+	// the file's HSM state.
+	HsmGhostCopy = HsmRequestFlag(C.HSM_GHOST_COPY)
+)
+
+// HsmUserItem is a file and extent in an HSM request.
+type HsmUserItem struct {
+	Fid    *lustre.Fid
+	Extent HsmExtent
+}
+
 func (action HsmUserAction) String() string {
 	return C.GoString(C.hsm_user_action2name(C.enum_hsm_user_action(action)))
 }
@@ -81,44 +113,81 @@ func HsmRequest(r string, cmd HsmUserAction, archiveID uint, fidsToSend []*lustr
 }
 
 func hsmRequest(r string, cmd HsmUserAction, archiveID uint, fids []*lustre.Fid) (int, error) {
-	fileCount := len(fids)
-	hur := C.llapi_hsm_user_request_alloc(C.int(fileCount), 0)
-	defer C.free(unsafe.Pointer(hur))
+	items := make([]HsmUserItem, len(fids))
+	for i, f := range fids {
+		items[i] = HsmUserItem{
+			Fid:    f,
+			Extent: HsmExtent{Offset: 0, Length: lustre.MaxExtentLength},
+		}
+	}
+
+	if err := HsmRequestItems(r, cmd, archiveID, 0, items, nil); err != nil {
+		return 0, fmt.Errorf("lustre: Got error from llapi_hsm_request: %s", err.Error())
+	}
+	return len(items), nil
+}
+
+// HsmRequestItems submits a single HSM request for the items, with
+// the request flags and opaque data, which is passed to the copytool
+// with each action. An extent length of lustre.MaxExtentLength extends
+// to the end of the file. The error is returned unwrapped, so callers
+// can check for errors such as E2BIG.
+func HsmRequestItems(r string, cmd HsmUserAction, archiveID uint, flags HsmRequestFlag, items []HsmUserItem, data []byte) error {
+	if len(items) < 1 {
+		return fmt.Errorf("lustre: Request must include at least 1 file")
+	}
+
+	// The data length is an int when allocated and a __u32 in the
+	// request.
+	if len(data) > math.MaxInt32 || uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("lustre: Request data is too large (%d bytes)", len(data))
+	}
+
+	itemCount := len(items)
+	hur := C.llapi_hsm_user_request_alloc(C.int(itemCount), C.int(len(data)))
 	if hur == nil {
-		panic("Failed to allocate HSM User Request struct!")
+		return syscall.ENOMEM
 	}
+	defer C.free(unsafe.Pointer(hur))
 
 	hur.hur_request.hr_action = C.__u32(cmd)
 	hur.hur_request.hr_archive_id = C.__u32(archiveID)
-	hur.hur_request.hr_flags = 0
+	hur.hur_request.hr_flags = C.__u64(flags)
 	hur.hur_request.hr_itemcount = 0
 	hur.hur_request.hr_data_len = 0
 
 	// https://code.google.com/p/go-wiki/wiki/cgo#Turning_C_arrays_into_Go_slices
 	hdr := reflect.SliceHeader{
 		Data: uintptr(unsafe.Pointer(C._hur_user_item(hur))),
-		Len:  fileCount,
-		Cap:  fileCount,
+		Len:  itemCount,
+		Cap:  itemCount,
 	}
 	userItems := *(*[]C.struct_hsm_user_item)(unsafe.Pointer(&hdr))
-	for i, f := range fids {
-		userItems[i].hui_extent.offset = 0
-		userItems[i].hui_extent.length = C.__u64(^uint(0))
-		userItems[i].hui_fid = *toCFid(f)
+	for i, item := range items {
+		userItems[i].hui_extent.offset = C.__u64(item.Extent.Offset)
+		if item.Extent.Length == lustre.MaxExtentLength {
+			userItems[i].hui_extent.length = C.__u64(math.MaxUint64)
+		} else {
+			userItems[i].hui_extent.length = C.__u64(item.Extent.Length)
+		}
+		userItems[i].hui_fid = *toCFid(item.Fid)
 		hur.hur_request.hr_itemcount++
 	}
 
-	num := int(hur.hur_request.hr_itemcount)
-	if num != fileCount {
-		return 0, fmt.Errorf("lustre: Can't submit incomplete request (%d/%d)", num, fileCount)
+	// The data follows the items, so it must be copied after the
+	// item count is set.
+	if len(data) > 0 {
+		dst := C._hur_data(hur)
+		end := uintptr(unsafe.Pointer(hur)) + uintptr(C._hur_alloc_len(C.int(itemCount), C.int(len(data))))
+		if uintptr(dst)+uintptr(len(data)) > end {
+			return fmt.Errorf("lustre: Request data (%d bytes) overruns the request", len(data))
+		}
+		C.memcpy(dst, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+		hur.hur_request.hr_data_len = C.__u32(len(data))
 	}
 
 	buf := C.CString(r)
 	defer C.free(unsafe.Pointer(buf))
 	rc, err := C.llapi_hsm_request(buf, hur)
-	if err := isError(rc, err); err != nil {
-		return 0, fmt.Errorf("lustre: Got error from llapi_hsm_request: %s", err.Error())
-	}
-
-	return num, nil
+	return isError(rc, err)
 }
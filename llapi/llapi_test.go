@@ -1,6 +1,7 @@
 package llapi
 
 import (
+	"encoding/binary"
 	"math"
 	"testing"
 
@@ -52,3 +53,46 @@ func err2Str(err error) (str string) {
 	}
 	return
 }
+
+func TestSanitizeLovEA(t *testing.T) {
+	plain := make([]byte, lovUserMdV1Size+24)
+	binary.LittleEndian.PutUint32(plain, lovUserMagicV1)
+	binary.LittleEndian.PutUint16(plain[lovStripeOffset:], 3)
+
+	lum, err := sanitizeLovEA(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := binary.LittleEndian.Uint16(lum[lovStripeOffset:]); off != 0xffff {
+		t.Fatalf("stripe offset %d, expected -1", off)
+	}
+	if binary.LittleEndian.Uint16(plain[lovStripeOffset:]) != 3 {
+		t.Fatal("original layout was modified")
+	}
+
+	compOff := lovCompHeaderSize + lovCompEntrySize
+	comp := make([]byte, compOff+len(plain))
+	binary.LittleEndian.PutUint32(comp, lovUserMagicCompV1)
+	binary.LittleEndian.PutUint16(comp[14:], 1)
+	binary.LittleEndian.PutUint32(comp[lovCompHeaderSize+lovCompEntryFlags:], lcmeFlagInit|1)
+	binary.LittleEndian.PutUint32(comp[lovCompHeaderSize+lovCompEntryOffset:], uint32(compOff))
+	copy(comp[compOff:], plain)
+
+	lum, err = sanitizeLovEA(comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := binary.LittleEndian.Uint32(lum[lovCompHeaderSize+lovCompEntryFlags:]); flags != 1 {
+		t.Fatalf("component flags 0x%x, expected 0x1", flags)
+	}
+	if off := binary.LittleEndian.Uint16(lum[compOff+lovStripeOffset:]); off != 0xffff {
+		t.Fatalf("component stripe offset %d, expected -1", off)
+	}
+
+	if _, err := sanitizeLovEA(comp[:compOff]); err == nil {
+		t.Fatal("expected error for truncated composite layout")
+	}
+	if _, err := sanitizeLovEA([]byte{1, 2, 3, 4}); err == nil {
+		t.Fatal("expected error for unknown magic")
+	}
+}
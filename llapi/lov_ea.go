@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package llapi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
+)
+
+// xattrLustreLov is the virtual xattr used to get and set the full
+// layout of a file.
+const xattrLustreLov = "lustre.lov"
+
+// Layout EA magic numbers and offsets, from lustre_user.h. Layouts are
+// stored little-endian.
+const (
+	lovUserMagicV1     = 0x0BD10BD0
+	lovUserMagicV3     = 0x0BD30BD0
+	lovUserMagicCompV1 = 0x0BD60BD0
+
+	// offset of lmm_stripe_offset in lov_user_md_v1 and v3
+	lovStripeOffset = 30
+	// size of a lov_user_md_v1 header, without objects
+	lovUserMdV1Size = 32
+
+	// size of the lov_comp_md_v1 header and each entry
+	lovCompHeaderSize = 32
+	lovCompEntrySize  = 48
+	// offsets of lcme_flags and lcme_offset in a component entry
+	lovCompEntryFlags  = 4
+	lovCompEntryOffset = 24
+
+	// lcmeFlagInit marks a component whose objects are allocated
+	lcmeFlagInit = 0x10
+)
+
+// FileLovEA returns the raw layout of an open file, including the pool
+// name and all components of a composite (PFL) layout.
+func FileLovEA(fd int) ([]byte, error) {
+	for {
+		sz, err := xattr.Fgetxattr(fd, xattrLustreLov, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		n, err := xattr.Fgetxattr(fd, xattrLustreLov, buf)
+		if err == syscall.ERANGE {
+			// the layout grew between calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// SetFileLovEA applies a layout returned by FileLovEA to an open file
+// that does not have a layout yet, such as a file opened with
+// LovDelayCreate. The objects of the original layout are not reused, so
+// the MDS is free to choose new OSTs within the same pool.
+func SetFileLovEA(fd int, ea []byte) error {
+	lum, err := sanitizeLovEA(ea)
+	if err != nil {
+		return err
+	}
+	return xattr.Fsetxattr(fd, xattrLustreLov, lum, xattr.CREATE)
+}
+
+// sanitizeLovEA returns a copy of the layout with the starting OST of
+// each plain layout cleared and composite components marked as not yet
+// instantiated.
+func sanitizeLovEA(ea []byte) ([]byte, error) {
+	if len(ea) < 4 {
+		return nil, fmt.Errorf("layout too short: %d bytes", len(ea))
+	}
+	lum := make([]byte, len(ea))
+	copy(lum, ea)
+
+	switch magic := binary.LittleEndian.Uint32(lum); magic {
+	case lovUserMagicV1, lovUserMagicV3:
+		return lum, clearStripeOffset(lum)
+	case lovUserMagicCompV1:
+		if len(lum) < lovCompHeaderSize {
+			return nil, fmt.Errorf("composite layout too short: %d bytes", len(lum))
+		}
+		count := int(binary.LittleEndian.Uint16(lum[14:]))
+		for i := 0; i < count; i++ {
+			entry := lovCompHeaderSize + i*lovCompEntrySize
+			if entry+lovCompEntrySize > len(lum) {
+				return nil, fmt.Errorf("composite layout truncated at component %d", i)
+			}
+			flags := binary.LittleEndian.Uint32(lum[entry+lovCompEntryFlags:])
+			binary.LittleEndian.PutUint32(lum[entry+lovCompEntryFlags:], flags&^lcmeFlagInit)
+
+			off := int(binary.LittleEndian.Uint32(lum[entry+lovCompEntryOffset:]))
+			if off < 0 || off > len(lum) {
+				return nil, fmt.Errorf("component %d offset %d out of range", i, off)
+			}
+			if err := clearStripeOffset(lum[off:]); err != nil {
+				return nil, fmt.Errorf("component %d: %v", i, err)
+			}
+		}
+		return lum, nil
+	default:
+		return nil, fmt.Errorf("unknown layout magic 0x%08x", magic)
+	}
+}
+
+func clearStripeOffset(lum []byte) error {
+	if len(lum) < lovUserMdV1Size {
+		return fmt.Errorf("layout too short: %d bytes", len(lum))
+	}
+	binary.LittleEndian.PutUint16(lum[lovStripeOffset:], 0xffff)
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package luser
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fsxattr mirrors struct fsxattr from linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// FS_IOC_FSGETXATTR is _IOR('X', 31, struct fsxattr)
+const fsIocFsgetxattr = 0x801c581f
+
+// GetProjectID returns the project ID of the file.
+func GetProjectID(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var fsx fsxattr
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(fsIocFsgetxattr), uintptr(unsafe.Pointer(&fsx)))
+	if errno != 0 {
+		return 0, os.NewSyscallError("ioctl", errno)
+	}
+	return fsx.projid, nil
+}
@@ -112,12 +112,17 @@ func Fsetxattr(fd int, attr string, value []byte, flags int) error {
 		return err
 	}
 
-	valuePtr := &value[0]
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	} else {
+		valuePtr = unsafe.Pointer(&_zero)
+	}
 
 	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR,
 		uintptr(fd),
 		uintptr(unsafe.Pointer(attrBuf)),
-		uintptr(unsafe.Pointer(valuePtr)),
+		uintptr(valuePtr),
 		uintptr(len(value)),
 		uintptr(flags),
 		0)
@@ -126,3 +131,58 @@ func Fsetxattr(fd int, attr string, value []byte, flags int) error {
 	}
 	return errno
 }
+
+// Llistxattr returns the NUL-separated list of extended attribute names
+// for the path name.
+func Llistxattr(path string, dest []byte) (sz int, err error) {
+	pathBuf, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return
+	}
+
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	} else {
+		buf = unsafe.Pointer(&_zero)
+	}
+
+	rc, _, errno := syscall.Syscall6(syscall.SYS_LISTXATTR,
+		uintptr(unsafe.Pointer(pathBuf)),
+		uintptr(buf),
+		uintptr(len(dest)),
+		0,
+		0,
+		0)
+
+	sz = int(rc)
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// Flistxattr returns the NUL-separated list of extended attribute names
+// for the file descriptor.
+func Flistxattr(fd int, dest []byte) (sz int, err error) {
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	} else {
+		buf = unsafe.Pointer(&_zero)
+	}
+
+	rc, _, errno := syscall.Syscall6(syscall.SYS_FLISTXATTR,
+		uintptr(fd),
+		uintptr(buf),
+		uintptr(len(dest)),
+		0,
+		0,
+		0)
+
+	sz = int(rc)
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
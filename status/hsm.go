@@ -0,0 +1,482 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+// DefaultParamRoot is the directory holding the Lustre parameter files.
+const DefaultParamRoot = procBase
+
+// CoordinatorState is the state of an MDT's HSM coordinator, as shown
+// and set through hsm_control.
+type CoordinatorState string
+
+// Coordinator states. CoordinatorPurge can only be set; it cancels all
+// requests and leaves the state unchanged.
+const (
+	CoordinatorEnabled  = CoordinatorState("enabled")
+	CoordinatorStopped  = CoordinatorState("stopped")
+	CoordinatorDisabled = CoordinatorState("disabled")
+	CoordinatorShutdown = CoordinatorState("shutdown")
+	CoordinatorPurge    = CoordinatorState("purge")
+)
+
+type (
+	// Coordinator reads and controls the HSM coordinator of an MDT
+	// through its parameter files.
+	Coordinator struct {
+		Name string
+		dir  string
+	}
+
+	// HsmExtent is the inclusive byte range of a request.
+	HsmExtent struct {
+		Start uint64
+		End   uint64
+	}
+
+	// HsmRequest is the description of a request shared by
+	// hsm.actions and hsm.active_requests.
+	HsmRequest struct {
+		Fid        lustre.Fid
+		DataFid    lustre.Fid
+		CompoundID uint64
+		Cookie     uint64
+		Action     string
+		ArchiveID  uint
+		Flags      uint64
+		Extent     HsmExtent
+		Gid        uint64
+		Data       string
+	}
+
+	// CoordinatorAction is a record from hsm.actions, the
+	// coordinator's log of requests.
+	CoordinatorAction struct {
+		HsmRequest
+		// Index is the record index in the log.
+		Index  int
+		Status string
+	}
+
+	// ActiveRequest is a request that has been sent to an agent,
+	// from hsm.active_requests.
+	ActiveRequest struct {
+		HsmRequest
+		AgentUUID string
+		Canceled  bool
+		Done      bool
+	}
+
+	// HsmAgent is a copytool registered with the coordinator, from
+	// hsm.agents.
+	HsmAgent struct {
+		UUID string
+		// ArchiveIDs is nil if the agent handles any archive.
+		ArchiveIDs []uint
+		Current    int
+		OK         int
+		Errors     int
+	}
+
+	// HsmPolicy is the coordinator policy set in hsm.policy.
+	HsmPolicy struct {
+		NonBlockingRestore bool
+		NoRetryAction      bool
+	}
+
+	// HsmTimeouts are the coordinator's tunables.
+	HsmTimeouts struct {
+		ActiveRequestTimeout time.Duration
+		LoopPeriod           time.Duration
+		GraceDelay           time.Duration
+		MaxRequests          int
+		DefaultArchiveID     uint
+	}
+)
+
+// Coordinators returns the coordinators of the MDTs with parameter files
+// under root, which is normally DefaultParamRoot.
+func Coordinators(root string) ([]*Coordinator, error) {
+	matches, err := filepath.Glob(filepath.Join(root, "mdt", "*-MDT*"))
+	if err != nil {
+		return nil, err
+	}
+	var cdts []*Coordinator
+	for _, m := range matches {
+		cdts = append(cdts, NewCoordinator(root, filepath.Base(m)))
+	}
+	return cdts, nil
+}
+
+// NewCoordinator returns the coordinator of the named MDT, such as
+// lustre-MDT0000, with parameter files under root.
+func NewCoordinator(root, mdt string) *Coordinator {
+	return &Coordinator{Name: mdt, dir: filepath.Join(root, "mdt", mdt)}
+}
+
+func (c *Coordinator) String() string {
+	return c.Name
+}
+
+func (c *Coordinator) param(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+func (c *Coordinator) readParam(name string) (string, error) {
+	b, err := ioutil.ReadFile(c.param(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// State returns the state of the coordinator.
+func (c *Coordinator) State() (CoordinatorState, error) {
+	s, err := c.readParam("hsm_control")
+	return CoordinatorState(s), err
+}
+
+// SetState enables, disables or shuts down the coordinator, or purges
+// its requests.
+func (c *Coordinator) SetState(state CoordinatorState) error {
+	switch state {
+	case CoordinatorEnabled, CoordinatorDisabled, CoordinatorShutdown, CoordinatorPurge:
+	default:
+		return errors.Errorf("invalid coordinator state: %q", state)
+	}
+	f, err := os.OpenFile(c.param("hsm_control"), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(string(state)); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "set %s hsm_control", c)
+	}
+	return f.Close()
+}
+
+// Actions returns the records in the coordinator's log of requests.
+func (c *Coordinator) Actions() ([]CoordinatorAction, error) {
+	f, err := os.Open(c.param("hsm/actions"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCoordinatorActions(f)
+}
+
+// ActiveRequests returns the requests being processed by agents.
+func (c *Coordinator) ActiveRequests() ([]ActiveRequest, error) {
+	f, err := os.Open(c.param("hsm/active_requests"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseActiveRequests(f)
+}
+
+// Agents returns the copytools registered with the coordinator.
+func (c *Coordinator) Agents() ([]HsmAgent, error) {
+	f, err := os.Open(c.param("hsm/agents"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHsmAgents(f)
+}
+
+// Policy returns the coordinator policy.
+func (c *Coordinator) Policy() (*HsmPolicy, error) {
+	s, err := c.readParam("hsm/policy")
+	if err != nil {
+		return nil, err
+	}
+	return ParseHsmPolicy(s)
+}
+
+// Timeouts returns the coordinator's tunables.
+func (c *Coordinator) Timeouts() (*HsmTimeouts, error) {
+	var t HsmTimeouts
+	for name, set := range map[string]func(int64){
+		"active_request_timeout": func(n int64) { t.ActiveRequestTimeout = time.Duration(n) * time.Second },
+		"loop_period":            func(n int64) { t.LoopPeriod = time.Duration(n) * time.Second },
+		"grace_delay":            func(n int64) { t.GraceDelay = time.Duration(n) * time.Second },
+		"max_requests":           func(n int64) { t.MaxRequests = int(n) },
+		"default_archive_id":     func(n int64) { t.DefaultArchiveID = uint(n) },
+	} {
+		s, err := c.readParam("hsm/" + name)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", name)
+		}
+		set(n)
+	}
+	return &t, nil
+}
+
+// splitFields splits a line into key=value fields separated by spaces,
+// keeping spaces within brackets as part of the value.
+func splitFields(line string) (map[string]string, error) {
+	fields := make(map[string]string)
+	var depth, start int
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) {
+			switch line[i] {
+			case '[':
+				depth++
+				continue
+			case ']':
+				depth--
+				continue
+			case ' ', '\t':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if field := line[start:i]; field != "" {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.Errorf("invalid field %q", field)
+			}
+			fields[kv[0]] = kv[1]
+		}
+		start = i + 1
+	}
+	return fields, nil
+}
+
+func trimBrackets(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+}
+
+func parseHex(s string) (uint64, error) {
+	return strconv.ParseUint(s, 0, 64)
+}
+
+// requestFields are the fields of a request that must be present.
+var requestFields = []string{"fid", "dfid", "compound/cookie", "action", "archive#", "flags", "extent", "gid"}
+
+func parseRequest(f map[string]string) (*HsmRequest, error) {
+	for _, key := range requestFields {
+		if _, ok := f[key]; !ok {
+			return nil, errors.Errorf("missing %s", key)
+		}
+	}
+
+	var r HsmRequest
+	fid, err := lustre.ParseFid(f["fid"])
+	if err != nil {
+		return nil, err
+	}
+	r.Fid = *fid
+	if fid, err = lustre.ParseFid(f["dfid"]); err != nil {
+		return nil, err
+	}
+	r.DataFid = *fid
+
+	ids := strings.SplitN(f["compound/cookie"], "/", 2)
+	if len(ids) != 2 {
+		return nil, errors.Errorf("invalid compound/cookie %q", f["compound/cookie"])
+	}
+	if r.CompoundID, err = parseHex(ids[0]); err != nil {
+		return nil, err
+	}
+	if r.Cookie, err = parseHex(ids[1]); err != nil {
+		return nil, err
+	}
+
+	r.Action = f["action"]
+	archiveID, err := strconv.ParseUint(f["archive#"], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	r.ArchiveID = uint(archiveID)
+	if r.Flags, err = parseHex(f["flags"]); err != nil {
+		return nil, err
+	}
+
+	extent := strings.SplitN(f["extent"], "-", 2)
+	if len(extent) != 2 {
+		return nil, errors.Errorf("invalid extent %q", f["extent"])
+	}
+	if r.Extent.Start, err = parseHex(extent[0]); err != nil {
+		return nil, err
+	}
+	if r.Extent.End, err = parseHex(extent[1]); err != nil {
+		return nil, err
+	}
+	if r.Gid, err = parseHex(f["gid"]); err != nil {
+		return nil, err
+	}
+	r.Data = trimBrackets(f["data"])
+	return &r, nil
+}
+
+// parseLines calls fn with the fields of each non-empty line in r.
+func parseLines(r io.Reader, fn func(fields map[string]string) error) error {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields, err := splitFields(line)
+		if err == nil {
+			err = fn(fields)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "line %d", lineno)
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseCoordinatorActions parses the contents of hsm.actions.
+func ParseCoordinatorActions(r io.Reader) ([]CoordinatorAction, error) {
+	var actions []CoordinatorAction
+	err := parseLines(r, func(f map[string]string) error {
+		req, err := parseRequest(f)
+		if err != nil {
+			return err
+		}
+		a := CoordinatorAction{HsmRequest: *req, Status: f["status"]}
+		lrh, err := splitFields(trimBrackets(f["lrh"]))
+		if err != nil {
+			return err
+		}
+		// idx is the catalog index and the record index in the llog.
+		if idx := strings.SplitN(lrh["idx"], "/", 2); len(idx) == 2 {
+			if a.Index, err = strconv.Atoi(idx[1]); err != nil {
+				return err
+			}
+		}
+		actions = append(actions, a)
+		return nil
+	})
+	return actions, err
+}
+
+// ParseActiveRequests parses the contents of hsm.active_requests.
+func ParseActiveRequests(r io.Reader) ([]ActiveRequest, error) {
+	var requests []ActiveRequest
+	err := parseLines(r, func(f map[string]string) error {
+		req, err := parseRequest(f)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, ActiveRequest{
+			HsmRequest: *req,
+			AgentUUID:  f["uuid"],
+			Canceled:   f["canceled"] == "1",
+			Done:       f["done"] == "1",
+		})
+		return nil
+	})
+	return requests, err
+}
+
+// ParseHsmAgents parses the contents of hsm.agents.
+func ParseHsmAgents(r io.Reader) ([]HsmAgent, error) {
+	var agents []HsmAgent
+	err := parseLines(r, func(f map[string]string) error {
+		a := HsmAgent{UUID: f["uuid"]}
+		if ids := f["archive_id"]; ids != "ANY" {
+			for _, id := range strings.Split(ids, ",") {
+				if id == "" {
+					continue
+				}
+				n, err := strconv.ParseUint(id, 10, 32)
+				if err != nil {
+					return err
+				}
+				a.ArchiveIDs = append(a.ArchiveIDs, uint(n))
+			}
+		}
+		for _, count := range strings.Fields(trimBrackets(f["requests"])) {
+			kv := strings.SplitN(count, ":", 2)
+			if len(kv) != 2 {
+				return errors.Errorf("invalid request count %q", count)
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return err
+			}
+			switch kv[0] {
+			case "current":
+				a.Current = n
+			case "ok":
+				a.OK = n
+			case "errors":
+				a.Errors = n
+			}
+		}
+		agents = append(agents, a)
+		return nil
+	})
+	return agents, err
+}
+
+// ParseHsmPolicy parses the contents of hsm.policy, in which the enabled
+// flags are shown in brackets.
+func ParseHsmPolicy(s string) (*HsmPolicy, error) {
+	var p HsmPolicy
+	for _, flag := range strings.Fields(s) {
+		enabled := strings.HasPrefix(flag, "[")
+		switch trimBrackets(flag) {
+		case "NonBlockingRestore", "NBR":
+			p.NonBlockingRestore = enabled
+		case "NoRetryAction", "NRA":
+			p.NoRetryAction = enabled
+		default:
+			return nil, errors.Errorf("unknown policy %q", flag)
+		}
+	}
+	return &p, nil
+}
+
+func (p *HsmPolicy) String() string {
+	var flags []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"NonBlockingRestore", p.NonBlockingRestore},
+		{"NoRetryAction", p.NoRetryAction},
+	} {
+		if f.enabled {
+			flags = append(flags, "["+f.name+"]")
+		} else {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+func (e HsmExtent) String() string {
+	return fmt.Sprintf("%#x-%#x", e.Start, e.End)
+}
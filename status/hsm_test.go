@@ -0,0 +1,134 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+func TestCoordinator(t *testing.T) {
+	cdts, err := Coordinators("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cdts) != 1 || cdts[0].Name != "lustre-MDT0000" {
+		t.Fatalf("unexpected coordinators: %v", cdts)
+	}
+	c := cdts[0]
+
+	if state, err := c.State(); err != nil || state != CoordinatorEnabled {
+		t.Fatalf("got state %q, %v", state, err)
+	}
+
+	actions, err := c.Actions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 3 {
+		t.Fatalf("got %d actions, expected 3", len(actions))
+	}
+	a := actions[1]
+	if a.Index != 4 || a.Status != "STARTED" || a.Action != "RESTORE" || a.ArchiveID != 2 ||
+		a.Cookie != 0x57d1d2a9 || a.Fid != (lustre.Fid{Seq: 0x200000400, Oid: 2}) ||
+		a.Extent != (HsmExtent{0, 1<<64 - 1}) || a.Data != "746170653d31" {
+		t.Fatalf("unexpected action: %+v", a)
+	}
+
+	active, err := c.ActiveRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].AgentUUID != "a7d4c1e8-9a9b-1e3a-7a43-3e0a1c6c0a1e" ||
+		active[0].DataFid != (lustre.Fid{Seq: 0x200000401, Oid: 7}) || active[0].Canceled || active[0].Done {
+		t.Fatalf("unexpected active requests: %+v", active)
+	}
+
+	agents, err := c.Agents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HsmAgent{
+		{UUID: "a7d4c1e8-9a9b-1e3a-7a43-3e0a1c6c0a1e", ArchiveIDs: []uint{2, 3}, Current: 1, OK: 12, Errors: 2},
+		{UUID: "0c4e2f7a-55b1-4d3e-8e4a-6f1f2b9d3c10", OK: 40},
+	}
+	if !reflect.DeepEqual(agents, expected) {
+		t.Fatalf("got agents %+v, expected %+v", agents, expected)
+	}
+
+	policy, err := c.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.NonBlockingRestore || policy.NoRetryAction || policy.String() != "[NonBlockingRestore] NoRetryAction" {
+		t.Fatalf("unexpected policy: %s", policy)
+	}
+
+	timeouts, err := c.Timeouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *timeouts != (HsmTimeouts{
+		ActiveRequestTimeout: time.Hour,
+		LoopPeriod:           10 * time.Second,
+		GraceDelay:           time.Minute,
+		MaxRequests:          3,
+		DefaultArchiveID:     1,
+	}) {
+		t.Fatalf("unexpected timeouts: %+v", timeouts)
+	}
+}
+
+func TestCoordinatorSetState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mdt := filepath.Join(dir, "mdt", "lustre-MDT0001")
+	if err := os.MkdirAll(mdt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mdt, "hsm_control"), []byte("enabled\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCoordinator(dir, "lustre-MDT0001")
+	if err := c.SetState(CoordinatorShutdown); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := c.State(); err != nil || state != CoordinatorShutdown {
+		t.Fatalf("got state %q, %v", state, err)
+	}
+	if err := c.SetState(CoordinatorStopped); err == nil {
+		t.Fatal("expected error setting read-only state")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, bad := range []string{
+		"fid=[0x1:0x2:0x0] dfid=[0x1:0x2:0x0] compound/cookie=0x1 action=ARCHIVE archive#=1 flags=0x0 extent=0x0-0x1 gid=0x0",
+		"fid=[bogus] dfid=[0x1:0x2:0x0] compound/cookie=0x1/0x1 action=ARCHIVE archive#=1 flags=0x0 extent=0x0-0x1 gid=0x0",
+		"uuid=x done",
+		// Truncated lines.
+		"dfid=[0x1:0x2:0x0] action=RESTORE",
+		"fid=[0x1:0x2:0x0] action=RESTORE",
+		"fid=[0x1:0x2:0x0] dfid=[0x1:0x2:0x0] compound/cookie=0x1/0x1 action=ARCHIVE archive#=1 flags=0x0",
+	} {
+		if _, err := ParseActiveRequests(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+	if _, err := ParseHsmPolicy("[Bogus]"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
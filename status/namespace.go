@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"os"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/luser"
+)
+
+type rootNamespace struct {
+	root fs.RootDir
+}
+
+// NewNamespace returns an fs.Namespace for the filesystem mounted at
+// root. Queries are answered by the live filesystem.
+func NewNamespace(root fs.RootDir) fs.Namespace {
+	return &rootNamespace{root: root}
+}
+
+func (ns *rootNamespace) FidPathname(f *lustre.Fid, linkno int) (string, error) {
+	return FidPathname(ns.root, f, linkno)
+}
+
+func (ns *rootNamespace) FidPathnames(f *lustre.Fid) ([]string, error) {
+	return FidPathnames(ns.root, f)
+}
+
+func (ns *rootNamespace) LookupFid(path string) (*lustre.Fid, error) {
+	return fs.LookupFid(ns.root.Join(path))
+}
+
+func (ns *rootNamespace) StatFid(f *lustre.Fid) (os.FileInfo, error) {
+	return fs.StatFid(ns.root, f)
+}
+
+func (ns *rootNamespace) LinkEA(f *lustre.Fid) ([]luser.LinkEntry, error) {
+	return luser.GetLinkEA(fs.FidPath(ns.root, f))
+}
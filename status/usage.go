@@ -0,0 +1,99 @@
+// Copyright (c) 2016 Intel Corporation. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TargetUsage is the space usage of a target, as seen by a client.
+type TargetUsage struct {
+	Target      string
+	KBytesTotal uint64
+	KBytesFree  uint64
+	KBytesAvail uint64
+}
+
+// UsedFraction returns the fraction of the target's space in use,
+// between 0 and 1.
+func (u *TargetUsage) UsedFraction() float64 {
+	if u.KBytesTotal == 0 {
+		return 0
+	}
+	return float64(u.KBytesTotal-u.KBytesFree) / float64(u.KBytesTotal)
+}
+
+func (u *TargetUsage) String() string {
+	return fmt.Sprintf("%s: %d/%d KB used", u.Target, u.KBytesTotal-u.KBytesFree, u.KBytesTotal)
+}
+
+func readUint(name string) (uint64, error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+// ReadTargetUsage reads the space usage from a client device directory,
+// such as an OSC directory in /proc/fs/lustre/osc.
+func ReadTargetUsage(dir string, target string) (*TargetUsage, error) {
+	u := &TargetUsage{Target: target}
+	for name, v := range map[string]*uint64{
+		"kbytestotal": &u.KBytesTotal,
+		"kbytesfree":  &u.KBytesFree,
+		"kbytesavail": &u.KBytesAvail,
+	} {
+		var err error
+		if *v, err = readUint(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// OSTUsage returns the space usage of each OST used by the client.
+func (c *LustreClient) OSTUsage() ([]*TargetUsage, error) {
+	var result []*TargetUsage
+	for _, ost := range c.LOVTargets() {
+		u, err := ReadTargetUsage(c.ClientPath("osc", ost), ost)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+// PoolTargets returns the names of the OSTs in an OST pool.
+func (c *LustreClient) PoolTargets(pool string) ([]string, error) {
+	lov := fmt.Sprintf("%s-clilov-%s", c.FsName, c.ClientID)
+	return readPoolTargets(filepath.Join(procBase, "lov", lov, "pools", pool))
+}
+
+func readPoolTargets(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t := strings.TrimSpace(scanner.Text())
+		if t == "" {
+			continue
+		}
+		targets = append(targets, strings.TrimSuffix(t, "_UUID"))
+	}
+	return targets, scanner.Err()
+}